@@ -3,10 +3,14 @@ package api
 import (
 	"errors"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/secrets"
+	"github.com/ansriaz/redzilla/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -52,6 +56,149 @@ func isRootDomain(host, domain string) bool {
 	return host == domain
 }
 
+// instanceRequest is the optional body to create or start an instance
+type instanceRequest struct {
+	NodeSelector map[string]string
+	Image        string
+	Resources    *model.InstanceResources
+	Env          map[string]string
+	Labels       map[string]string
+	Annotations  map[string]string
+	// Secrets are encrypted before being stored
+	Secrets    map[string]string
+	SecretRefs []model.SecretRef
+	// DataVolume is set on create only
+	DataVolume string
+	Mounts     []model.Mount
+	DiskQuota  *int64
+	// ProxyHeaders replace the header rules when set
+	ProxyHeaders []model.HeaderRule
+	// Template provisions a new instance
+	Template string
+}
+
+// apply the requested settings to the instance record
+func (r *instanceRequest) apply(instance *model.Instance) {
+	if r.NodeSelector != nil {
+		instance.NodeSelector = r.NodeSelector
+	}
+	if len(r.Image) > 0 {
+		instance.Image = r.Image
+	}
+	if r.Resources != nil {
+		instance.Resources = *r.Resources
+	}
+	if r.Env != nil {
+		instance.Env = r.Env
+	}
+	if r.Labels != nil {
+		instance.Labels = r.Labels
+	}
+	if r.Annotations != nil {
+		instance.Annotations = r.Annotations
+	}
+	if r.Secrets != nil {
+		instance.Secrets = r.Secrets
+	}
+	if r.SecretRefs != nil {
+		instance.SecretRefs = r.SecretRefs
+	}
+	if len(r.DataVolume) > 0 {
+		instance.DataVolume = r.DataVolume
+	}
+	if r.Mounts != nil {
+		instance.Mounts = normalizeMounts(r.Mounts)
+	}
+	if r.DiskQuota != nil {
+		instance.DiskQuota = *r.DiskQuota
+	}
+	if r.ProxyHeaders != nil {
+		instance.ProxyHeaders = normalizeHeaderRules(r.ProxyHeaders)
+	}
+}
+
+// matchVersion check the If-Match header against the stored record version
+func matchVersion(c *gin.Context, instance *Instance) bool {
+
+	ifMatch := c.GetHeader("If-Match")
+	if len(ifMatch) == 0 {
+		return true
+	}
+
+	version, err := instance.StoredVersion()
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+
+	if !matchETag(ifMatch, version) {
+		c.Header("ETag", formatETag(version))
+		conflict(c)
+		return false
+	}
+
+	return true
+}
+
+// applyTemplate provision a new instance from a template
+func applyTemplate(c *gin.Context, instance *Instance, name string) bool {
+
+	exists, err := instance.Exists()
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+	if exists {
+		errorResponse(c, http.StatusConflict, "Templates apply to new instances only")
+		return false
+	}
+	if len(instance.GetStatus().DataVolume) > 0 {
+		errorResponse(c, http.StatusBadRequest, ErrDataVolume.Error())
+		return false
+	}
+
+	tpl, err := GetTemplate(name, instance.cfg)
+	if err != nil {
+		if os.IsNotExist(err) {
+			errorResponse(c, http.StatusBadRequest, "Template not found")
+			return false
+		}
+		internalError(c, err)
+		return false
+	}
+
+	err = instance.ApplyTemplate(tpl)
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+
+	return true
+}
+
+// secretsError send a bad request if secrets cannot be encrypted
+func secretsError(c *gin.Context, err error) {
+	if err == secrets.ErrNoKey {
+		errorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	internalError(c, err)
+}
+
+// saveError send a conflict response if the record changed concurrently
+// or the operation does not apply to the instance
+func saveError(c *gin.Context, err error) {
+	if err == storage.ErrConflict {
+		conflict(c)
+		return
+	}
+	if err == ErrDataVolume || err == ErrQuotaExceeded {
+		errorResponse(c, http.StatusConflict, err.Error())
+		return
+	}
+	internalError(c, err)
+}
+
 func validateName(name string) (string, error) {
 	re := regexp.MustCompile("[^0-9a-z_-]")
 	if len(re.FindStringSubmatch(name)) > 0 {
@@ -65,11 +212,41 @@ func Start(cfg *model.Config) error {
 
 	router := gin.Default()
 
-	if len(cfg.AuthType) > 0 && cfg.AuthType != "none" {
-		router.Use(AuthHandler(cfg))
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	// client addresses are read from forwarded headers of trusted proxies
+	err = router.SetTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	router.Use(auditHandler(cfg))
+
+	if cfg.TLSEnabled() && cfg.HSTSMaxAge > 0 {
+		router.Use(hstsHandler(cfg))
+	}
+
+	if cfg.UsesAuth(model.AuthOIDC) {
+		initOIDC(cfg)
 	}
 
-	router.Any("/v2/instances/:name", func(c *gin.Context) {
+	if len(cfg.AuthChain) > 0 || len(cfg.AuthProxyChain) > 0 {
+		authHandler, err := AuthHandler(cfg)
+		if err != nil {
+			return err
+		}
+		router.Use(authHandler)
+	}
+
+	if cfg.UsesAuth(model.AuthOIDC) {
+		router.GET(authPathPrefix+"login", loginHandler(cfg))
+		router.GET(authPathPrefix+"callback", callbackHandler(cfg))
+		router.GET(authPathPrefix+"logout", logoutHandler(cfg))
+	}
+
+	router.Any("/v2/instances/:name", authorize(cfg, permInstance), func(c *gin.Context) {
 
 		if !isRootDomain(c.Request.Host, cfg.Domain) {
 			c.Next()
@@ -100,45 +277,124 @@ func Start(cfg *model.Config) error {
 				return
 			}
 
-			c.JSON(http.StatusOK, instance.GetStatus())
+			setETag(c, instance.GetStatus())
+			c.JSON(http.StatusOK, withUsage(instance))
 
 			break
 		case http.MethodPost:
 
 			logrus.Debugf("Start instance %s", name)
+			setAuditAction(c, "instance.start")
 
-			err := instance.Start()
+			if !matchVersion(c, instance) {
+				return
+			}
+
+			req := instanceRequest{}
+			if c.Request.ContentLength > 0 {
+				err := c.BindJSON(&req)
+				if err != nil {
+					return
+				}
+			}
+			err = validateLabels(req.Labels)
+			if err == nil {
+				err = validateSecretRefs(req.SecretRefs)
+			}
+			if err == nil {
+				err = validateMounts(req.Mounts, req.DataVolume, cfg)
+			}
+			if err == nil {
+				err = validateHeaderRules(req.ProxyHeaders)
+			}
 			if err != nil {
-				internalError(c, err)
+				errorResponse(c, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !authorizeSettings(c, cfg, name, req.SecretRefs, req.DataVolume, req.Mounts) {
 				return
 			}
+			if !authorizeLimits(c, req.Image, req.Resources, req.DiskQuota) {
+				return
+			}
+			if len(req.DataVolume) > 0 && req.DataVolume != instance.GetStatus().DataVolume {
+				exists, err := instance.Exists()
+				if err != nil {
+					internalError(c, err)
+					return
+				}
+				if exists {
+					errorResponse(c, http.StatusBadRequest, "DataVolume can be set on create only")
+					return
+				}
+			}
+			req.Secrets, err = encryptSecrets(req.Secrets, cfg)
+			if err != nil {
+				secretsError(c, err)
+				return
+			}
+			previous := *instance.GetStatus()
+			req.apply(instance.GetStatus())
+
+			if len(req.Template) > 0 {
+				if !applyTemplate(c, instance, req.Template) {
+					instance.restore(previous)
+					return
+				}
+			}
 
-			c.JSON(http.StatusOK, instance.GetStatus())
+			err := instance.Start(getPrincipal(c))
+			if err != nil {
+				instance.restore(previous)
+				saveError(c, err)
+				return
+			}
+
+			setETag(c, instance.GetStatus())
+			c.JSON(http.StatusOK, instance.GetStatus().Redact())
 
 			break
 		case http.MethodPut:
 			logrus.Debugf("Restart instance %s", name)
+			setAuditAction(c, "instance.restart")
 
 			if !instanceExists(c, instance) {
 				return
 			}
 
-			err := instance.Restart()
+			if !matchVersion(c, instance) {
+				return
+			}
+
+			err := instance.Restart(getPrincipal(c))
 			if err != nil {
-				internalError(c, err)
+				saveError(c, err)
 				return
 			}
 
-			c.JSON(http.StatusOK, instance.GetStatus())
+			setETag(c, instance.GetStatus())
+			c.JSON(http.StatusOK, instance.GetStatus().Redact())
+
+			break
+		case http.MethodPatch:
+			logrus.Debugf("Update instance %s", name)
+			setAuditAction(c, "instance.update")
+
+			patchInstance(c, instance)
 
 			break
 		case http.MethodDelete:
 			logrus.Debugf("Stop instance %s", name)
+			setAuditAction(c, "instance.stop")
 
 			if !instanceExists(c, instance) {
 				return
 			}
 
+			if !matchVersion(c, instance) {
+				return
+			}
+
 			err := instance.Stop()
 			if err != nil {
 				errorResponse(c, http.StatusInternalServerError, err.Error())
@@ -155,13 +411,19 @@ func Start(cfg *model.Config) error {
 
 	})
 
-	router.GET("/v2/instances", func(c *gin.Context) {
+	router.GET("/v2/instances", authorize(cfg, permList), func(c *gin.Context) {
 
 		if !isRootDomain(c.Request.Host, cfg.Domain) {
 			c.Next()
 			return
 		}
 
+		filter, err := newInstanceFilter(c)
+		if err != nil {
+			errorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
 		logrus.Debug("List instances")
 		list, err := ListInstances(cfg)
 		if err != nil {
@@ -169,11 +431,95 @@ func Start(cfg *model.Config) error {
 			return
 		}
 
-		c.JSON(http.StatusOK, list)
+		page, total := filter.apply(getAccess(c).visibleInstances(*list))
+
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		usages, err := ListUsage(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		usageByName := make(map[string]*model.Usage)
+		for idx := range usages {
+			usageByName[usages[idx].Instance] = &usages[idx]
+		}
+
+		for idx := range page {
+			page[idx].Secrets = page[idx].Redact().Secrets
+			page[idx].Usage = usageByName[page[idx].Name]
+		}
+
+		c.JSON(http.StatusOK, page)
 	})
 
+	router.GET("/v2/instances/:name/backups", authorize(cfg, permRead), backupsHandler(cfg))
+	router.POST("/v2/instances/:name/backups", authorize(cfg, permWrite), backupsHandler(cfg))
+	router.GET("/v2/instances/:name/backups/:id", authorize(cfg, permRead), backupHandler(cfg))
+	router.DELETE("/v2/instances/:name/backups/:id", authorize(cfg, permWrite), backupHandler(cfg))
+	router.POST("/v2/instances/:name/backups/:id/restore", authorize(cfg, permWrite), restoreHandler(cfg))
+
+	router.POST("/v2/bulk", authorize(cfg, permOperate), bulkHandler(cfg))
+
+	router.GET("/v2/instances/:name/flows", authorize(cfg, permRead), flowsHandler(cfg))
+	router.PUT("/v2/instances/:name/flows", authorize(cfg, permWrite), flowsHandler(cfg))
+	router.PUT("/v2/flows", authorize(cfg, permOperate), deployFlowsHandler(cfg))
+	router.GET("/v2/instances/:name/nodes", authorize(cfg, permRead), nodesModulesHandler(cfg))
+	router.POST("/v2/instances/:name/nodes", authorize(cfg, permWrite), nodesModulesHandler(cfg))
+	router.DELETE("/v2/instances/:name/nodes/*module", authorize(cfg, permWrite), nodesModulesHandler(cfg))
+
+	router.GET("/v2/secrets", authorize(cfg, permAdmin), secretsHandler(cfg))
+	router.GET("/v2/secrets/:secret", authorize(cfg, permAdmin), secretHandler(cfg))
+	router.PUT("/v2/secrets/:secret", authorize(cfg, permAdmin), secretHandler(cfg))
+	router.DELETE("/v2/secrets/:secret", authorize(cfg, permAdmin), secretHandler(cfg))
+	router.POST("/v2/secrets/rotate", authorize(cfg, permAdmin), rotateSecretsHandler(cfg))
+
+	router.GET("/v2/templates", authorize(cfg, permList), templatesHandler(cfg))
+	router.GET("/v2/templates/:template", authorize(cfg, permList), templateHandler(cfg))
+	router.PUT("/v2/templates/:template", authorize(cfg, permAdmin), templateHandler(cfg))
+	router.DELETE("/v2/templates/:template", authorize(cfg, permAdmin), templateHandler(cfg))
+
+	router.POST("/v2/instances/:name/clone", authorize(cfg, permWrite), cloneHandler(cfg))
+	router.POST("/v2/instances/:name/rename", authorize(cfg, permWrite), renameHandler(cfg))
+
+	router.GET("/v2/instances/:name/domains", authorize(cfg, permRead), domainsHandler(cfg))
+	router.POST("/v2/instances/:name/domains", authorize(cfg, permWrite), domainsHandler(cfg))
+	router.GET("/v2/instances/:name/domains/:host", authorize(cfg, permRead), domainHandler(cfg))
+	router.DELETE("/v2/instances/:name/domains/:host", authorize(cfg, permWrite), domainHandler(cfg))
+	router.POST("/v2/instances/:name/domains/:host/verify", authorize(cfg, permWrite), verifyDomainHandler(cfg))
+
+	router.GET("/v2/usage", authorize(cfg, permList), usageHandler(cfg))
+	router.GET("/v2/instances/:name/usage", authorize(cfg, permRead), instanceUsageHandler(cfg))
+
+	router.GET("/v2/audit", authorize(cfg, permAdmin), auditQueryHandler(cfg))
+
+	router.GET("/v2/nodes", authorize(cfg, permAdmin), nodesHandler(cfg))
+	router.POST("/v2/nodes/:node/drain", authorize(cfg, permAdmin), nodeDrainHandler(cfg))
+	router.DELETE("/v2/nodes/:node/drain", authorize(cfg, permAdmin), nodeDrainHandler(cfg))
+
+	router.GET("/v2/access", authorize(cfg, permList), accessHandler(cfg))
+	router.GET("/v2/tokens", authorize(cfg, permList), tokensHandler(cfg))
+	router.POST("/v2/tokens", authorize(cfg, permList), tokensHandler(cfg))
+	router.GET("/v2/tokens/:token", authorize(cfg, permList), tokenHandler(cfg))
+	router.DELETE("/v2/tokens/:token", authorize(cfg, permList), tokenHandler(cfg))
+	router.GET("/v2/grants", authorize(cfg, permAdmin), grantsHandler(cfg))
+	router.GET("/v2/grants/:subject", authorize(cfg, permAdmin), grantHandler(cfg))
+	router.PUT("/v2/grants/:subject", authorize(cfg, permAdmin), grantHandler(cfg))
+	router.DELETE("/v2/grants/:subject", authorize(cfg, permAdmin), grantHandler(cfg))
+	router.GET("/v2/teams", authorize(cfg, permAdmin), teamsHandler(cfg))
+	router.GET("/v2/teams/:team", authorize(cfg, permAdmin), teamHandler(cfg))
+	router.PUT("/v2/teams/:team", authorize(cfg, permAdmin), teamHandler(cfg))
+	router.DELETE("/v2/teams/:team", authorize(cfg, permAdmin), teamHandler(cfg))
+
 	// reverse proxy
-	router.Use(proxyHandler(cfg))
+	backendTLS, err := newBackendTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	router.Use(proxyHandler(cfg, backendTLS, proxies))
+
+	if cfg.TLSEnabled() {
+		return serveTLS(router, cfg)
+	}
 
 	logrus.Infof("Starting API at %s", cfg.APIPort)
 	return router.Run(cfg.APIPort)
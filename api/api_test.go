@@ -1,7 +1,19 @@
 package api
 
 import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
 )
 
 func TestIsRootDomain(t *testing.T) {
@@ -39,3 +51,328 @@ func TestValidateName(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMatchETag(t *testing.T) {
+	if !matchETag(`"3"`, 3) {
+		t.Fail()
+	}
+	if !matchETag(`"1", W/"3"`, 3) {
+		t.Fail()
+	}
+	if !matchETag(`*`, 7) {
+		t.Fail()
+	}
+	if matchETag(`"2"`, 3) {
+		t.Fail()
+	}
+}
+
+func TestIsCredentialsFile(t *testing.T) {
+	if !isCredentialsFile("flows_cred.json") {
+		t.Fail()
+	}
+	if !isCredentialsFile("flows_myhost_cred.json") {
+		t.Fail()
+	}
+	if isCredentialsFile("flows.json") {
+		t.Fail()
+	}
+	if isCredentialsFile("node_modules/foo/test_cred.json") {
+		t.Fail()
+	}
+}
+
+func TestRollbackOrder(t *testing.T) {
+	steps := ""
+	var undo rollback
+	undo.add(func() error { steps += "a"; return nil })
+	undo.add(func() error { steps += "b"; return nil })
+	undo.run()
+	if steps != "ba" {
+		t.Fatalf("Unexpected rollback order %s", steps)
+	}
+}
+
+func TestValidDeploymentType(t *testing.T) {
+	for _, deploymentType := range []string{"", "full", "nodes", "flows", "reload"} {
+		if !validDeploymentType(deploymentType) {
+			t.Fatalf("Deployment type %s should be valid", deploymentType)
+		}
+	}
+	if validDeploymentType("partial") {
+		t.Fatal("Unknown deployment type should be invalid")
+	}
+}
+
+func TestRunBulkAbort(t *testing.T) {
+	req := &bulkRequest{Action: "restart", BatchSize: 2, Concurrency: 1, MaxFailures: 0}
+	names := []string{"a", "b", "c", "d", "e"}
+
+	res := runBulk(req, names, func(name string) error {
+		if name == "b" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	if !res.Aborted || res.Failures != 1 {
+		t.Fatalf("Expected abort after one failure, got %+v", res)
+	}
+	expected := []string{bulkSuccess, bulkFailure, bulkSkipped, bulkSkipped, bulkSkipped}
+	for idx, result := range res.Results {
+		if result.Instance != names[idx] || result.Status != expected[idx] {
+			t.Fatalf("Unexpected result %d: %+v", idx, result)
+		}
+	}
+}
+
+func TestInstanceFilter(t *testing.T) {
+	list := []model.Instance{
+		{Name: "tenant-b", Status: model.InstanceStarted, Labels: map[string]string{"env": "prod"}},
+		{Name: "tenant-a", Status: model.InstanceStarted, Labels: map[string]string{"env": "prod"}},
+		{Name: "tenant-c", Status: model.InstanceStopped, Labels: map[string]string{"env": "prod"}},
+		{Name: "other", Status: model.InstanceStarted, Labels: map[string]string{"env": "prod"}},
+		{Name: "tenant-d", Status: model.InstanceStarted, Labels: map[string]string{"env": "dev"}},
+	}
+
+	f := &instanceFilter{
+		Selector: map[string]string{"env": "prod"},
+		Status:   "started",
+		Prefix:   "tenant-",
+		Sort:     "-name",
+		Limit:    1,
+	}
+	page, total := f.apply(list)
+	if total != 2 || len(page) != 1 || page[0].Name != "tenant-b" {
+		t.Fatalf("Unexpected page %d %+v", total, page)
+	}
+
+	f.Offset = 1
+	page, _ = f.apply(list)
+	if len(page) != 1 || page[0].Name != "tenant-a" {
+		t.Fatalf("Unexpected second page %+v", page)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	if validateLabels(map[string]string{"env": "prod", "example.com/team": "iot"}) != nil {
+		t.Fatal("Labels should be valid")
+	}
+	if validateLabels(map[string]string{"redzilla": "0"}) == nil {
+		t.Fatal("Reserved label should be refused")
+	}
+	if validateLabels(map[string]string{"bad key": "x"}) == nil {
+		t.Fatal("Invalid key should be refused")
+	}
+}
+
+func TestValidateMounts(t *testing.T) {
+	cfg := &model.Config{MountAllowList: []string{"/srv/shared"}}
+
+	valid := []model.Mount{
+		{Type: model.MountVolume, Source: "tenant-files", Target: "/files"},
+		{Type: model.MountBind, Source: "/srv/shared/maps", Target: "/maps"},
+		{Type: model.MountTmpfs, Target: "/tmp/cache", Size: 1 << 20},
+	}
+	if err := validateMounts(valid, "tenant-data", cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]model.Mount{
+		{{Type: model.MountBind, Source: "/srv/shared/../../etc", Target: "/etc-copy"}},
+		{{Type: model.MountBind, Source: "/srv/sharedother", Target: "/other"}},
+		{{Type: model.MountVolume, Source: "files", Target: "/data/files"}},
+		{{Type: model.MountVolume, Source: "files", Target: "relative"}},
+		{{Type: model.MountTmpfs, Target: "/a"}, {Type: model.MountTmpfs, Target: "/a/"}},
+		{{Type: "npipe", Target: "/pipe"}},
+	}
+	for idx, mounts := range invalid {
+		if validateMounts(mounts, "", cfg) == nil {
+			t.Fatalf("Mounts %d should be refused", idx)
+		}
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redzilla-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "flows.json"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "lib", "node.js"), make([]byte, 50), 0644)
+	ioutil.WriteFile(filepath.Join(dir, instanceLogFile), make([]byte, 1000), 0644)
+
+	size, err := dirSize(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 150 {
+		t.Fatalf("Expected 150 bytes without log, got %d", size)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	owned := &model.Instance{Name: "a", Owner: "alice"}
+	shared := &model.Instance{Name: "b", Owner: "bob", Team: "iot"}
+	other := &model.Instance{Name: "c", Owner: "bob"}
+
+	operator := &access{Principal: "alice", Role: model.RoleOperator, Teams: []string{"iot"}}
+	if !operator.canWrite(owned) || !operator.canWrite(shared) || operator.canRead(other) {
+		t.Fatal("Operator should reach owned and team instances only")
+	}
+
+	viewer := &access{Principal: "alice", Role: model.RoleViewer}
+	if !viewer.canRead(owned) || viewer.canWrite(owned) || viewer.canRead(shared) {
+		t.Fatal("Viewer should only read owned instances")
+	}
+
+	admin := &access{Principal: "root", Role: model.RoleAdmin}
+	if !admin.canWrite(other) {
+		t.Fatal("Admin should change any instance")
+	}
+
+	var disabled *access
+	if !disabled.canWrite(other) || len(disabled.visibleInstances([]model.Instance{*other})) != 1 {
+		t.Fatal("Nil access should allow everything")
+	}
+
+	visible := operator.visibleInstances([]model.Instance{*owned, *shared, *other})
+	if len(visible) != 2 {
+		t.Fatalf("Expected 2 visible instances, got %d", len(visible))
+	}
+
+	if validateSubject("team:iot") != nil || validateSubject("alice@example.com") != nil {
+		t.Fatal("Valid subjects refused")
+	}
+	if validateSubject("../alice") == nil || validateSubject("team:IoT") == nil || validateSubject("") == nil {
+		t.Fatal("Invalid subjects accepted")
+	}
+}
+
+func TestTokenAccess(t *testing.T) {
+	owned := &model.Instance{Name: "a", Owner: "ci"}
+	other := &model.Instance{Name: "b", Owner: "ci"}
+
+	read := &access{Principal: "ci", Role: model.RoleAdmin, Scopes: []string{model.ScopeRead}}
+	if !read.canRead(owned) || read.canWrite(owned) || read.isAdmin() {
+		t.Fatal("Read token should only read")
+	}
+
+	lifecycle := &access{Principal: "ci", Role: model.RoleOperator, Scopes: []string{model.ScopeLifecycle}, Instances: []string{"a"}}
+	if !lifecycle.canRead(owned) || !lifecycle.canWrite(owned) || lifecycle.canRead(other) {
+		t.Fatal("Lifecycle token should be restricted to its instances")
+	}
+
+	id, value, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokenIDRegexp.MatchString(id) || !strings.HasPrefix(value, apiTokenPrefix+id+"_") {
+		t.Fatalf("Unexpected token format %s", value)
+	}
+	if _, err := VerifyToken("rzt_../../x_y", nil); err != ErrInvalidToken {
+		t.Fatal("Malformed token should be refused")
+	}
+	if !lifecycle.allowsToken([]string{model.ScopeRead}, []string{"a"}) ||
+		lifecycle.allowsToken([]string{model.ScopeAdmin}, []string{"a"}) ||
+		lifecycle.allowsToken([]string{model.ScopeRead}, nil) ||
+		lifecycle.allowsToken([]string{model.ScopeRead}, []string{"a", "b"}) {
+		t.Fatal("Tokens issued by a token should be within its scopes and instances")
+	}
+	if validateScopes([]string{"read", "write"}) == nil || validateScopes(nil) == nil {
+		t.Fatal("Invalid scopes accepted")
+	}
+
+	parent := &model.Token{Expires: time.Now().Add(time.Hour)}
+	if expires, err := tokenExpiry(parent, time.Now().Add(24*time.Hour)); err != nil || !expires.Equal(parent.Expires) {
+		t.Fatalf("Expiry should be capped to the parent token, got %s (%v)", expires, err)
+	}
+	if _, err := tokenExpiry(parent, time.Time{}); err == nil {
+		t.Fatal("Token without expiry issued by an expiring token should be refused")
+	}
+	if expires, err := tokenExpiry(&model.Token{}, time.Time{}); err != nil || !expires.IsZero() {
+		t.Fatal("Token without expiry should be allowed from a token without expiry")
+	}
+}
+
+func TestRestoreInstance(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "redzilla-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &model.Config{StorePath: dir}
+	instance := &Instance{instance: model.NewInstance("tenant"), cfg: cfg, store: storage.GetStore(instanceCollection, cfg)}
+
+	previous := *instance.GetStatus()
+	instance.GetStatus().Env = map[string]string{"MODE": "new"}
+	instance.restore(previous)
+	if instance.GetStatus().Env != nil {
+		t.Fatalf("Failed change on a new instance should be dropped, got %v", instance.GetStatus().Env)
+	}
+
+	instance.GetStatus().Env = map[string]string{"MODE": "stored"}
+	if err := instance.Save("alice", "create"); err != nil {
+		t.Fatal(err)
+	}
+	instance.GetStatus().IP = "10.0.0.5"
+
+	previous = *instance.GetStatus()
+	instance.GetStatus().Env = map[string]string{"MODE": "rejected"}
+	instance.restore(previous)
+	if instance.GetStatus().Env["MODE"] != "stored" || instance.GetStatus().IP != "10.0.0.5" {
+		t.Fatalf("Stored record should be restored keeping runtime state, got %+v", instance.GetStatus())
+	}
+}
+
+func TestAuthorizeLimits(t *testing.T) {
+
+	quota := int64(-1)
+	for _, tc := range []struct {
+		access  *access
+		allowed bool
+	}{
+		{&access{Principal: "root", Role: model.RoleAdmin}, true},
+		{&access{Principal: "alice", Role: model.RoleOperator}, false},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set(accessKey, tc.access)
+		if authorizeLimits(c, "", nil, &quota) != tc.allowed {
+			t.Fatalf("DiskQuota for %s should be allowed=%v", tc.access.Role, tc.allowed)
+		}
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set(accessKey, &access{Principal: "alice", Role: model.RoleOperator})
+	if !authorizeLimits(c, "", nil, nil) {
+		t.Fatal("Requests without limits should be allowed")
+	}
+
+	if !isSafeMethod(http.MethodGet) || isSafeMethod(http.MethodPost) || isSafeMethod(http.MethodDelete) {
+		t.Fatal("Only read methods should be safe")
+	}
+}
+
+func TestVolumeOwnership(t *testing.T) {
+
+	if !ownVolume("foo", "foo") || !ownVolume("foo", "foo.cache") {
+		t.Fatal("Volumes named after the instance should be allowed")
+	}
+	if ownVolume("foo", "foo-bar") || ownVolume("foo", "foo_bar") || ownVolume("foo", "foobar") {
+		t.Fatal("Volumes of instances sharing the name prefix should be refused")
+	}
+
+	list := []model.Instance{
+		{Name: "foo"},
+		{Name: "foo-bar", DataVolume: "foo.data"},
+		{Name: "baz", Mounts: []model.Mount{{Type: model.MountVolume, Source: "foo.cache", Target: "/cache"}}},
+	}
+	if volumeUser(list, "foo.data") != "foo-bar" || volumeUser(list, "foo.cache") != "baz" || volumeUser(list, "foo.new") != "" {
+		t.Fatal("Volume users should be found by data volume and mounts")
+	}
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// auditActionKey is the context key naming the action of a request
+const auditActionKey = "auditAction"
+
+// defaultAuditLimit is the max number of entries returned by a query
+const defaultAuditLimit = 100
+
+var errAuditUnavailable = errors.New("Audit log not available")
+
+var auditLog *storage.AppendLog
+var auditLogMutex sync.Mutex
+
+// getAuditLog return the audit log, opening it on first use
+func getAuditLog(cfg *model.Config) *storage.AppendLog {
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	if auditLog == nil {
+		l, err := storage.NewAppendLog(cfg.AuditLogPath)
+		if err != nil {
+			logrus.Errorf("Failed to open audit log at %s: %s", cfg.AuditLogPath, err.Error())
+			return nil
+		}
+		auditLog = l
+	}
+	return auditLog
+}
+
+// recordAudit append an entry to the audit log
+func recordAudit(cfg *model.Config, entry *model.AuditEntry) {
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Replica = cfg.ReplicaID
+
+	l := getAuditLog(cfg)
+	if l == nil {
+		return
+	}
+
+	err := l.Append(entry)
+	if err != nil {
+		logrus.Errorf("Failed to write audit entry %s %s: %s", entry.Action, entry.Instance, err.Error())
+	}
+}
+
+// RecordSystemAudit record an action performed automatically by redzilla
+func RecordSystemAudit(cfg *model.Config, action, name string, err error) {
+
+	entry := &model.AuditEntry{
+		Principal: SystemPrincipal,
+		Action:    action,
+		Instance:  name,
+		Source:    SystemPrincipal,
+		Outcome:   model.AuditSuccess,
+	}
+	if err != nil {
+		entry.Outcome = model.AuditFailure
+		entry.Message = err.Error()
+	}
+
+	recordAudit(cfg, entry)
+}
+
+// setAuditAction name the action performed by the current request
+func setAuditAction(c *gin.Context, action string) {
+	c.Set(auditActionKey, action)
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// auditHandler record the outcome of mutating API calls
+func auditHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isMutating(c.Request.Method) ||
+			!isRootDomain(c.Request.Host, cfg.Domain) ||
+			!strings.HasPrefix(c.Request.URL.Path, "/v2/") {
+			c.Next()
+			return
+		}
+
+		c.Next()
+
+		action := c.GetString(auditActionKey)
+		if len(action) == 0 {
+			action = c.Request.Method + " " + c.Request.URL.Path
+		}
+
+		status := c.Writer.Status()
+		outcome := model.AuditSuccess
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			outcome = model.AuditDenied
+		} else if status >= 400 {
+			outcome = model.AuditFailure
+		}
+
+		entry := &model.AuditEntry{
+			Principal: getPrincipal(c),
+			Action:    action,
+			Instance:  c.Param("name"),
+			Source:    c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			Outcome:   outcome,
+			Status:    status,
+		}
+		if len(c.Errors) > 0 {
+			entry.Message = c.Errors.String()
+		}
+
+		recordAudit(cfg, entry)
+	}
+}
+
+// auditFilter select audit entries from query parameters
+type auditFilter struct {
+	Principal string
+	Action    string
+	Instance  string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f *auditFilter) match(entry *model.AuditEntry) bool {
+	if len(f.Principal) > 0 && entry.Principal != f.Principal {
+		return false
+	}
+	if len(f.Action) > 0 && entry.Action != f.Action {
+		return false
+	}
+	if len(f.Instance) > 0 && entry.Instance != f.Instance {
+		return false
+	}
+	if len(f.Outcome) > 0 && entry.Outcome != f.Outcome {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+func parseAuditFilter(c *gin.Context) (*auditFilter, error) {
+
+	f := &auditFilter{
+		Principal: c.Query("principal"),
+		Action:    c.Query("action"),
+		Instance:  c.Query("instance"),
+		Outcome:   c.Query("outcome"),
+	}
+
+	var err error
+	if since := c.Query("since"); len(since) > 0 {
+		f.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if until := c.Query("until"); len(until) > 0 {
+		f.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// auditQueryHandler list audit entries as JSON or export them as JSON lines
+func auditQueryHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			errorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		limit := defaultAuditLimit
+		if rawLimit := c.Query("limit"); len(rawLimit) > 0 {
+			limit, err = strconv.Atoi(rawLimit)
+			if err != nil || limit < 0 {
+				errorResponse(c, http.StatusBadRequest, "Invalid limit")
+				return
+			}
+		}
+
+		export := c.Query("format") == "jsonl" ||
+			strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+
+		l := getAuditLog(cfg)
+		if l == nil {
+			internalError(c, errAuditUnavailable)
+			return
+		}
+
+		if export {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+			err = l.Scan(func(line []byte) error {
+				entry := new(model.AuditEntry)
+				if jerr := json.Unmarshal(line, entry); jerr != nil || !filter.match(entry) {
+					return nil
+				}
+				_, werr := c.Writer.Write(line)
+				if werr != nil {
+					return werr
+				}
+				_, werr = c.Writer.Write([]byte("\n"))
+				return werr
+			})
+			if err != nil {
+				logrus.Warnf("Failed to export audit log: %s", err.Error())
+			}
+			return
+		}
+
+		list := make([]model.AuditEntry, 0)
+		err = l.Scan(func(line []byte) error {
+			entry := model.AuditEntry{}
+			if jerr := json.Unmarshal(line, &entry); jerr != nil {
+				logrus.Warnf("Skipping invalid audit entry: %s", jerr.Error())
+				return nil
+			}
+			if filter.match(&entry) {
+				list = append(list, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		// keep the most recent entries
+		if limit > 0 && len(list) > limit {
+			list = list[len(list)-limit:]
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
@@ -2,8 +2,12 @@ package api
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +16,49 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// principalKey is the context key storing the authenticated principal
+const principalKey = "principal"
+
+// groupsKey is the context key storing the groups of the principal
+const groupsKey = "groups"
+
+// actionsKey is the context key storing the actions allowed by the auth
+// service
+const actionsKey = "actions"
+
+// upstreamHeadersKey is the context key storing the headers to add to
+// requests proxied to instances
+const upstreamHeadersKey = "upstreamHeaders"
+
+// anonymousPrincipal is used when no principal is known
+const anonymousPrincipal = "anonymous"
+
+// SystemPrincipal is used for actions taken automatically by redzilla
+const SystemPrincipal = "system"
+
+// AuthResult is the outcome of an authentication request
+type AuthResult struct {
+	Allowed   bool
+	Principal string
+	Groups    []string
+	// Actions allowed to the principal, as token scopes, nil allows all
+	Actions []string
+	// Headers are added to requests proxied to the instance
+	Headers map[string]string
+	// TTL the decision can be cached for, zero is not cached
+	TTL time.Duration
+}
+
+// authResponse is the JSON body an auth service can reply with. Services
+// replying with a status code only keep working, 2xx allows the request
+type authResponse struct {
+	Allowed   *bool             `json:"allowed"`
+	Principal string            `json:"principal"`
+	Groups    []string          `json:"groups"`
+	Actions   []string          `json:"actions"`
+	Headers   map[string]string `json:"headers"`
+}
+
 //RequestBodyTemplate contains params avail in the body template
 type RequestBodyTemplate struct {
 	Url       string
@@ -21,42 +68,169 @@ type RequestBodyTemplate struct {
 	HeaderVal string
 }
 
-// AuthHandler handle authentication and authorization
-func AuthHandler(cfg *model.Config) func(c *gin.Context) {
+// AuthHandler handle authentication through the providers chain of the
+// management API or of the proxied instances traffic
+func AuthHandler(cfg *model.Config) (func(c *gin.Context), error) {
+
+	apiChain, err := newAuthChain(cfg.AuthChain, cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxyChain, err := newAuthChain(cfg.AuthProxyChain, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(c *gin.Context) {
+		if !isProxied(c.Request, cfg) {
+			apiChain.authenticate(c, cfg)
+			return
+		}
+		proxyChain.authenticate(c, cfg)
+	}, nil
+}
 
-		switch strings.ToLower(cfg.AuthType) {
-		case "http":
+// httpAuthenticate ask the auth service, it decides every request carrying
+// the credential header. Requests without it are left to the next provider
+func httpAuthenticate(c *gin.Context, cfg *model.Config) bool {
 
-			reqArgs := new(RequestBodyTemplate)
-			reqArgs.Url = c.Request.URL.String()
-			reqArgs.Method = c.Request.Method
-			reqArgs.Name = c.Param("name")
-			reqArgs.HeaderKey = cfg.AuthHttp.Header
-			reqArgs.HeaderVal = c.Request.Header.Get(cfg.AuthHttp.Header)
+	if len(c.Request.Header.Get(cfg.AuthHttp.Header)) == 0 {
+		return false
+	}
 
-			res, err := doRequest(reqArgs, cfg.AuthHttp)
-			if err != nil {
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
+	reqArgs := new(RequestBodyTemplate)
+	reqArgs.Url = c.Request.URL.String()
+	reqArgs.Method = c.Request.Method
+	reqArgs.Name = c.Param("name")
+	if len(reqArgs.Name) == 0 {
+		reqArgs.Name = requestInstance(c.Request, cfg)
+	}
+	reqArgs.HeaderKey = cfg.AuthHttp.Header
+	reqArgs.HeaderVal = c.Request.Header.Get(cfg.AuthHttp.Header)
+
+	res, err := cachedRequest(reqArgs, cfg.AuthHttp)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+
+	if !res.Allowed {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return true
+	}
+
+	c.Set(principalKey, res.Principal)
+	if res.Groups != nil {
+		c.Set(groupsKey, res.Groups)
+	}
+	if res.Actions != nil {
+		c.Set(actionsKey, res.Actions)
+	}
+	if len(res.Headers) > 0 {
+		c.Set(upstreamHeadersKey, res.Headers)
+	}
+	if isProxied(c.Request, cfg) {
+		c.Request.Header.Del(cfg.AuthHttp.Header)
+	}
 
-			if res {
-				c.Next()
-				return
+	return true
+}
+
+// getPrincipal return the principal of the current request
+func getPrincipal(c *gin.Context) string {
+	principal := c.GetString(principalKey)
+	if len(principal) == 0 {
+		return anonymousPrincipal
+	}
+	return principal
+}
+
+// getGroups return the groups of the principal, if provided at login
+func getGroups(c *gin.Context) []string {
+	if groups, ok := c.Get(groupsKey); ok {
+		if list, ok := groups.([]string); ok {
+			return list
+		}
+	}
+	return nil
+}
+
+// getActions return the actions allowed by the auth service, nil if it
+// did not restrict them
+func getActions(c *gin.Context) []string {
+	if actions, ok := c.Get(actionsKey); ok {
+		if list, ok := actions.([]string); ok {
+			return list
+		}
+	}
+	return nil
+}
+
+// credentialPrincipal derive a principal from the credential when the auth
+// service does not provide one, without exposing the credential itself
+func credentialPrincipal(headerVal string) string {
+	if len(headerVal) == 0 {
+		return ""
+	}
+	req := http.Request{Header: http.Header{}}
+	req.Header.Set("Authorization", headerVal)
+	if user, _, ok := req.BasicAuth(); ok {
+		return user
+	}
+	sum := sha256.Sum256([]byte(headerVal))
+	return "credential:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// readAuthResponse apply the JSON body of a 2xx auth service response to
+// the result. The X-Auth-Principal header takes precedence on the body
+func readAuthResponse(resp *http.Response, result *AuthResult) {
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && len(body) > 0 {
+		payload := authResponse{}
+		if json.Unmarshal(body, &payload) == nil {
+			if payload.Allowed != nil {
+				result.Allowed = *payload.Allowed
+			}
+			result.Principal = payload.Principal
+			result.Groups = payload.Groups
+			result.Headers = payload.Headers
+			if payload.Actions != nil {
+				result.Actions = lowerAll(payload.Actions)
 			}
+		}
+	}
 
-			c.AbortWithStatus(401)
+	if principal := resp.Header.Get("X-Auth-Principal"); len(principal) > 0 {
+		result.Principal = principal
+	}
+}
 
-			break
-		case "none":
-		case "":
-			//no auth, go on
+// cacheTTL read how long a decision can be cached from Cache-Control,
+// falling back to the configured TTL
+func cacheTTL(header string, fallback time.Duration) time.Duration {
+	if len(header) == 0 {
+		return fallback
+	}
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			return 0
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
 		}
 	}
+	return fallback
 }
 
-func doRequest(reqArgs *RequestBodyTemplate, a *model.AuthHttp) (bool, error) {
+func doRequest(reqArgs *RequestBodyTemplate, a *model.AuthHttp) (*AuthResult, error) {
+
+	result := new(AuthResult)
 
 	url := a.URL
 	method := strings.ToUpper(a.Method)
@@ -64,10 +238,12 @@ func doRequest(reqArgs *RequestBodyTemplate, a *model.AuthHttp) (bool, error) {
 
 	var body bytes.Buffer
 
-	err := bodyTemplate.Execute(&body, reqArgs)
-	if err != nil {
-		logrus.Warnf("Template execution failed: %s", err)
-		return false, err
+	if bodyTemplate != nil {
+		err := bodyTemplate.Execute(&body, reqArgs)
+		if err != nil {
+			logrus.Warnf("Template execution failed: %s", err)
+			return result, err
+		}
 	}
 
 	client := new(http.Client)
@@ -75,28 +251,36 @@ func doRequest(reqArgs *RequestBodyTemplate, a *model.AuthHttp) (bool, error) {
 	req, err := http.NewRequest(method, url, &body)
 	if err != nil {
 		logrus.Warnf("Auth request creation failed: %s", err)
-		return false, err
+		return result, err
 	}
 
 	req.Header.Add(reqArgs.HeaderKey, reqArgs.HeaderVal)
 	resp, err := client.Do(req)
 	if err != nil {
 		logrus.Warnf("Auth request creation failed: %s", err)
-		return false, err
+		return result, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return true, nil
+		result.Allowed = true
+		readAuthResponse(resp, result)
+		if len(result.Principal) == 0 {
+			result.Principal = credentialPrincipal(reqArgs.HeaderVal)
+		}
+		result.TTL = cacheTTL(resp.Header.Get("Cache-Control"), a.CacheTTL)
+		return result, nil
 	}
 	if resp.StatusCode >= 500 {
-		logrus.Warnf("Auth request failed with code %s", resp.StatusCode)
+		logrus.Warnf("Auth request failed with code %d", resp.StatusCode)
 		body, err := ioutil.ReadAll(resp.Body)
 		if err == nil {
 			logrus.Warnf("Response body: %s", string(body))
 		}
-		return false, err
+		return result, err
 	}
 
 	logrus.Debugf("Request unauthorized %s %s [response code: %d]", reqArgs.Method, reqArgs.Url, resp.StatusCode)
-	return false, nil
+	result.TTL = cacheTTL(resp.Header.Get("Cache-Control"), a.CacheTTL)
+	return result, nil
 }
@@ -1,14 +1,18 @@
 package api
 
 import (
-	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuthReqPost(t *testing.T) {
@@ -26,41 +30,228 @@ func TestAuthReqPost(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	var headerValue, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerValue = r.Header.Get(reqArgs.HeaderKey)
+		raw, _ := ioutil.ReadAll(r.Body)
+		body = string(raw)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
 	a := &model.AuthHttp{
 		Body:   tmpl,
 		Header: "Authorization",
 		Method: "POST",
-		URL:    "http://localhost:50999/test",
-	}
-
-	go func() {
-		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			headerValue := r.Header.Get(reqArgs.HeaderKey)
-			body, err1 := ioutil.ReadAll(r.Body)
-			if err1 != nil {
-				t.Fatal(err1)
-				return
-			}
-
-			fmt.Printf("Got request `%s %s`\n", r.Method, r.URL.String())
-			fmt.Printf("Header `%s`\n", headerValue)
-			fmt.Printf("Body `%s`\n", body)
-
-			w.WriteHeader(http.StatusUnauthorized)
-		})
-		err1 := http.ListenAndServe("localhost:50999", h)
-		if err1 != nil {
-			t.Fatal(err1)
+		URL:    server.URL + "/test",
+	}
+
+	res, err := doRequest(reqArgs, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Allowed {
+		t.Fatal("Request should be denied")
+	}
+	if headerValue != "Bearer foobar" || !strings.Contains(body, `"instance": "myInstance"`) {
+		t.Fatalf("Unexpected request header %s body %s", headerValue, body)
+	}
+}
+
+func TestAuthResponseContract(t *testing.T) {
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		w.Write([]byte(`{"allowed": true, "principal": "alice", "actions": ["Read"], "headers": {"X-User": "alice"}}`))
+	}))
+	defer server.Close()
+
+	a := &model.AuthHttp{Header: "Authorization", Method: "GET", URL: server.URL}
+	reqArgs := &RequestBodyTemplate{HeaderKey: "Authorization", HeaderVal: "Bearer contract", Name: "tenant"}
+
+	res, err := cachedRequest(reqArgs, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed || res.Principal != "alice" || res.TTL != time.Minute {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if len(res.Actions) != 1 || res.Actions[0] != "read" || res.Headers["X-User"] != "alice" {
+		t.Fatalf("Unexpected actions %v or headers %v", res.Actions, res.Headers)
+	}
+
+	_, err = cachedRequest(reqArgs, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("Decision should be cached, got %d calls", calls)
+	}
+
+	reqArgs.Name = "other"
+	cachedRequest(reqArgs, a)
+	if calls != 2 {
+		t.Fatal("Decision should be cached per instance")
+	}
+
+	reqArgs.Method = http.MethodDelete
+	cachedRequest(reqArgs, a)
+	reqArgs.Url = "/v2/instances/other"
+	cachedRequest(reqArgs, a)
+	if calls != 4 {
+		t.Fatalf("Decision should be cached per method and URL, got %d calls", calls)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	if cacheTTL("", time.Second) != time.Second {
+		t.Fatal("Fallback expected without Cache-Control")
+	}
+	if cacheTTL("no-store", time.Second) != 0 || cacheTTL("max-age=0", time.Second) != 0 {
+		t.Fatal("Decision should not be cached")
+	}
+	if cacheTTL("public, max-age=30", 0) != 30*time.Second {
+		t.Fatal("max-age should be honoured")
+	}
+}
+
+func TestCredentialPrincipal(t *testing.T) {
+	if credentialPrincipal("Basic dXNlcjpwYXNz") != "user" {
+		t.Fail()
+	}
+	p := credentialPrincipal("Bearer foobar")
+	if p == "" || p == "Bearer foobar" {
+		t.Fatalf("Unexpected principal %s", p)
+	}
+	if credentialPrincipal("") != "" {
+		t.Fail()
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	key := []byte("test-session-key")
+
+	value, err := signValue(key, &session{Principal: "user@example.com", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(session)
+	if err := verifyValue(key, value, s); err != nil || s.Principal != "user@example.com" {
+		t.Fatalf("Unexpected session %+v: %v", s, err)
+	}
+
+	if err := verifyValue([]byte("other-key"), value, s); err == nil {
+		t.Fatal("Session signed with another key should be refused")
+	}
+}
+
+func TestSessionRequestAllowed(t *testing.T) {
+	cfg := &model.Config{Domain: "redzilla.localhost"}
+
+	request := func(method string, header map[string]string) *http.Request {
+		req := httptest.NewRequest(method, "http://redzilla.localhost:3000/v2/tokens", strings.NewReader("{}"))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		return req
+	}
+
+	for _, req := range []*http.Request{
+		request(http.MethodGet, nil),
+		request(http.MethodPost, map[string]string{"Origin": "http://redzilla.localhost:3000"}),
+		request(http.MethodPost, map[string]string{"X-Requested-With": "XMLHttpRequest"}),
+	} {
+		if !sessionRequestAllowed(req, cfg) {
+			t.Fatalf("%s with %v should be allowed", req.Method, req.Header)
 		}
-	}()
+	}
+
+	for _, req := range []*http.Request{
+		request(http.MethodPost, nil),
+		request(http.MethodPost, map[string]string{"Origin": "http://tenant.redzilla.localhost:3000"}),
+		request(http.MethodDelete, map[string]string{"Origin": "null"}),
+	} {
+		if sessionRequestAllowed(req, cfg) {
+			t.Fatalf("%s with %v should be refused", req.Method, req.Header)
+		}
+	}
+}
 
-	time.Sleep(time.Millisecond * 500)
+func TestSafeReturnURL(t *testing.T) {
+	cfg := &model.Config{Domain: "redzilla.localhost"}
 
-	res, err := doRequest(reqArgs, a)
+	valid := "http://tenant.redzilla.localhost:3000/red/"
+	if safeReturnURL(valid, cfg) != valid {
+		t.Fatalf("Subdomain URL should be kept")
+	}
+	for _, raw := range []string{"https://evil.example.com/", "//evil.example.com", "javascript:alert(1)", "http://redzilla.localhost.evil.com/"} {
+		if safeReturnURL(raw, cfg) != "/" {
+			t.Fatalf("URL %s should be refused", raw)
+		}
+	}
+}
+
+func TestAuthChain(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "htpasswd")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.Remove(file.Name())
+	// {SHA} of "password"
+	file.WriteString("# users\nalice:" + string(hash) + "\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	file.Close()
+
+	cfg := &model.Config{Domain: "redzilla.localhost", AuthHtpasswdFile: file.Name()}
+	chain, err := newAuthChain([]string{model.AuthBasic, model.AuthToken}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(user, password string) (*gin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "http://redzilla.localhost/v2/instances", nil)
+		if len(user) > 0 {
+			c.Request.SetBasicAuth(user, password)
+		}
+		chain.authenticate(c, cfg)
+		return c, w
+	}
 
-	fmt.Printf("Result %t\n", res)
-	time.Sleep(time.Millisecond * 500)
+	for _, creds := range [][]string{{"alice", "secret"}, {"bob", "password"}} {
+		c, _ := run(creds[0], creds[1])
+		if c.IsAborted() || getPrincipal(c) != creds[0] {
+			t.Fatalf("User %s should be authenticated", creds[0])
+		}
+	}
+
+	c, w := run("alice", "wrong")
+	if !c.IsAborted() || w.Code != http.StatusUnauthorized {
+		t.Fatal("Wrong password should be refused")
+	}
+
+	c, w = run("", "")
+	if !c.IsAborted() || w.Header().Get("WWW-Authenticate") != `Basic realm="redzilla"` {
+		t.Fatal("Missing credentials should be challenged")
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "http://redzilla.localhost/v2/instances", nil)
+	if httpAuthenticate(c, &model.Config{AuthHttp: &model.AuthHttp{Header: "Authorization"}}) {
+		t.Fatal("Requests without the credential header should be left to the next provider")
+	}
+
+	if _, err := newAuthChain([]string{"kerberos"}, cfg); err == nil {
+		t.Fatal("Unknown provider should be refused")
+	}
 }
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+// maxAuthCacheEntries bound the cached decisions, new decisions are not
+// cached once full
+const maxAuthCacheEntries = 10000
+
+type authCacheEntry struct {
+	result  *AuthResult
+	expires time.Time
+}
+
+// authCache holds auth decisions by credential and instance
+type authCache struct {
+	mutex   sync.Mutex
+	entries map[string]authCacheEntry
+}
+
+var authDecisions = &authCache{entries: make(map[string]authCacheEntry)}
+
+// authCacheKey hash the credential and all the request fields passed to the
+// auth service, which may decide on them. Credentials are not kept in
+// memory in clear
+func authCacheKey(reqArgs *RequestBodyTemplate) string {
+	sum := sha256.Sum256([]byte(reqArgs.HeaderVal + "\x00" + reqArgs.Name + "\x00" + reqArgs.Method + "\x00" + reqArgs.Url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *authCache) get(key string) *AuthResult {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.result
+}
+
+func (c *authCache) set(key string, result *AuthResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxAuthCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxAuthCacheEntries {
+			return
+		}
+	}
+
+	c.entries[key] = authCacheEntry{result: result, expires: now.Add(result.TTL)}
+}
+
+// cachedRequest return a cached decision for the credential and instance,
+// asking the auth service otherwise
+func cachedRequest(reqArgs *RequestBodyTemplate, a *model.AuthHttp) (*AuthResult, error) {
+
+	key := authCacheKey(reqArgs)
+	if result := authDecisions.get(key); result != nil {
+		return result, nil
+	}
+
+	result, err := doRequest(reqArgs, a)
+	if err != nil {
+		return result, err
+	}
+
+	if result.TTL > 0 {
+		authDecisions.set(key, result)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+)
+
+// authProvider authenticates the requests carrying a credential it
+// recognises: it sets the principal or aborts the request, and returns
+// false to leave requests without such credential to the next provider
+type authProvider func(c *gin.Context, cfg *model.Config) bool
+
+// authChain try providers in order, the first recognising the credential
+// decides
+type authChain struct {
+	providers []authProvider
+	oidc      bool
+	basic     bool
+}
+
+// newAuthChain build the chain from provider names
+func newAuthChain(names []string, cfg *model.Config) (*authChain, error) {
+
+	chain := new(authChain)
+
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case model.AuthBasic:
+			users, err := newHtpasswd(cfg.AuthHtpasswdFile)
+			if err != nil {
+				return nil, err
+			}
+			chain.providers = append(chain.providers, users.authenticate)
+			chain.basic = true
+		case model.AuthToken:
+			chain.providers = append(chain.providers, tokenAuthenticate)
+		case model.AuthHTTP:
+			if cfg.AuthHttp == nil {
+				return nil, errors.New("AuthHttpUrl is required by the http provider")
+			}
+			chain.providers = append(chain.providers, httpAuthenticate)
+		case model.AuthOIDC:
+			chain.providers = append(chain.providers, oidcAuthenticate)
+			chain.oidc = true
+		case model.AuthMTLS:
+			verifier, err := newCertVerifier(cfg.AuthClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			chain.providers = append(chain.providers, verifier.authenticate)
+		default:
+			return nil, fmt.Errorf("Unknown auth provider %s", name)
+		}
+	}
+
+	return chain, nil
+}
+
+// authenticate run the chain, refusing requests no provider recognised
+func (a *authChain) authenticate(c *gin.Context, cfg *model.Config) {
+
+	if len(a.providers) == 0 {
+		return
+	}
+
+	// the login flow is reachable without credentials
+	if a.oidc && isRootDomain(c.Request.Host, cfg.Domain) && strings.HasPrefix(c.Request.URL.Path, authPathPrefix) {
+		return
+	}
+
+	for _, provider := range a.providers {
+		if provider(c, cfg) {
+			return
+		}
+	}
+
+	if a.oidc && oidcLogin(c, cfg) {
+		return
+	}
+
+	if a.basic {
+		c.Header("WWW-Authenticate", `Basic realm="redzilla"`)
+	} else {
+		c.Header("WWW-Authenticate", "Bearer")
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// certVerifier authenticates TLS client certificates issued by a CA
+type certVerifier struct {
+	roots *x509.CertPool
+}
+
+func newCertVerifier(caFile string) (*certVerifier, error) {
+
+	if len(caFile) == 0 {
+		return nil, errors.New("AuthClientCAFile is required by the mtls provider")
+	}
+
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+
+	return &certVerifier{roots: roots}, nil
+}
+
+// certPrincipal return the first email of the certificate, else its
+// common name
+func certPrincipal(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// authenticate accept client certificates of requests served over TLS,
+// organizational units are the principal groups
+func (v *certVerifier) authenticate(c *gin.Context, cfg *model.Config) bool {
+
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	certs := c.Request.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil || len(certPrincipal(certs[0])) == 0 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return true
+	}
+
+	c.Set(principalKey, certPrincipal(certs[0]))
+	c.Set(groupsKey, certs[0].Subject.OrganizationalUnit)
+
+	return true
+}
@@ -0,0 +1,529 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const backupTimeFormat = "20060102T150405.000Z"
+const backupSuffix = ".tar.gz"
+
+var backupIDPattern = regexp.MustCompile("^[0-9]{8}T[0-9]{6}\\.[0-9]{3}Z$")
+
+var backupStore storage.ObjectStore
+var backupStoreMutex sync.Mutex
+
+// getBackupStore return the configured backup target
+func getBackupStore(cfg *model.Config) (storage.ObjectStore, error) {
+	backupStoreMutex.Lock()
+	defer backupStoreMutex.Unlock()
+	if backupStore == nil {
+		s, err := storage.NewBackupStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		backupStore = s
+	}
+	return backupStore, nil
+}
+
+func backupKey(name, id string) string {
+	return name + "/" + id + backupSuffix
+}
+
+func validateBackupID(id string) (string, error) {
+	if !backupIDPattern.MatchString(id) {
+		return "", errors.New("Invalid backup ID")
+	}
+	return id, nil
+}
+
+// skipBackupFile leave runtime files out of the archive
+func skipBackupFile(path string, info os.FileInfo) bool {
+	return path == instanceLogFile
+}
+
+//Backup snapshot the instance data, if stop is set a running instance is
+//stopped while archiving and started again afterwards
+func (i *Instance) Backup(actor string, stop bool) (*model.Backup, error) {
+
+	if len(i.instance.DataVolume) > 0 {
+		return nil, ErrDataVolume
+	}
+
+	wasRunning := false
+	if stop {
+		running, err := i.IsRunning()
+		if err != nil {
+			return nil, err
+		}
+		if running {
+			err = i.Stop()
+			if err != nil {
+				return nil, err
+			}
+			wasRunning = true
+		}
+	}
+
+	backup, err := i.archiveData()
+
+	if wasRunning {
+		i.Reset()
+		serr := i.start(actor, "backup")
+		if serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	return backup, err
+}
+
+func (i *Instance) archiveData() (*model.Backup, error) {
+
+	name := i.instance.Name
+
+	store, err := getBackupStore(i.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// archive to a temporary file first, targets need the size upfront
+	tmp, err := ioutil.TempFile("", "redzilla-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	datadir := storage.GetInstancesDataPath(name, i.cfg)
+	err = storage.ArchiveDir(datadir, tmp, skipBackupFile)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Now().UTC()
+	backup := &model.Backup{
+		ID:       created.Format(backupTimeFormat),
+		Instance: name,
+		Created:  created,
+		Size:     size,
+	}
+
+	err = store.Put(backupKey(name, backup.ID), tmp, size)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Created backup %s of %s (%d bytes)", backup.ID, name, size)
+	return backup, nil
+}
+
+//ListBackups return the backups of an instance, oldest first
+func ListBackups(name string, cfg *model.Config) ([]model.Backup, error) {
+
+	store, err := getBackupStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := store.List(name + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Backup, 0)
+	for _, object := range objects {
+		id := strings.TrimSuffix(strings.TrimPrefix(object.Key, name+"/"), backupSuffix)
+		created, err := time.Parse(backupTimeFormat, id)
+		if err != nil {
+			continue
+		}
+		list = append(list, model.Backup{
+			ID:       id,
+			Instance: name,
+			Created:  created,
+			Size:     object.Size,
+		})
+	}
+
+	return list, nil
+}
+
+//PruneBackups delete the oldest backups of an instance keeping retain of them
+func PruneBackups(name string, retain int, cfg *model.Config) error {
+
+	if retain <= 0 {
+		return nil
+	}
+
+	list, err := ListBackups(name, cfg)
+	if err != nil {
+		return err
+	}
+	if len(list) <= retain {
+		return nil
+	}
+
+	store, err := getBackupStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range list[:len(list)-retain] {
+		logrus.Debugf("Removing expired backup %s of %s", backup.ID, name)
+		err = store.Delete(backupKey(name, backup.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Restore replace the instance data with a backup of source, creating the
+//instance if it does not exists. A running instance is restarted
+func (i *Instance) Restore(source, id, actor string) error {
+
+	if len(i.instance.DataVolume) > 0 {
+		return ErrDataVolume
+	}
+
+	name := i.instance.Name
+
+	store, err := getBackupStore(i.cfg)
+	if err != nil {
+		return err
+	}
+
+	archive, err := store.Get(backupKey(source, id))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	datadir := storage.GetInstancesDataPath(name, i.cfg)
+
+	// extract aside first, an invalid archive leaves the data untouched
+	extracted := datadir + ".restore"
+	os.RemoveAll(extracted)
+	defer os.RemoveAll(extracted)
+
+	err = storage.ExtractArchive(archive, extracted)
+	if err != nil {
+		return err
+	}
+
+	running, err := i.IsRunning()
+	if err != nil {
+		return err
+	}
+	if running {
+		err = i.Stop()
+		if err != nil {
+			return err
+		}
+		i.Reset()
+	}
+
+	err = replaceDir(datadir, extracted, instanceLogFile)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Restored backup %s of %s into %s", id, source, name)
+
+	exists, err := i.Exists()
+	if err != nil {
+		return err
+	}
+
+	if running {
+		return i.start(actor, "restore")
+	}
+	if !exists {
+		return i.Save(actor, "restore")
+	}
+
+	return nil
+}
+
+// replaceDir swap the content of dir with the content of src, except the
+// keep entry. The previous content is put back on failure
+func replaceDir(dir, src, keep string) error {
+
+	previous := dir + ".previous"
+	os.RemoveAll(previous)
+
+	err := storage.CreateDir(previous)
+	if err != nil {
+		return err
+	}
+
+	moved, err := moveEntries(dir, previous, keep)
+	if err != nil {
+		moveEntries(previous, dir, keep)
+		os.RemoveAll(previous)
+		return err
+	}
+
+	_, err = moveEntries(src, dir, keep)
+	if err != nil {
+		logrus.Warnf("Restore of %s failed, rolling back: %s", dir, err.Error())
+		for _, entry := range moved {
+			os.RemoveAll(filepath.Join(dir, entry))
+		}
+		moveEntries(previous, dir, keep)
+		os.RemoveAll(previous)
+		return err
+	}
+
+	return os.RemoveAll(previous)
+}
+
+// moveEntries move the content of src into dst, returning moved names
+func moveEntries(src, dst, skip string) ([]string, error) {
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Name() == skip {
+			continue
+		}
+		err = os.Rename(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()))
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, entry.Name())
+	}
+
+	return moved, nil
+}
+
+// BackupAll back up every instance and apply the retention policy
+func BackupAll(cfg *model.Config) {
+
+	list, err := ListInstances(cfg)
+	if err != nil {
+		logrus.Errorf("Failed to list instances for backup: %s", err.Error())
+		return
+	}
+
+	for _, item := range *list {
+		if len(item.DataVolume) > 0 {
+			logrus.Debugf("Skipping backup of %s, data is on volume %s", item.Name, item.DataVolume)
+			continue
+		}
+
+		instance := GetInstance(item.Name, cfg)
+
+		_, err = instance.Backup(SystemPrincipal, cfg.BackupStop)
+		RecordSystemAudit(cfg, "backup.scheduled", item.Name, err)
+		if err != nil {
+			logrus.Warnf("Scheduled backup of %s failed: %s", item.Name, err.Error())
+			continue
+		}
+
+		err = PruneBackups(item.Name, cfg.BackupRetention, cfg)
+		if err != nil {
+			logrus.Warnf("Failed to prune backups of %s: %s", item.Name, err.Error())
+		}
+	}
+}
+
+// restoreRequest is the optional body of a restore call
+type restoreRequest struct {
+	// Target restores into another instance, created if missing
+	Target string
+}
+
+func backupsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		instance := GetInstance(name, cfg)
+		if !instanceExists(c, instance) {
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			list, err := ListBackups(name, cfg)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, list)
+		case http.MethodPost:
+			setAuditAction(c, "backup.create")
+
+			backup, err := instance.Backup(getPrincipal(c), c.Query("stop") == "true")
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+			c.JSON(http.StatusCreated, backup)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func backupHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		id, err := validateBackupID(c.Param("id"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		store, err := getBackupStore(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			archive, err := store.Get(backupKey(name, id))
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			defer archive.Close()
+
+			c.Header("Content-Type", "application/gzip")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s%s\"", name, id, backupSuffix))
+			c.Status(http.StatusOK)
+			_, err = io.Copy(c.Writer, archive)
+			if err != nil {
+				logrus.Warnf("Failed to send backup %s of %s: %s", id, name, err.Error())
+			}
+		case http.MethodDelete:
+			setAuditAction(c, "backup.delete")
+
+			err = store.Delete(backupKey(name, id))
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func restoreHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setAuditAction(c, "backup.restore")
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		id, err := validateBackupID(c.Param("id"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		req := restoreRequest{}
+		if c.Request.ContentLength > 0 {
+			err = c.BindJSON(&req)
+			if err != nil {
+				return
+			}
+		}
+
+		target := name
+		if len(req.Target) > 0 {
+			target, err = validateName(req.Target)
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		instance := GetInstance(target, cfg)
+		if target != name && !authorizeInstance(c, cfg, instance, true) {
+			return
+		}
+		err = instance.Restore(name, id, getPrincipal(c))
+		if err != nil {
+			if os.IsNotExist(err) {
+				notFound(c)
+				return
+			}
+			saveError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, instance.GetStatus().Redact())
+	}
+}
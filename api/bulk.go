@@ -0,0 +1,288 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultBulkConcurrency is the number of instances processed in parallel
+const defaultBulkConcurrency = 4
+
+const (
+	bulkSuccess = "success"
+	bulkFailure = "failure"
+	bulkSkipped = "skipped"
+)
+
+// bulkRequest is the body of a bulk operation
+type bulkRequest struct {
+	// Action is one of start, stop, restart, upgrade or backup
+	Action string
+	// Names and Selector pick the instances, both apply if set
+	Names    []string
+	Selector map[string]string
+	// Image is the image to upgrade to
+	Image string
+	// Stop instances while taking a backup
+	Stop bool
+	// Concurrency is the number of instances processed at once in a batch
+	Concurrency int
+	// BatchSize is the number of instances per rolling batch, 0 is one batch
+	BatchSize int
+	// MaxFailures is the number of failures tolerated before skipping
+	// the next batches
+	MaxFailures int
+}
+
+// bulkResult is the outcome of the operation on one instance
+type bulkResult struct {
+	Instance string
+	Status   string
+	Error    string `json:",omitempty"`
+}
+
+// bulkResponse report the outcome of a bulk operation
+type bulkResponse struct {
+	Action   string
+	Results  []bulkResult
+	Failures int
+	// Aborted is set when the failure threshold stopped the operation
+	Aborted bool
+}
+
+func (r *bulkRequest) validate() error {
+	switch r.Action {
+	case "start", "stop", "restart", "backup":
+	case "upgrade":
+		if len(r.Image) == 0 {
+			return errors.New("Image is required to upgrade")
+		}
+	default:
+		return errors.New("Invalid action")
+	}
+	if len(r.Names) == 0 && len(r.Selector) == 0 {
+		return errors.New("Names or Selector are required")
+	}
+	if r.Concurrency < 0 || r.BatchSize < 0 || r.MaxFailures < 0 {
+		return errors.New("Invalid concurrency, batch size or failures threshold")
+	}
+	for _, name := range r.Names {
+		if _, err := validateName(name); err != nil || len(name) == 0 {
+			return errors.New("Invalid instance name " + name)
+		}
+	}
+	return nil
+}
+
+// selectInstances return the names of stored instances matching the request
+// which the principal can change
+func selectInstances(names []string, selector map[string]string, a *access, cfg *model.Config) ([]string, error) {
+
+	list, err := ListInstances(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]bool)
+	for _, name := range names {
+		byName[name] = true
+	}
+
+	selected := make([]string, 0)
+	for _, item := range *list {
+		if len(names) > 0 && !byName[item.Name] {
+			continue
+		}
+		if !item.MatchLabels(selector) || !a.canWrite(&item) {
+			continue
+		}
+		selected = append(selected, item.Name)
+	}
+	sort.Strings(selected)
+
+	return selected, nil
+}
+
+// batches split names in rolling batches of size, 0 is a single batch
+func batches(names []string, size int) [][]string {
+	if size <= 0 || size >= len(names) {
+		return [][]string{names}
+	}
+	list := make([][]string, 0, (len(names)+size-1)/size)
+	for start := 0; start < len(names); start += size {
+		end := start + size
+		if end > len(names) {
+			end = len(names)
+		}
+		list = append(list, names[start:end])
+	}
+	return list
+}
+
+//Upgrade recreate the instance container from another image, a stopped
+//instance gets the image on next start
+func (i *Instance) Upgrade(image, actor string) error {
+
+	running, err := i.IsRunning()
+	if err != nil {
+		return err
+	}
+
+	i.instance.Image = image
+
+	if !running {
+		return i.Save(actor, "upgrade")
+	}
+
+	return i.Recreate(actor, "upgrade")
+}
+
+// runBulkAction apply the action to one instance
+func runBulkAction(req *bulkRequest, name, actor string, cfg *model.Config) error {
+
+	instance := GetInstance(name, cfg)
+
+	switch req.Action {
+	case "start":
+		return instance.Start(actor)
+	case "stop":
+		return instance.Stop()
+	case "restart":
+		return instance.Restart(actor)
+	case "upgrade":
+		return instance.Upgrade(req.Image, actor)
+	case "backup":
+		_, err := instance.Backup(actor, req.Stop)
+		return err
+	}
+
+	return errors.New("Invalid action")
+}
+
+// runBulk process the instances in rolling batches, skipping the remaining
+// batches once failures exceed the threshold
+func runBulk(req *bulkRequest, names []string, run func(name string) error) *bulkResponse {
+
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultBulkConcurrency
+	}
+
+	res := &bulkResponse{
+		Action:  req.Action,
+		Results: make([]bulkResult, 0, len(names)),
+	}
+
+	for _, batch := range batches(names, req.BatchSize) {
+
+		if res.Aborted {
+			for _, name := range batch {
+				res.Results = append(res.Results, bulkResult{Instance: name, Status: bulkSkipped})
+			}
+			continue
+		}
+
+		results := make([]bulkResult, len(batch))
+		sem := make(chan bool, concurrency)
+		var wg sync.WaitGroup
+
+		for idx, name := range batch {
+			wg.Add(1)
+			sem <- true
+			go func(idx int, name string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				result := bulkResult{Instance: name, Status: bulkSuccess}
+				err := run(name)
+				if err != nil {
+					result.Status = bulkFailure
+					result.Error = err.Error()
+				}
+				results[idx] = result
+			}(idx, name)
+		}
+		wg.Wait()
+
+		for _, result := range results {
+			if result.Status == bulkFailure {
+				res.Failures++
+			}
+		}
+		res.Results = append(res.Results, results...)
+
+		if res.Failures > req.MaxFailures {
+			logrus.Warnf("Bulk %s aborted after %d failures", req.Action, res.Failures)
+			res.Aborted = true
+		}
+	}
+
+	return res
+}
+
+func bulkHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setAuditAction(c, "instances.bulk")
+
+		req := bulkRequest{}
+		err := c.BindJSON(&req)
+		if err != nil {
+			return
+		}
+
+		req.Action = strings.ToLower(req.Action)
+		err = req.validate()
+		if err != nil {
+			errorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		setAuditAction(c, "instances.bulk."+req.Action)
+
+		if !authorizeLimits(c, req.Image, nil, nil) {
+			return
+		}
+
+		names, err := selectInstances(req.Names, req.Selector, getAccess(c), cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		principal := getPrincipal(c)
+		source := c.ClientIP()
+
+		res := runBulk(&req, names, func(name string) error {
+			err := runBulkAction(&req, name, principal, cfg)
+
+			entry := &model.AuditEntry{
+				Principal: principal,
+				Action:    "instance." + req.Action,
+				Instance:  name,
+				Source:    source,
+				Outcome:   model.AuditSuccess,
+			}
+			if err != nil {
+				entry.Outcome = model.AuditFailure
+				entry.Message = err.Error()
+			}
+			recordAudit(cfg, entry)
+
+			return err
+		})
+
+		c.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//ErrInstanceExists is returned when the target instance already exists
+var ErrInstanceExists = errors.New("Instance already exists")
+
+// cloneRequest is the body of a clone call
+type cloneRequest struct {
+	Target string
+	// ExcludeCredentials leave out Node-RED credential files
+	ExcludeCredentials bool
+	Start              bool
+}
+
+// isCredentialsFile match Node-RED encrypted credentials, like flows_cred.json
+func isCredentialsFile(path string) bool {
+	return !strings.Contains(path, string(os.PathSeparator)) && strings.HasSuffix(path, "_cred.json")
+}
+
+//Clone copy the instance data and settings into a new instance named target
+func (i *Instance) Clone(target string, excludeCredentials bool, actor string) (*Instance, error) {
+
+	if len(i.instance.DataVolume) > 0 {
+		return nil, ErrDataVolume
+	}
+
+	name := i.instance.Name
+
+	clone := GetInstance(target, i.cfg)
+	exists, err := clone.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrInstanceExists
+	}
+
+	record, err := i.instance.Copy(target)
+	if err != nil {
+		return nil, err
+	}
+
+	src := storage.GetInstancesDataPath(name, i.cfg)
+	dst := storage.GetInstancesDataPath(target, i.cfg)
+
+	err = storage.CopyDir(src, dst, func(path string, info os.FileInfo) bool {
+		if path == instanceLogFile {
+			return true
+		}
+		return excludeCredentials && isCredentialsFile(path)
+	})
+	if err != nil {
+		removeClonedData(dst)
+		return nil, err
+	}
+
+	record.Port = clone.GetStatus().Port
+	record.Owner = actor
+	// custom domains stay with the source instance
+	record.Domains = nil
+	*clone.instance = *record
+
+	err = clone.Save(actor, "clone")
+	if err != nil {
+		removeClonedData(dst)
+		return nil, err
+	}
+
+	logrus.Infof("Cloned instance %s into %s", name, target)
+	return clone, nil
+}
+
+// removeClonedData clean up a partial copy, keeping the instance log open
+// by the logger
+func removeClonedData(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Warnf("Failed to clean up %s: %s", dir, err.Error())
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == instanceLogFile {
+			continue
+		}
+		os.RemoveAll(filepath.Join(dir, entry.Name()))
+	}
+}
+
+func cloneHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setAuditAction(c, "instance.clone")
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		req := cloneRequest{}
+		err = c.BindJSON(&req)
+		if err != nil {
+			return
+		}
+
+		target, err := validateName(req.Target)
+		if err != nil || len(target) == 0 {
+			errorResponse(c, http.StatusBadRequest, "Invalid target name")
+			return
+		}
+
+		instance := GetInstance(name, cfg)
+		if !instanceExists(c, instance) {
+			return
+		}
+
+		clone, err := instance.Clone(target, req.ExcludeCredentials, getPrincipal(c))
+		if err != nil {
+			if err == ErrInstanceExists {
+				errorResponse(c, http.StatusConflict, err.Error())
+				return
+			}
+			saveError(c, err)
+			return
+		}
+
+		if req.Start {
+			err = clone.Start(getPrincipal(c))
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+		}
+
+		setETag(c, clone.GetStatus())
+		c.JSON(http.StatusCreated, clone.GetStatus().Redact())
+	}
+}
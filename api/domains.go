@@ -0,0 +1,527 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const domainCollection = "domains"
+
+// domainTXTPrefix name the TXT record holding the verification token
+const domainTXTPrefix = "_redzilla-challenge."
+
+// maxInstanceDomains bound the custom hostnames of an instance
+const maxInstanceDomains = 20
+
+// domainClaimTTL is how long a host can be claimed without being verified,
+// expired claims can be taken by any instance
+const domainClaimTTL = 72 * time.Hour
+
+// domainCacheTTL is used when CacheSyncInterval is not set
+const domainCacheTTL = 5 * time.Second
+
+var hostRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+//ErrDomainNotVerified is returned when the token is not published
+var ErrDomainNotVerified = errors.New("Domain not verified")
+
+//ErrDomainClaimExpired is returned when verifying an expired claim
+var ErrDomainClaimExpired = errors.New("Domain claim expired, add the domain again")
+
+// lookupTXT resolve the TXT records holding the verification token
+var lookupTXT = net.LookupTXT
+
+type domainCacheEntry struct {
+	name    string
+	expires time.Time
+}
+
+// domainLookup caches the instance served on custom hosts
+var domainLookup = struct {
+	mutex   sync.Mutex
+	entries map[string]domainCacheEntry
+}{entries: make(map[string]domainCacheEntry)}
+
+// domainRequest is the body to add a custom hostname
+type domainRequest struct {
+	Host string
+}
+
+// domainResponse add the verification instructions to a domain
+type domainResponse struct {
+	*model.Domain
+	TXTRecord string
+	// Expires is the deadline to verify a pending claim
+	Expires *time.Time `json:",omitempty"`
+}
+
+func newDomainResponse(d *model.Domain) *domainResponse {
+	res := &domainResponse{
+		Domain:    d,
+		TXTRecord: domainTXTPrefix + d.Host,
+	}
+	if !d.Verified {
+		expires := d.Created.Add(domainClaimTTL)
+		res.Expires = &expires
+	}
+	return res
+}
+
+// claimExpired check if a pending claim is past domainClaimTTL
+func claimExpired(d *model.Domain, now time.Time) bool {
+	return !d.Verified && now.Sub(d.Created) > domainClaimTTL
+}
+
+// stripPort return the host without port
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// validateHost normalize a custom hostname, refusing IP addresses, the
+// redzilla domain and its subdomains
+func validateHost(host string, cfg *model.Config) (string, error) {
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if len(host) > 253 || !hostRegex.MatchString(host) || net.ParseIP(host) != nil {
+		return "", errors.New("Invalid host")
+	}
+
+	domain := strings.ToLower(cfg.Domain)
+	if host == domain || strings.HasSuffix(host, "."+domain) {
+		return "", errors.New("Host belongs to the redzilla domain")
+	}
+
+	return host, nil
+}
+
+// lookupDomain return the instance served on a verified custom host
+func lookupDomain(host string, cfg *model.Config) string {
+
+	host = strings.TrimSuffix(strings.ToLower(stripPort(host)), ".")
+
+	domainLookup.mutex.Lock()
+	entry, ok := domainLookup.entries[host]
+	domainLookup.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.name
+	}
+
+	name := ""
+	d := new(model.Domain)
+	err := storage.GetStore(domainCollection, cfg).Load(host, d)
+	if err == nil && d.Verified {
+		name = d.Instance
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to load domain %s: %s", host, err.Error())
+		return ""
+	}
+
+	ttl := cfg.CacheSyncInterval
+	if ttl <= 0 {
+		ttl = domainCacheTTL
+	}
+
+	domainLookup.mutex.Lock()
+	domainLookup.entries[host] = domainCacheEntry{name: name, expires: time.Now().Add(ttl)}
+	domainLookup.mutex.Unlock()
+
+	return name
+}
+
+// forgetDomain drop a cached lookup after a change
+func forgetDomain(host string) {
+	domainLookup.mutex.Lock()
+	delete(domainLookup.entries, host)
+	domainLookup.mutex.Unlock()
+}
+
+// hostInstance return the instance name served on host, from the subdomain
+// or the custom domains
+func hostInstance(host string, cfg *model.Config) string {
+	if isRootDomain(host, cfg.Domain) {
+		return ""
+	}
+	if isSubdomain(host, cfg.Domain) {
+		return extractSubdomain(host, cfg)
+	}
+	return lookupDomain(host, cfg)
+}
+
+// isCustomDomain check if the host is outside the redzilla domain
+func isCustomDomain(host string, cfg *model.Config) bool {
+	return !isRootDomain(host, cfg.Domain) && !isSubdomain(host, cfg.Domain)
+}
+
+// newDomainToken return a random verification token
+func newDomainToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// verifyDomain check the token is published in the DNS of the host. Only
+// the owner of the zone can publish it, unlike content served on the host
+func verifyDomain(d *model.Domain) error {
+
+	if claimExpired(d, time.Now()) {
+		return ErrDomainClaimExpired
+	}
+
+	records, err := lookupTXT(domainTXTPrefix + d.Host)
+	if err != nil {
+		logrus.Debugf("Domain %s TXT lookup failed: %s", d.Host, err.Error())
+		return ErrDomainNotVerified
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == d.Token {
+			return nil
+		}
+	}
+
+	return ErrDomainNotVerified
+}
+
+// loadDomain read a domain of the instance, false if the response is sent
+func loadDomain(c *gin.Context, name string, cfg *model.Config) (*model.Domain, bool) {
+
+	host, err := validateHost(c.Param("host"), cfg)
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	d := new(model.Domain)
+	err = storage.GetStore(domainCollection, cfg).Load(host, d)
+	if err != nil {
+		if os.IsNotExist(err) {
+			notFound(c)
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+	if d.Instance != name {
+		notFound(c)
+		return nil, false
+	}
+
+	return d, true
+}
+
+// withoutHost return the hosts except host
+func withoutHost(hosts []string, host string) []string {
+	list := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if h != host {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+// removeDomains drop the custom domains of a removed instance, except the
+// ones claimed since by another instance
+func removeDomains(name string, hosts []string, cfg *model.Config) {
+	store := storage.GetStore(domainCollection, cfg)
+	for _, host := range hosts {
+		d := new(model.Domain)
+		err := store.Load(host, d)
+		if err == nil && d.Instance != name {
+			continue
+		}
+		err = store.Delete(host)
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove domain %s: %s", host, err.Error())
+		}
+		forgetDomain(host)
+	}
+}
+
+// takeExpiredClaim replace an expired pending claim of the host with d,
+// releasing the host from the instance which claimed it
+func takeExpiredClaim(d *model.Domain, cfg *model.Config) error {
+
+	store := storage.GetStore(domainCollection, cfg)
+
+	current := new(model.Domain)
+	err := store.Load(d.Host, current)
+	if err != nil {
+		return err
+	}
+	if !claimExpired(current, time.Now()) {
+		return storage.ErrConflict
+	}
+
+	err = store.Update(d.Host, d, current.Version)
+	if err != nil {
+		return err
+	}
+	forgetDomain(d.Host)
+	logrus.Infof("Domain %s claim of %s expired, claimed by %s", d.Host, current.Instance, d.Instance)
+
+	if current.Instance == d.Instance {
+		return nil
+	}
+
+	previous := GetInstance(current.Instance, cfg)
+	record := previous.GetStatus()
+	domains := record.Domains
+	record.Domains = withoutHost(domains, d.Host)
+	err = previous.Save(SystemPrincipal, "domain.expire")
+	if err != nil {
+		record.Domains = domains
+		logrus.Warnf("Failed to release domain %s from %s: %s", d.Host, current.Instance, err.Error())
+	}
+
+	return nil
+}
+
+// moveDomains point the custom domains to a renamed instance
+func moveDomains(hosts []string, target string, cfg *model.Config) error {
+	store := storage.GetStore(domainCollection, cfg)
+	for _, host := range hosts {
+		d := new(model.Domain)
+		err := store.Load(host, d)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		d.Instance = target
+		err = store.Update(host, d, d.Version)
+		if err != nil {
+			return err
+		}
+		forgetDomain(host)
+	}
+	return nil
+}
+
+// customDomainsAllowed tell if instances can be served on custom domains.
+// The oidc session cookie is scoped to Domain, browsers never send it to
+// other hosts and login could not return to them
+func customDomainsAllowed(cfg *model.Config) bool {
+	for _, provider := range cfg.AuthProxyChain {
+		if provider == model.AuthOIDC {
+			return false
+		}
+	}
+	return true
+}
+
+func domainsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		instance := GetInstance(name, cfg)
+		if !instanceExists(c, instance) {
+			return
+		}
+
+		store := storage.GetStore(domainCollection, cfg)
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			list := make([]*domainResponse, 0)
+			for _, host := range instance.GetStatus().Domains {
+				d := new(model.Domain)
+				err := store.Load(host, d)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					internalError(c, err)
+					return
+				}
+				list = append(list, newDomainResponse(d))
+			}
+			c.JSON(http.StatusOK, list)
+		case http.MethodPost:
+			setAuditAction(c, "domain.add")
+
+			if !customDomainsAllowed(cfg) {
+				errorResponse(c, http.StatusBadRequest, "Custom domains cannot be used with "+model.AuthOIDC+" sessions on instances")
+				return
+			}
+
+			req := domainRequest{}
+			err := c.BindJSON(&req)
+			if err != nil {
+				return
+			}
+			host, err := validateHost(req.Host, cfg)
+			if err != nil {
+				errorResponse(c, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			record := instance.GetStatus()
+			if len(record.Domains) >= maxInstanceDomains {
+				errorResponse(c, http.StatusBadRequest, fmt.Sprintf("At most %d domains per instance", maxInstanceDomains))
+				return
+			}
+
+			token, err := newDomainToken()
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+
+			d := &model.Domain{
+				Host:      host,
+				Instance:  name,
+				Token:     token,
+				Created:   time.Now(),
+				CreatedBy: getPrincipal(c),
+			}
+			// a host is claimed by a single instance
+			err = store.Update(host, d, 0)
+			if err == storage.ErrConflict {
+				err = takeExpiredClaim(d, cfg)
+			}
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			previous := record.Domains
+			record.Domains = append(withoutHost(previous, host), host)
+			err = instance.Save(getPrincipal(c), "domain.add")
+			if err != nil {
+				record.Domains = previous
+				store.Delete(host)
+				saveError(c, err)
+				return
+			}
+
+			setETag(c, record)
+			c.JSON(http.StatusCreated, newDomainResponse(d))
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func domainHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		instance := GetInstance(name, cfg)
+		if !instanceExists(c, instance) {
+			return
+		}
+
+		d, ok := loadDomain(c, name, cfg)
+		if !ok {
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			c.Header("ETag", formatETag(d.Version))
+			c.JSON(http.StatusOK, newDomainResponse(d))
+		case http.MethodDelete:
+			setAuditAction(c, "domain.remove")
+
+			record := instance.GetStatus()
+			previous := record.Domains
+			record.Domains = withoutHost(previous, d.Host)
+			err := instance.Save(getPrincipal(c), "domain.remove")
+			if err != nil {
+				record.Domains = previous
+				saveError(c, err)
+				return
+			}
+
+			removeDomains(name, []string{d.Host}, cfg)
+			c.Status(http.StatusNoContent)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func verifyDomainHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		d, ok := loadDomain(c, name, cfg)
+		if !ok {
+			return
+		}
+
+		setAuditAction(c, "domain.verify")
+
+		if !d.Verified {
+			err = verifyDomain(d)
+			if err != nil {
+				errorResponse(c, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+
+			d.Verified = true
+			d.VerifiedAt = time.Now()
+			err = storage.GetStore(domainCollection, cfg).Update(d.Host, d, d.Version)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+			forgetDomain(d.Host)
+			logrus.Infof("Verified domain %s of %s", d.Host, name)
+		}
+
+		c.Header("ETag", formatETag(d.Version))
+		c.JSON(http.StatusOK, newDomainResponse(d))
+	}
+}
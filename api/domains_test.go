@@ -0,0 +1,137 @@
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+)
+
+func TestValidateHost(t *testing.T) {
+	cfg := &model.Config{Domain: "redzilla.localhost"}
+
+	host, err := validateHost("Flows.Example.com.", cfg)
+	if err != nil || host != "flows.example.com" {
+		t.Fatalf("Host should be normalized, got %s %v", host, err)
+	}
+	for _, invalid := range []string{"", "localhost", "-a.example.com", "a_b.example.com", "example.com:80", "10.0.0.1", "127.0.0.1.", "redzilla.localhost", "tenant.redzilla.localhost"} {
+		if _, err := validateHost(invalid, cfg); err == nil {
+			t.Fatalf("Host %s should be refused", invalid)
+		}
+	}
+
+	if !customDomainsAllowed(&model.Config{AuthChain: []string{model.AuthOIDC}, AuthProxyChain: []string{model.AuthToken}}) ||
+		customDomainsAllowed(&model.Config{AuthProxyChain: []string{model.AuthToken, model.AuthOIDC}}) {
+		t.Fatal("Custom domains should be refused only with oidc on instances")
+	}
+}
+
+func TestCustomDomain(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "redzilla-domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &model.Config{Domain: "redzilla.localhost", StorePath: dir, CacheSyncInterval: time.Millisecond}
+	store := storage.GetStore(domainCollection, cfg)
+
+	d := &model.Domain{Host: "flows.example.com", Instance: "tenant", Token: "abc123"}
+	err = store.Update(d.Host, d, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hostInstance("flows.example.com:3000", cfg) != "" {
+		t.Fatal("Unverified domain should not be routed")
+	}
+
+	d.Verified = true
+	err = store.Update(d.Host, d, d.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if hostInstance("Flows.example.com:3000", cfg) != "tenant" || hostInstance("tenant.redzilla.localhost", cfg) != "tenant" {
+		t.Fatal("Verified domain should be routed to the instance")
+	}
+	if hostInstance("redzilla.localhost", cfg) != "" {
+		t.Fatal("Root domain is not an instance")
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+
+	defer func() { lookupTXT = net.LookupTXT }()
+	lookupTXT = func(name string) ([]string, error) {
+		if name == domainTXTPrefix+"flows.example.com" {
+			return []string{"other", " abc123 "}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	d := &model.Domain{Host: "flows.example.com", Token: "abc123", Created: time.Now()}
+	if err := verifyDomain(d); err != nil {
+		t.Fatalf("Token published in DNS should verify: %v", err)
+	}
+	if err := verifyDomain(&model.Domain{Host: "flows.example.com", Token: "wrong", Created: time.Now()}); err != ErrDomainNotVerified {
+		t.Fatal("Wrong token should not verify")
+	}
+	if err := verifyDomain(&model.Domain{Host: "other.example.com", Token: "abc123", Created: time.Now()}); err != ErrDomainNotVerified {
+		t.Fatal("Missing record should not verify")
+	}
+
+	d.Created = time.Now().Add(-domainClaimTTL - time.Minute)
+	if err := verifyDomain(d); err != ErrDomainClaimExpired {
+		t.Fatalf("Expired claim should not verify, got %v", err)
+	}
+}
+
+func TestTakeExpiredClaim(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "redzilla-claims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &model.Config{Domain: "redzilla.localhost", StorePath: dir, InstanceDataPath: filepath.Join(dir, "instances")}
+	store := storage.GetStore(domainCollection, cfg)
+
+	pending := &model.Domain{Host: "claim.example.com", Instance: "squatter", Token: "abc123", Created: time.Now()}
+	if err := store.Update(pending.Host, pending, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	claim := &model.Domain{Host: "claim.example.com", Instance: "tenant", Token: "def456", Created: time.Now()}
+	if err := takeExpiredClaim(claim, cfg); err != storage.ErrConflict {
+		t.Fatalf("Pending claim should be kept, got %v", err)
+	}
+
+	pending.Created = time.Now().Add(-domainClaimTTL - time.Minute)
+	if err := store.Update(pending.Host, pending, pending.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := takeExpiredClaim(claim, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	current := new(model.Domain)
+	if err := store.Load(claim.Host, current); err != nil || current.Instance != "tenant" {
+		t.Fatalf("Expired claim should be replaced, got %+v %v", current, err)
+	}
+
+	// removing the previous claimer keeps the new claim
+	removeDomains("squatter", []string{claim.Host}, cfg)
+	if err := store.Load(claim.Host, current); err != nil {
+		t.Fatalf("Domain claimed by another instance should be kept, got %v", err)
+	}
+}
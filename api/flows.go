@@ -0,0 +1,355 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//ErrInstanceNotRunning is returned when the Node-RED admin API is not reachable
+var ErrInstanceNotRunning = errors.New("Instance not running")
+
+//ErrAdminAuth is returned when the Node-RED admin API requires credentials,
+//redzilla calls it without a token so adminAuth must be disabled
+var ErrAdminAuth = errors.New("Node-RED admin API requires authentication, disable adminAuth in the instance settings")
+
+// adminTimeout limit calls to the Node-RED admin API
+const adminTimeout = 30 * time.Second
+
+// deploymentTypeHeader select how Node-RED applies a flows deployment
+const deploymentTypeHeader = "Node-RED-Deployment-Type"
+
+var adminClient = &http.Client{Timeout: adminTimeout}
+
+// AdminResponse is the response of the Node-RED admin API
+type AdminResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// flowsRequest is the body of a deployment to many instances
+type flowsRequest struct {
+	Instances []string
+	Flows     json.RawMessage
+	// DeploymentType is one of full, nodes, flows or reload
+	DeploymentType string
+	// Concurrency is the number of instances deployed at once
+	Concurrency int
+}
+
+// flowsResult report the deployment outcome on one instance
+type flowsResult struct {
+	Instance   string
+	StatusCode int
+	Error      string `json:",omitempty"`
+}
+
+// validDeploymentType check the Node-RED deployment type, empty means full
+func validDeploymentType(deploymentType string) bool {
+	switch deploymentType {
+	case "", "full", "nodes", "flows", "reload":
+		return true
+	}
+	return false
+}
+
+//AdminRequest call the Node-RED admin HTTP API of a running instance, path
+//is relative to the admin root
+func (i *Instance) AdminRequest(method, path string, body []byte, header http.Header) (*AdminResponse, error) {
+
+	running, err := i.IsRunning()
+	if err != nil {
+		return nil, err
+	}
+	if !running {
+		return nil, ErrInstanceNotRunning
+	}
+
+	addr, err := i.GetAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	url := "http://" + addr + adminRoot(i.instance.Name, i.cfg) + path
+	logrus.Debugf("Admin API %s %s", method, url)
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrAdminAuth
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdminResponse{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        respBody,
+	}, nil
+}
+
+//DeployFlows replace the flows of a running instance
+func (i *Instance) DeployFlows(flows []byte, deploymentType string) (*AdminResponse, error) {
+
+	header := http.Header{}
+	if len(deploymentType) > 0 {
+		header.Set(deploymentTypeHeader, deploymentType)
+	}
+
+	return i.AdminRequest(http.MethodPost, "/flows", flows, header)
+}
+
+// adminError send the response for a failed admin API call
+func adminError(c *gin.Context, err error) {
+	if err == ErrInstanceNotRunning {
+		errorResponse(c, http.StatusConflict, err.Error())
+		return
+	}
+	logrus.Warnf("Admin API request failed: %s", err.Error())
+	code := http.StatusBadGateway
+	if err == ErrAdminAuth {
+		errorResponse(c, code, err.Error())
+		return
+	}
+	errorResponse(c, code, http.StatusText(code))
+}
+
+// adminProxy forward a request to the admin API of the named instance
+func adminProxy(c *gin.Context, cfg *model.Config, method, path string) {
+
+	name, err := validateName(c.Param("name"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	instance := GetInstance(name, cfg)
+	if !instanceExists(c, instance) {
+		return
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		body, err = ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			badRequest(c)
+			return
+		}
+	}
+
+	header := http.Header{}
+	if apiVersion := c.GetHeader("Node-RED-API-Version"); len(apiVersion) > 0 {
+		header.Set("Node-RED-API-Version", apiVersion)
+	}
+	if deploymentType := c.GetHeader(deploymentTypeHeader); len(deploymentType) > 0 {
+		if !validDeploymentType(deploymentType) {
+			errorResponse(c, http.StatusBadRequest, "Invalid deployment type")
+			return
+		}
+		header.Set(deploymentTypeHeader, deploymentType)
+	}
+
+	resp, err := instance.AdminRequest(method, path, body, header)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	if resp.StatusCode == http.StatusNoContent {
+		c.Status(resp.StatusCode)
+		return
+	}
+	c.Data(resp.StatusCode, resp.ContentType, resp.Body)
+}
+
+func flowsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			adminProxy(c, cfg, http.MethodGet, "/flows")
+		case http.MethodPut:
+			setAuditAction(c, "instance.flows.deploy")
+			adminProxy(c, cfg, http.MethodPost, "/flows")
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func nodesModulesHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			adminProxy(c, cfg, http.MethodGet, "/nodes")
+		case http.MethodPost:
+			setAuditAction(c, "instance.nodes.install")
+			adminProxy(c, cfg, http.MethodPost, "/nodes")
+		case http.MethodDelete:
+			setAuditAction(c, "instance.nodes.remove")
+			// the wildcard keeps scoped modules like @scope/name
+			module := strings.TrimPrefix(c.Param("module"), "/")
+			if len(module) == 0 {
+				badRequest(c)
+				return
+			}
+			adminProxy(c, cfg, http.MethodDelete, "/nodes/"+module)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+// deployFlowsAll deploy the same flows to many instances, Concurrency at
+// a time, refusing the ones the principal cannot change
+func deployFlowsAll(req *flowsRequest, a *access, cfg *model.Config) []flowsResult {
+
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultBulkConcurrency
+	}
+
+	results := make([]flowsResult, len(req.Instances))
+	sem := make(chan bool, concurrency)
+
+	var wg sync.WaitGroup
+	for idx, name := range req.Instances {
+		wg.Add(1)
+		sem <- true
+		go func(idx int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := flowsResult{Instance: name}
+			defer func() {
+				results[idx] = result
+			}()
+
+			if _, err := validateName(name); err != nil || len(name) == 0 {
+				result.StatusCode = http.StatusBadRequest
+				result.Error = "Invalid instance name"
+				return
+			}
+
+			instance := GetInstance(name, cfg)
+			exists, err := instance.Exists()
+			if err != nil {
+				result.StatusCode = http.StatusInternalServerError
+				result.Error = err.Error()
+				return
+			}
+			if !exists {
+				result.StatusCode = http.StatusNotFound
+				result.Error = http.StatusText(http.StatusNotFound)
+				return
+			}
+			if !a.canWrite(instance.GetStatus()) {
+				result.StatusCode = http.StatusForbidden
+				result.Error = http.StatusText(http.StatusForbidden)
+				return
+			}
+
+			resp, err := instance.DeployFlows(req.Flows, req.DeploymentType)
+			if err != nil {
+				result.StatusCode = http.StatusBadGateway
+				if err == ErrInstanceNotRunning {
+					result.StatusCode = http.StatusConflict
+				}
+				result.Error = err.Error()
+				return
+			}
+
+			result.StatusCode = resp.StatusCode
+			if resp.StatusCode >= 300 {
+				result.Error = fmt.Sprintf("Deploy failed: %s", strings.TrimSpace(string(resp.Body)))
+			}
+		}(idx, name)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func deployFlowsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setAuditAction(c, "flows.deploy")
+
+		req := flowsRequest{}
+		err := c.BindJSON(&req)
+		if err != nil {
+			return
+		}
+
+		if len(req.Instances) == 0 || len(req.Flows) == 0 {
+			errorResponse(c, http.StatusBadRequest, "Instances and Flows are required")
+			return
+		}
+		if !validDeploymentType(req.DeploymentType) {
+			errorResponse(c, http.StatusBadRequest, "Invalid deployment type")
+			return
+		}
+		if req.Concurrency < 0 {
+			errorResponse(c, http.StatusBadRequest, "Invalid concurrency")
+			return
+		}
+
+		results := deployFlowsAll(&req, getAccess(c), cfg)
+		for _, result := range results {
+			if len(result.Error) > 0 {
+				logrus.Warnf("Flows deploy failed on %s: %s", result.Instance, result.Error)
+			}
+		}
+
+		c.JSON(http.StatusOK, results)
+	}
+}
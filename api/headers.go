@@ -0,0 +1,258 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+)
+
+const maxHeaderRules = 50
+
+var headerNameRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// forwardedHeaders describe the client, accepted from trusted proxies only
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// reservedHeaders are managed by the proxy and cannot be changed by rules
+var reservedHeaders = append([]string{
+	"Host", "Connection", "Upgrade", "Keep-Alive", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Content-Length",
+}, forwardedHeaders...)
+
+// connectionTokens are Connection options, not header names
+var connectionTokens = []string{"upgrade", "keep-alive", "close"}
+
+// parseTrustedProxies parse the addresses and CIDRs of proxies in front of
+// redzilla
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+
+	proxies := []*net.IPNet{}
+	for _, value := range list {
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %s", value)
+		}
+		proxies = append(proxies, cidr)
+	}
+
+	return proxies, nil
+}
+
+// remoteIP return the address of the peer
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// isTrustedProxy check if the peer is a trusted proxy
+func isTrustedProxy(req *http.Request, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(remoteIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range proxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHeaderRules check the header rules of an instance
+func validateHeaderRules(rules []model.HeaderRule) error {
+
+	if len(rules) > maxHeaderRules {
+		return fmt.Errorf("At most %d proxy headers are allowed", maxHeaderRules)
+	}
+
+	for _, rule := range rules {
+		if !headerNameRegexp.MatchString(rule.Name) {
+			return errors.New("Invalid header name " + rule.Name)
+		}
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(rule.Name, reserved) {
+				return errors.New("Header " + rule.Name + " is managed by redzilla")
+			}
+		}
+		switch strings.ToLower(rule.Action) {
+		case "", model.HeaderSet, model.HeaderAdd, model.HeaderRemove:
+		default:
+			return errors.New("Invalid header action " + rule.Action)
+		}
+		if strings.ContainsAny(rule.Value, "\r\n") {
+			return errors.New("Invalid value of header " + rule.Name)
+		}
+	}
+
+	return nil
+}
+
+// normalizeHeaderRules canonicalize names and actions before storing
+func normalizeHeaderRules(rules []model.HeaderRule) []model.HeaderRule {
+	res := make([]model.HeaderRule, 0, len(rules))
+	for _, rule := range rules {
+		rule.Name = http.CanonicalHeaderKey(rule.Name)
+		rule.Action = strings.ToLower(rule.Action)
+		if len(rule.Action) == 0 {
+			rule.Action = model.HeaderSet
+		}
+		if rule.Action == model.HeaderRemove {
+			rule.Value = ""
+		}
+		res = append(res, rule)
+	}
+	return res
+}
+
+// applyHeaderRules change the request as configured for the instance
+func applyHeaderRules(req *http.Request, rules []model.HeaderRule) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case model.HeaderAdd:
+			req.Header.Add(rule.Name, rule.Value)
+		case model.HeaderRemove:
+			req.Header.Del(rule.Name)
+		default:
+			req.Header.Set(rule.Name, rule.Value)
+		}
+	}
+}
+
+// dropConnectionHeaders remove the headers a client lists in Connection,
+// the proxy would otherwise drop the headers set by redzilla
+func dropConnectionHeaders(req *http.Request) {
+
+	options := []string{}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if len(token) == 0 {
+				continue
+			}
+			known := false
+			for _, option := range connectionTokens {
+				if strings.EqualFold(token, option) {
+					known = true
+				}
+			}
+			if known {
+				options = append(options, token)
+				continue
+			}
+			req.Header.Del(token)
+		}
+	}
+
+	if len(options) == 0 {
+		req.Header.Del("Connection")
+		return
+	}
+	req.Header.Set("Connection", strings.Join(options, ", "))
+}
+
+// forwardedNode format an address for the Forwarded header
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// setForwardedHeaders describe the client to the instance. Headers sent by
+// peers other than trusted proxies are dropped. X-Forwarded-For lists the
+// prior hops only, the reverse proxy appends the peer address
+func setForwardedHeaders(req *http.Request, proxies []*net.IPNet) {
+
+	trusted := isTrustedProxy(req, proxies)
+	if !trusted {
+		for _, header := range forwardedHeaders {
+			req.Header.Del(header)
+		}
+	}
+
+	proto := requestScheme(req)
+	if value := req.Header.Get("X-Forwarded-Proto"); len(value) > 0 {
+		proto = value
+	}
+	host := req.Host
+	if value := req.Header.Get("X-Forwarded-Host"); len(value) > 0 {
+		host = value
+	}
+
+	prior := strings.Join(req.Header["X-Forwarded-For"], ", ")
+	req.Header.Del("X-Forwarded-For")
+	if len(prior) > 0 {
+		req.Header.Set("X-Forwarded-For", prior)
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", host)
+
+	// each hop describes the request it received
+	element := fmt.Sprintf(`for=%s;host="%s";proto=%s`, forwardedNode(remoteIP(req)), req.Host, requestScheme(req))
+	if value := strings.Join(req.Header["Forwarded"], ", "); len(value) > 0 {
+		element = value + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// appendForwardedFor add the peer address to X-Forwarded-For, for requests
+// not sent by the reverse proxy
+func appendForwardedFor(req *http.Request) {
+	ip := remoteIP(req)
+	if len(ip) == 0 {
+		return
+	}
+	if prior := req.Header.Get("X-Forwarded-For"); len(prior) > 0 {
+		ip = prior + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+}
+
+// proxyHeaders prepare the headers of a request proxied to an instance:
+// client description, redzilla credentials removed, instance rules, then
+// the headers of the auth service
+func proxyHeaders(c *gin.Context, instance *model.Instance, proxies []*net.IPNet) {
+
+	req := c.Request
+
+	dropConnectionHeaders(req)
+	setForwardedHeaders(req, proxies)
+	for _, name := range []string{sessionCookie, stateCookie} {
+		if _, err := req.Cookie(name); err == nil {
+			stripSessionCookie(req)
+			break
+		}
+	}
+
+	applyHeaderRules(req, instance.ProxyHeaders)
+
+	if headers, ok := c.Get(upstreamHeadersKey); ok {
+		for key, value := range headers.(map[string]string) {
+			req.Header.Set(key, value)
+		}
+	}
+}
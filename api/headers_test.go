@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidateHeaderRules(t *testing.T) {
+
+	valid := []model.HeaderRule{
+		{Name: "x-tenant", Value: "acme"},
+		{Name: "X-Feature", Action: "ADD", Value: "beta"},
+		{Name: "Accept-Language", Action: model.HeaderRemove, Value: "ignored"},
+	}
+	if err := validateHeaderRules(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := normalizeHeaderRules(valid)
+	if rules[0].Name != "X-Tenant" || rules[0].Action != model.HeaderSet || rules[1].Action != model.HeaderAdd || rules[2].Value != "" {
+		t.Fatalf("Rules should be normalized, got %+v", rules)
+	}
+
+	for _, invalid := range []model.HeaderRule{
+		{Name: "X Tenant"},
+		{Name: "host", Value: "other"},
+		{Name: "X-Forwarded-For", Value: "10.0.0.1"},
+		{Name: "X-Tenant", Action: "replace"},
+		{Name: "X-Tenant", Value: "a\r\nX-Admin: true"},
+	} {
+		if err := validateHeaderRules([]model.HeaderRule{invalid}); err == nil {
+			t.Fatalf("Rule %+v should be refused", invalid)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/8", "not-an-ip"}); err == nil {
+		t.Fatal("Invalid proxy should be refused")
+	}
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://tenant.redzilla.localhost/", nil)
+	for addr, trusted := range map[string]bool{"10.1.2.3:4000": true, "[::1]:4000": true, "192.168.1.1:4000": false, "bogus": false} {
+		req.RemoteAddr = addr
+		if isTrustedProxy(req, proxies) != trusted {
+			t.Fatalf("Trust of %s should be %v", addr, trusted)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://tenant.redzilla.localhost/", nil)
+	req.RemoteAddr = "192.168.1.5:4000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Real-Ip", "1.2.3.4")
+	setForwardedHeaders(req, proxies)
+
+	if req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("X-Real-Ip") != "" || req.Header.Get("X-Forwarded-Proto") != "http" {
+		t.Fatalf("Headers of untrusted peers should be dropped, got %v", req.Header)
+	}
+	if req.Header.Get("Forwarded") != `for=192.168.1.5;host="tenant.redzilla.localhost";proto=http` {
+		t.Fatalf("Forwarded should describe the peer, got %s", req.Header.Get("Forwarded"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://tenant.redzilla.localhost/", nil)
+	req.RemoteAddr = "10.0.0.2:4000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "flows.example.com")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	setForwardedHeaders(req, proxies)
+
+	if req.Header.Get("X-Forwarded-For") != "1.2.3.4" || req.Header.Get("X-Forwarded-Proto") != "https" || req.Header.Get("X-Forwarded-Host") != "flows.example.com" {
+		t.Fatalf("Headers of trusted proxies should be kept, got %v", req.Header)
+	}
+	if !strings.HasPrefix(req.Header.Get("Forwarded"), "for=1.2.3.4, for=10.0.0.2;") {
+		t.Fatalf("Forwarded should be appended, got %s", req.Header.Get("Forwarded"))
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"host": r.Host, "header": r.Header})
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://tenant.redzilla.localhost/flows", nil)
+	req.RemoteAddr = "192.168.1.5:4000"
+	req.Header.Set("Connection", "keep-alive, X-Tenant, X-Remote-User")
+	req.Header.Set("Cookie", sessionCookie+"=secret; io=abc")
+	req.Header.Set("Accept-Language", "en")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	c.Set(upstreamHeadersKey, map[string]string{"X-Remote-User": "alice"})
+	proxyHeaders(c, &model.Instance{ProxyHeaders: normalizeHeaderRules([]model.HeaderRule{
+		{Name: "X-Tenant", Value: "acme"},
+		{Name: "Accept-Language", Action: model.HeaderRemove},
+	})}, nil)
+
+	req.URL.Scheme = "http"
+	req.URL.Host = strings.TrimPrefix(backend.URL, "http://")
+	req.RequestURI = ""
+
+	newReverseProxy(&model.Config{}, nil).ServeHTTP(w, req)
+
+	res := struct {
+		Host   string
+		Header http.Header
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Host != "tenant.redzilla.localhost" {
+		t.Fatalf("Original host should be kept when not rewritten, got %s", res.Host)
+	}
+	if got := res.Header.Get("X-Forwarded-For"); got != "192.168.1.5" {
+		t.Fatalf("Client address should be forwarded once, got %s", got)
+	}
+	if res.Header.Get("X-Remote-User") != "alice" {
+		t.Fatalf("Auth service headers should not be dropped by the client, got %v", res.Header)
+	}
+	if res.Header.Get("X-Tenant") != "acme" || res.Header.Get("Accept-Language") != "" {
+		t.Fatalf("Instance rules should apply, got %v", res.Header)
+	}
+	if res.Header.Get("Cookie") != "io=abc" {
+		t.Fatalf("Session cookie should be stripped, got %s", res.Header.Get("Cookie"))
+	}
+}
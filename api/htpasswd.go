@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxVerifiedPasswords bound the cache of checked passwords, bcrypt is
+// too slow to run on each proxied request
+const maxVerifiedPasswords = 1000
+
+// htpasswd authenticates basic auth users of an htpasswd file, reloaded
+// when it changes. Passwords are hashed with bcrypt (htpasswd -B) or SHA1
+type htpasswd struct {
+	path     string
+	mutex    sync.Mutex
+	modTime  time.Time
+	users    map[string]string
+	verified map[[32]byte]bool
+}
+
+func newHtpasswd(path string) (*htpasswd, error) {
+
+	if len(path) == 0 {
+		return nil, errors.New("AuthHtpasswdFile is required by the basic provider")
+	}
+
+	h := &htpasswd{path: path}
+	err := h.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// parseHtpasswd read user:hash lines, skipping comments
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, errors.New("Invalid htpasswd line")
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	return users, scanner.Err()
+}
+
+// checkPassword compare a password with an htpasswd hash
+func checkPassword(hash, password string) bool {
+
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+
+	return false
+}
+
+// reload the file if modified since last read
+func (h *htpasswd) reload() error {
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && info.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return err
+	}
+
+	for user, hash := range users {
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			logrus.Warnf("Unsupported password hash for %s in %s, use bcrypt", user, h.path)
+		}
+	}
+
+	h.users = users
+	h.modTime = info.ModTime()
+	h.verified = make(map[[32]byte]bool)
+	logrus.Debugf("Loaded %d users from %s", len(users), h.path)
+
+	return nil
+}
+
+// verify check the password of a known user, false if the user is unknown
+func (h *htpasswd) verify(user, password string) (known bool, valid bool) {
+
+	h.mutex.Lock()
+	err := h.reload()
+	if err != nil {
+		logrus.Warnf("Failed to reload %s: %s", h.path, err.Error())
+	}
+	hash, ok := h.users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	cached := h.verified[key]
+	h.mutex.Unlock()
+
+	if !ok {
+		return false, false
+	}
+	if cached {
+		return true, true
+	}
+
+	// bcrypt is slow, do not hold the lock while checking
+	if !checkPassword(hash, password) {
+		return true, false
+	}
+
+	h.mutex.Lock()
+	if len(h.verified) >= maxVerifiedPasswords {
+		h.verified = make(map[[32]byte]bool)
+	}
+	h.verified[key] = true
+	h.mutex.Unlock()
+
+	return true, true
+}
+
+// authenticate accept basic auth credentials of the users in the file
+func (h *htpasswd) authenticate(c *gin.Context, cfg *model.Config) bool {
+
+	user, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	known, valid := h.verify(user, password)
+	if !known {
+		return false
+	}
+	if !valid {
+		c.Header("WWW-Authenticate", `Basic realm="redzilla"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return true
+	}
+
+	c.Set(principalKey, user)
+	if isProxied(c.Request, cfg) {
+		c.Request.Header.Del("Authorization")
+	}
+
+	return true
+}
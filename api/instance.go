@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"sync"
 
 	"github.com/ansriaz/redzilla/docker"
 	"github.com/ansriaz/redzilla/model"
@@ -14,6 +15,7 @@ import (
 const instanceCollection = "instances"
 
 var instancesCache = make(map[string]*Instance)
+var instancesCacheMutex sync.Mutex
 
 //ListInstances list available instances
 func ListInstances(cfg *model.Config) (*[]model.Instance, error) {
@@ -41,6 +43,8 @@ func ListInstances(cfg *model.Config) (*[]model.Instance, error) {
 
 // GetInstance return a instance from the cache if available
 func GetInstance(name string, cfg *model.Config) *Instance {
+	instancesCacheMutex.Lock()
+	defer instancesCacheMutex.Unlock()
 	if _, ok := instancesCache[name]; !ok {
 		instancesCache[name] = NewInstance(name, cfg)
 	}
@@ -67,6 +71,13 @@ func NewInstance(name string, cfg *model.Config) *Instance {
 		logContext: NewInstanceContext(),
 	}
 
+	// load the stored record, if any, runtime informations are resolved later
+	err = i.Reload()
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to load instance %s: %s", name, err.Error())
+	}
+	i.Reset()
+
 	// TODO add support to port mapping (eg. MQTT)
 	i.instance.Port = NodeRedPort
 
@@ -107,25 +118,77 @@ type Instance struct {
 	logContext *InstanceContext
 }
 
-//Save instance status
-func (i *Instance) Save() error {
+//Save instance status, failing with storage.ErrConflict if the stored
+//record has been modified since it was loaded
+func (i *Instance) Save(actor, action string) error {
 
 	logrus.Debugf("Saving instance state %s", i.instance.Name)
 
-	err := i.store.Save(i.instance.Name, i.instance)
+	record := *i.instance
+	record.Touch(actor, action)
+	// the principal creating an instance owns it
+	if record.Version == 0 && len(record.Owner) == 0 && actor != SystemPrincipal {
+		record.Owner = actor
+	}
+
+	err := i.store.Update(record.Name, &record, i.instance.Version)
 	if err != nil {
+		if err == storage.ErrConflict {
+			logrus.Warnf("Instance %s changed concurrently, reloading", record.Name)
+			rerr := i.Reload()
+			if rerr != nil {
+				logrus.Warnf("Failed to reload %s: %s", record.Name, rerr.Error())
+			}
+		}
 		return err
 	}
 
+	*i.instance = record
+	logrus.Infof("Instance %s %s by %s (version %d)", record.Name, action, actor, record.Version)
+
 	return nil
 }
 
+//Reload the stored record, keeping runtime informations
+func (i *Instance) Reload() error {
+
+	dbInstance := new(model.Instance)
+	err := i.store.Load(i.instance.Name, dbInstance)
+	if err != nil {
+		return err
+	}
+
+	dbInstance.IP = i.instance.IP
+	dbInstance.Address = i.instance.Address
+	dbInstance.Status = i.instance.Status
+	*i.instance = *dbInstance
+
+	return nil
+}
+
+// restore the record taken before a failed change, then the stored one as
+// the change may have been saved before failing
+func (i *Instance) restore(previous model.Instance) {
+
+	*i.instance = previous
+
+	err := i.Reload()
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to reload %s: %s", previous.Name, err.Error())
+	}
+}
+
+//StoredVersion return the version of the stored record
+func (i *Instance) StoredVersion() (int64, error) {
+	return i.store.Version(i.instance.Name)
+}
+
 //Create instance without starting
-func (i *Instance) Create() error {
+func (i *Instance) Create(actor string) error {
 
 	logrus.Debugf("Creating instance %s", i.instance.Name)
 
-	err := i.Save()
+	err := i.Save(actor, "create")
 	if err != nil {
 		return err
 	}
@@ -134,16 +197,43 @@ func (i *Instance) Create() error {
 }
 
 //Start an instance creating a record for if it does not exists
-func (i *Instance) Start() error {
+func (i *Instance) Start(actor string) error {
+	return i.start(actor, "start")
+}
+
+func (i *Instance) start(actor, action string) error {
 
 	logrus.Debugf("Starting instance %s", i.instance.Name)
 
-	err := i.Save()
+	err := i.schedule()
+	if err != nil {
+		return err
+	}
+
+	err = i.checkQuota()
+	if err != nil {
+		return err
+	}
+
+	if i.instance.InstallPending {
+		err = docker.InstallPackages(i.instance, i.cfg)
+		if err != nil {
+			return err
+		}
+		i.instance.InstallPending = false
+	}
+
+	err = i.Save(actor, action)
+	if err != nil {
+		return err
+	}
+
+	opts, err := i.containerOptions()
 	if err != nil {
 		return err
 	}
 
-	err = docker.StartContainer(i.instance.Name, i.cfg)
+	err = docker.StartContainer(i.instance, opts, i.cfg)
 	if err != nil {
 		return err
 	}
@@ -151,10 +241,36 @@ func (i *Instance) Start() error {
 	return nil
 }
 
+// schedule assign a node to the instance if it has none or the node is
+// no longer configured
+func (i *Instance) schedule() error {
+
+	if len(i.instance.Node) > 0 {
+		_, err := docker.GetNodeConfig(i.instance.Node)
+		if err == nil {
+			return nil
+		}
+		logrus.Warnf("Node %s of %s not available, rescheduling", i.instance.Node, i.instance.Name)
+	}
+
+	node, err := docker.Schedule(i.instance.NodeSelector, i.cfg)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("Scheduled %s on node %s", i.instance.Name, node)
+	i.instance.Node = node
+
+	return nil
+}
+
 //StartLogsPipe start the container log pipe
 func (i *Instance) StartLogsPipe() error {
 	logrus.Debugf("Start log pipe for %s", i.instance.Name)
-	return docker.ContainerWatchLogs(i.logContext.GetContext(), i.instance.Name, i.logger.GetFile())
+	// replace any previous pipe
+	i.logContext.Cancel()
+	i.logContext = NewInstanceContext()
+	return docker.ContainerWatchLogs(i.logContext.GetContext(), i.instance.Node, i.instance.Name, i.logger.GetFile())
 }
 
 //StopLogsPipe stop the container log pipe
@@ -176,6 +292,13 @@ func (i *Instance) Remove() error {
 		return err
 	}
 
+	err = storage.GetStore(usageCollection, i.cfg).Delete(i.instance.Name)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to remove usage of %s: %s", i.instance.Name, err.Error())
+	}
+
+	removeDomains(i.instance.Name, i.instance.Domains, i.cfg)
+
 	return nil
 }
 
@@ -184,11 +307,18 @@ func (i *Instance) Stop() error {
 
 	logrus.Debugf("Stopping instance %s", i.instance.Name)
 
-	err := docker.StopContainer(i.instance.Name)
+	err := docker.StopContainer(i.instance.Node, i.instance.Name)
 	if err != nil {
 		return err
 	}
 
+	closeConnections(i.instance.Name)
+
+	err = i.removeSecretFiles()
+	if err != nil {
+		logrus.Warnf("Failed to remove secret files of %s: %s", i.instance.Name, err.Error())
+	}
+
 	return nil
 }
 
@@ -221,7 +351,7 @@ func (i *Instance) IsRunning() (bool, error) {
 		return true, nil
 	}
 
-	info, err := docker.GetContainer(i.instance.Name)
+	info, err := docker.GetContainer(i.instance.Node, i.instance.Name)
 	if err != nil {
 		return false, err
 	}
@@ -237,9 +367,9 @@ func (i *Instance) IsRunning() (bool, error) {
 }
 
 //Restart instance
-func (i *Instance) Restart() error {
+func (i *Instance) Restart(actor string) error {
 	i.Stop()
-	return i.Start()
+	return i.start(actor, "restart")
 }
 
 //GetLogger Return the dedicated logger
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+)
+
+// maxLabelLength limit label keys and values
+const maxLabelLength = 253
+
+var labelKeyRegexp = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._/-]*$")
+
+// validateLabels check label keys can be used as container labels too,
+// keys prefixed with redzilla are reserved
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyRegexp.MatchString(key) || len(key) > maxLabelLength {
+			return errors.New("Invalid label key " + key)
+		}
+		if strings.HasPrefix(key, "redzilla") {
+			return errors.New("Reserved label key " + key)
+		}
+		if len(value) > maxLabelLength {
+			return errors.New("Label value too long for " + key)
+		}
+	}
+	return nil
+}
+
+// mergeValues apply changes to a key/value map, an empty value removes the key
+func mergeValues(labels, changes map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range changes {
+		if len(value) == 0 {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// parseSelector parse a label selector like env=prod,team=iot
+func parseSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if len(selector) == 0 {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(selector, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(key) == 0 {
+			return nil, errors.New("Invalid selector " + pair)
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// instanceFilter select, sort and paginate instances from query parameters
+type instanceFilter struct {
+	Selector map[string]string
+	Status   string
+	Prefix   string
+	Sort     string
+	Offset   int
+	Limit    int
+}
+
+// newInstanceFilter read the filter from the listing query parameters
+func newInstanceFilter(c *gin.Context) (*instanceFilter, error) {
+
+	var err error
+	f := new(instanceFilter)
+
+	f.Selector, err = parseSelector(c.Query("selector"))
+	if err != nil {
+		return nil, err
+	}
+
+	f.Status = strings.ToLower(c.Query("status"))
+	switch f.Status {
+	case "", "started", "stopped", "died":
+	default:
+		return nil, errors.New("Invalid status " + f.Status)
+	}
+
+	f.Prefix = c.Query("prefix")
+
+	f.Sort = c.DefaultQuery("sort", "name")
+	switch strings.TrimPrefix(f.Sort, "-") {
+	case "name", "created", "updated":
+	default:
+		return nil, errors.New("Invalid sort " + f.Sort)
+	}
+
+	if offset := c.Query("offset"); len(offset) > 0 {
+		f.Offset, err = strconv.Atoi(offset)
+		if err != nil || f.Offset < 0 {
+			return nil, errors.New("Invalid offset")
+		}
+	}
+	if limit := c.Query("limit"); len(limit) > 0 {
+		f.Limit, err = strconv.Atoi(limit)
+		if err != nil || f.Limit < 0 {
+			return nil, errors.New("Invalid limit")
+		}
+	}
+
+	return f, nil
+}
+
+// statusName return the name used to filter by status
+func statusName(status model.InstanceStatus) string {
+	switch status {
+	case model.InstanceStarted:
+		return "started"
+	case model.InstanceStopped:
+		return "stopped"
+	}
+	return "died"
+}
+
+func (f *instanceFilter) match(instance *model.Instance) bool {
+	if len(f.Status) > 0 && statusName(instance.Status) != f.Status {
+		return false
+	}
+	if len(f.Prefix) > 0 && !strings.HasPrefix(instance.Name, f.Prefix) {
+		return false
+	}
+	return instance.MatchLabels(f.Selector)
+}
+
+// apply return the matching instances page and the total of matches
+func (f *instanceFilter) apply(list []model.Instance) ([]model.Instance, int) {
+
+	matches := make([]model.Instance, 0)
+	for idx := range list {
+		if f.match(&list[idx]) {
+			matches = append(matches, list[idx])
+		}
+	}
+
+	desc := strings.HasPrefix(f.Sort, "-")
+	field := strings.TrimPrefix(f.Sort, "-")
+	sort.SliceStable(matches, func(a, b int) bool {
+		if desc {
+			a, b = b, a
+		}
+		switch field {
+		case "created":
+			return matches[a].Created.Before(matches[b].Created)
+		case "updated":
+			return matches[a].Updated.Before(matches[b].Updated)
+		}
+		return matches[a].Name < matches[b].Name
+	})
+
+	total := len(matches)
+	if f.Offset >= total {
+		return []model.Instance{}, total
+	}
+	matches = matches[f.Offset:]
+	if f.Limit > 0 && f.Limit < len(matches) {
+		matches = matches[:f.Limit]
+	}
+
+	return matches, total
+}
+
+// patchRequest is the body of an instance update, empty values remove
+// the key
+type patchRequest struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	Env         map[string]string
+	Secrets     map[string]string
+	// SecretRefs, Mounts and ProxyHeaders replace the current ones when set
+	SecretRefs   []model.SecretRef
+	Mounts       []model.Mount
+	DiskQuota    *int64
+	ProxyHeaders []model.HeaderRule
+	// Owner can be changed by admins, Team by members of the team
+	Owner *string
+	Team  *string
+}
+
+// patchInstance update the instance labels, annotations, env, secrets,
+// mounts, proxy headers and ownership. A running instance is recreated to apply container
+// changes
+func patchInstance(c *gin.Context, instance *Instance) {
+
+	req := patchRequest{}
+	err := c.BindJSON(&req)
+	if err != nil {
+		return
+	}
+
+	err = validateLabels(req.Labels)
+	if err == nil {
+		err = validateSecretRefs(req.SecretRefs)
+	}
+	if err == nil {
+		err = validateMounts(req.Mounts, "", instance.cfg)
+	}
+	if err == nil {
+		err = validateHeaderRules(req.ProxyHeaders)
+	}
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !authorizeSettings(c, instance.cfg, instance.GetStatus().Name, req.SecretRefs, "", req.Mounts) {
+		return
+	}
+	if !authorizeLimits(c, "", nil, req.DiskQuota) {
+		return
+	}
+	if !authorizeOwnership(c, req.Owner, req.Team) {
+		return
+	}
+
+	req.Secrets, err = encryptSecrets(req.Secrets, instance.cfg)
+	if err != nil {
+		secretsError(c, err)
+		return
+	}
+
+	if !instanceExists(c, instance) {
+		return
+	}
+	if !matchVersion(c, instance) {
+		return
+	}
+
+	running, err := instance.IsRunning()
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	previous := *instance.GetStatus()
+	record := instance.GetStatus()
+	if req.Labels != nil {
+		record.Labels = mergeValues(record.Labels, req.Labels)
+	}
+	if req.Annotations != nil {
+		record.Annotations = mergeValues(record.Annotations, req.Annotations)
+	}
+	if req.Env != nil {
+		record.Env = mergeValues(record.Env, req.Env)
+	}
+	if req.Secrets != nil {
+		record.Secrets = mergeValues(record.Secrets, req.Secrets)
+	}
+	if req.SecretRefs != nil {
+		record.SecretRefs = req.SecretRefs
+	}
+	if req.Mounts != nil {
+		record.Mounts = normalizeMounts(req.Mounts)
+	}
+	if req.DiskQuota != nil {
+		record.DiskQuota = *req.DiskQuota
+	}
+	if req.ProxyHeaders != nil {
+		record.ProxyHeaders = normalizeHeaderRules(req.ProxyHeaders)
+	}
+	if req.Owner != nil {
+		record.Owner = *req.Owner
+	}
+	if req.Team != nil {
+		record.Team = *req.Team
+	}
+
+	// labels are container labels too
+	recreate := req.Labels != nil || req.Env != nil || req.Secrets != nil || req.SecretRefs != nil || req.Mounts != nil
+	if running && recreate {
+		err = instance.Recreate(getPrincipal(c), "update")
+	} else {
+		err = instance.Save(getPrincipal(c), "update")
+	}
+	if err != nil {
+		instance.restore(previous)
+		saveError(c, err)
+		return
+	}
+
+	setETag(c, instance.GetStatus())
+	c.JSON(http.StatusOK, instance.GetStatus().Redact())
+}
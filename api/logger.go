@@ -8,6 +8,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// instanceLogFile is the log file name in the instance data directory
+const instanceLogFile = "instance.log"
+
 var loggerInstances = make(map[string]*InstanceLogger)
 
 // NewInstanceLogger create a new instance and cache it
@@ -29,6 +32,14 @@ func CloseInstanceLoggers() {
 	}
 }
 
+//CloseInstanceLogger close the file logger of an instance
+func CloseInstanceLogger(name string) {
+	if instanceLogger, ok := loggerInstances[name]; ok {
+		instanceLogger.Close()
+		delete(loggerInstances, name)
+	}
+}
+
 //InstanceLogger a logger for a container instance
 type InstanceLogger struct {
 	Name   string
@@ -54,7 +65,7 @@ func (i *InstanceLogger) Close() {
 
 func createInstanceLogger(name string, path string) error {
 
-	filename := filepath.Join(path, "instance.log")
+	filename := filepath.Join(path, instanceLogFile)
 
 	logrus.Debugf("Create log for %s at %s", name, path)
 
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ansriaz/redzilla/docker"
+	"github.com/ansriaz/redzilla/model"
+)
+
+//ErrDataVolume is returned for operations on the data directory of an
+//instance using a data volume
+var ErrDataVolume = errors.New("Not supported for instances with a data volume")
+
+var volumeNameRegexp = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9_.-]*$")
+
+// reservedTargets are mounted by redzilla
+var reservedTargets = []string{docker.DataPath, docker.ConfigPath, secretFilesPath}
+
+// isSubpath check if path is base or inside it, both cleaned
+func isSubpath(path, base string) bool {
+	return path == base || strings.HasPrefix(path, strings.TrimSuffix(base, "/")+"/")
+}
+
+// allowedHostPath check a bind source against the admin allow-list,
+// resolving symlinks of existing paths
+func allowedHostPath(source string, allowList []string) bool {
+
+	paths := []string{source}
+	if resolved, err := filepath.EvalSymlinks(source); err == nil {
+		paths = append(paths, resolved)
+	}
+
+	for _, path := range paths {
+		allowed := false
+		for _, base := range allowList {
+			base, err := filepath.Abs(base)
+			if err != nil {
+				continue
+			}
+			if isSubpath(path, base) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateMounts check instance mounts and data volume
+func validateMounts(mounts []model.Mount, dataVolume string, cfg *model.Config) error {
+
+	if len(dataVolume) > 0 && !volumeNameRegexp.MatchString(dataVolume) {
+		return errors.New("Invalid data volume " + dataVolume)
+	}
+
+	targets := make(map[string]bool)
+	for _, m := range mounts {
+
+		target := filepath.Clean(m.Target)
+		if !filepath.IsAbs(m.Target) || target == "/" {
+			return errors.New("Invalid mount target " + m.Target)
+		}
+		for _, reserved := range reservedTargets {
+			if isSubpath(target, reserved) || isSubpath(reserved, target) {
+				return errors.New("Reserved mount target " + m.Target)
+			}
+		}
+		if targets[target] {
+			return errors.New("Duplicated mount target " + m.Target)
+		}
+		targets[target] = true
+
+		switch m.Type {
+		case model.MountVolume:
+			if !volumeNameRegexp.MatchString(m.Source) {
+				return errors.New("Invalid volume " + m.Source)
+			}
+		case model.MountBind:
+			source := filepath.Clean(m.Source)
+			if !filepath.IsAbs(m.Source) || !allowedHostPath(source, cfg.MountAllowList) {
+				return errors.New("Host path not allowed " + m.Source)
+			}
+		case model.MountTmpfs:
+			if len(m.Source) > 0 || m.Size < 0 {
+				return errors.New("Invalid tmpfs mount " + m.Target)
+			}
+		default:
+			return errors.New("Invalid mount type " + m.Type)
+		}
+	}
+
+	return nil
+}
+
+// normalizeMounts clean mount paths before storing
+func normalizeMounts(mounts []model.Mount) []model.Mount {
+	if mounts == nil {
+		return nil
+	}
+	normalized := make([]model.Mount, 0, len(mounts))
+	for _, m := range mounts {
+		m.Target = filepath.Clean(m.Target)
+		if m.Type == model.MountBind {
+			m.Source = filepath.Clean(m.Source)
+			m.ReadOnly = true
+		}
+		normalized = append(normalized, m)
+	}
+	return normalized
+}
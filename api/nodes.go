@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ansriaz/redzilla/docker"
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// MoveResult report the outcome of moving an instance off a node
+type MoveResult struct {
+	Name    string
+	Node    string
+	Error   string `json:",omitempty"`
+	Started bool
+}
+
+// DrainNode mark a node as draining and move its instances to other nodes.
+// Instance data must be available at InstanceDataPath on all nodes
+func DrainNode(node, actor string, cfg *model.Config) ([]MoveResult, error) {
+
+	err := docker.SetDraining(node, true, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultNode, err := docker.GetNodeConfig("")
+	if err != nil {
+		return nil, err
+	}
+
+	store := storage.GetStore(instanceCollection, cfg)
+	jsonlist, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MoveResult, 0)
+	for _, jsonstr := range jsonlist {
+
+		item := new(model.Instance)
+		err = json.Unmarshal([]byte(jsonstr), item)
+		if err != nil {
+			return nil, err
+		}
+
+		instanceNode := item.Node
+		if len(instanceNode) == 0 {
+			instanceNode = defaultNode.Name
+		}
+		if instanceNode != node {
+			continue
+		}
+
+		results = append(results, moveInstance(GetInstance(item.Name, cfg), actor))
+	}
+
+	return results, nil
+}
+
+// moveInstance stop an instance and start it on a newly scheduled node
+func moveInstance(instance *Instance, actor string) MoveResult {
+
+	name := instance.GetStatus().Name
+	result := MoveResult{Name: name}
+
+	running, err := instance.IsRunning()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if running {
+		err = instance.Stop()
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	instance.Reset()
+	instance.GetStatus().Node = ""
+
+	if running {
+		err = instance.start(actor, "move")
+		result.Started = err == nil
+	} else {
+		err = instance.schedule()
+		if err == nil {
+			err = instance.Save(actor, "move")
+		}
+	}
+
+	result.Node = instance.GetStatus().Node
+	if err != nil {
+		logrus.Warnf("Failed to move %s: %s", name, err.Error())
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+func nodesHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		c.JSON(http.StatusOK, docker.ListNodes(cfg))
+	}
+}
+
+func nodeDrainHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		node := c.Param("node")
+		if _, err := docker.GetNodeConfig(node); err != nil {
+			notFound(c)
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodPost:
+			setAuditAction(c, "node.drain")
+
+			results, err := DrainNode(node, getPrincipal(c), cfg)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			c.JSON(http.StatusOK, results)
+		case http.MethodDelete:
+			setAuditAction(c, "node.undrain")
+
+			err := docker.SetDraining(node, false, cfg)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
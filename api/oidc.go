@@ -0,0 +1,391 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionCookie holds the signed session shared by the domain and subdomains
+const sessionCookie = "redzilla_session"
+
+// stateCookie holds the signed state of a login in progress
+const stateCookie = "redzilla_oidc_state"
+
+// loginTTL is the time allowed to complete a login at the provider
+const loginTTL = 10 * time.Minute
+
+// authPathPrefix serves the login flow on the root domain
+const authPathPrefix = "/auth/"
+
+var oidcProvider *oidc.Provider
+var sessionKey []byte
+
+// session is the payload of the session cookie
+type session struct {
+	Principal string
+	Groups    []string `json:",omitempty"`
+	Expires   int64
+}
+
+// loginState is the payload of the state cookie
+type loginState struct {
+	State   string
+	Nonce   string
+	Return  string
+	Expires int64
+}
+
+// initOIDC setup the provider and the key signing session cookies
+func initOIDC(cfg *model.Config) {
+
+	oidcProvider = oidc.NewProvider(cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret)
+
+	if len(cfg.SessionSecret) > 0 {
+		sum := sha256.Sum256([]byte(cfg.SessionSecret))
+		sessionKey = sum[:]
+		return
+	}
+
+	logrus.Warn("SessionSecret not set, sessions are lost on restart and not shared by replicas")
+	sessionKey = make([]byte, 32)
+	_, err := rand.Read(sessionKey)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// randomToken return a random string for state and nonce
+func randomToken() (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// signValue encode and sign a cookie payload
+func signValue(key []byte, payload interface{}) (string, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	return base64.RawURLEncoding.EncodeToString(raw) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyValue check the signature and decode a cookie payload
+func verifyValue(key []byte, value string, payload interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return errors.New("Invalid cookie")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("Invalid cookie")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("Invalid cookie")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("Invalid cookie signature")
+	}
+	return json.Unmarshal(raw, payload)
+}
+
+// rootURL return the base URL of the root domain as seen by the client
+func rootURL(req *http.Request, cfg *model.Config) string {
+	port := ""
+	if idx := strings.LastIndex(req.Host, ":"); idx > -1 {
+		port = req.Host[idx:]
+	}
+	return requestScheme(req) + "://" + cfg.Domain + port
+}
+
+// redirectURL return the callback URL registered at the provider
+func redirectURL(req *http.Request, cfg *model.Config) string {
+	if len(cfg.OIDCRedirectURL) > 0 {
+		return cfg.OIDCRedirectURL
+	}
+	return rootURL(req, cfg) + authPathPrefix + "callback"
+}
+
+// safeReturnURL accept only URLs on the domain or its subdomains, to avoid
+// redirecting to other sites after login
+func safeReturnURL(raw string, cfg *model.Config) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "/"
+	}
+	host := u.Hostname()
+	if host != cfg.Domain && !strings.HasSuffix(host, "."+cfg.Domain) {
+		return "/"
+	}
+	return u.String()
+}
+
+// setCookie set a cookie, scoped to the domain and subdomains if shared
+func setCookie(c *gin.Context, cfg *model.Config, name, value, path string, maxAge int, shared bool) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   requestScheme(c.Request) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if shared {
+		cookie.Domain = cfg.Domain
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// oidcPrincipal read the principal from the configured claim, falling
+// back to the subject
+func oidcPrincipal(claims oidc.Claims, cfg *model.Config) string {
+	if principal := claims.String(cfg.OIDCPrincipalClaim); len(principal) > 0 {
+		return principal
+	}
+	return claims.String("sub")
+}
+
+// bearerToken return the token of an Authorization: Bearer header
+func bearerToken(req *http.Request) string {
+	value := req.Header.Get("Authorization")
+	if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	return ""
+}
+
+// readSession return the valid session of the request, if any
+func readSession(req *http.Request) *session {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	s := new(session)
+	err = verifyValue(sessionKey, cookie.Value, s)
+	if err != nil || time.Now().Unix() > s.Expires {
+		return nil
+	}
+	return s
+}
+
+// stripSessionCookie remove the redzilla session from requests proxied to
+// instances, so it cannot be replayed by instance code
+func stripSessionCookie(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name == sessionCookie || cookie.Name == stateCookie {
+			continue
+		}
+		req.AddCookie(cookie)
+	}
+}
+
+// sessionRequestAllowed protect API changes authenticated by the session
+// cookie from cross site requests: instance pages are same site with the
+// API, so the request must come from the API origin or carry a header only
+// scripts of that origin can add
+func sessionRequestAllowed(req *http.Request, cfg *model.Config) bool {
+	if isSafeMethod(req.Method) || len(req.Header.Get("X-Requested-With")) > 0 {
+		return true
+	}
+	origin := req.Header.Get("Origin")
+	return len(origin) > 0 && strings.EqualFold(origin, rootURL(req, cfg))
+}
+
+// isBrowser check if the request can be redirected to the login page
+func isBrowser(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// oidcAuthenticate accept a bearer token or a session cookie
+func oidcAuthenticate(c *gin.Context, cfg *model.Config) bool {
+
+	root := !isProxied(c.Request, cfg)
+
+	if token := bearerToken(c.Request); len(token) > 0 {
+		claims, err := oidcProvider.Verify(token, "")
+		if err != nil {
+			logrus.Debugf("Bearer token refused: %s", err.Error())
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return true
+		}
+		c.Set(principalKey, oidcPrincipal(claims, cfg))
+		c.Set(groupsKey, claims.Strings(cfg.OIDCGroupsClaim))
+		if !root {
+			c.Request.Header.Del("Authorization")
+		}
+		return true
+	}
+
+	if s := readSession(c.Request); s != nil {
+		if root && !sessionRequestAllowed(c.Request, cfg) {
+			logrus.Debugf("Session request to %s refused, cross origin", c.Request.URL.Path)
+			errorResponse(c, http.StatusForbidden, "Cross origin request refused")
+			c.Abort()
+			return true
+		}
+		c.Set(principalKey, s.Principal)
+		c.Set(groupsKey, s.Groups)
+		if !root {
+			stripSessionCookie(c.Request)
+		}
+		return true
+	}
+
+	return false
+}
+
+// oidcLogin send browsers without credentials to the login page, API
+// requests are refused instead
+func oidcLogin(c *gin.Context, cfg *model.Config) bool {
+
+	root := isRootDomain(c.Request.Host, cfg.Domain)
+	if !isBrowser(c.Request) || (root && strings.HasPrefix(c.Request.URL.Path, "/v2/")) {
+		return false
+	}
+
+	current := requestScheme(c.Request) + "://" + c.Request.Host + c.Request.URL.RequestURI()
+	login := rootURL(c.Request, cfg) + authPathPrefix + "login?rd=" + url.QueryEscape(current)
+	c.Redirect(http.StatusFound, login)
+	c.Abort()
+	return true
+}
+
+func loginHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		state, err := randomToken()
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		nonce, err := randomToken()
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		value, err := signValue(sessionKey, &loginState{
+			State:   state,
+			Nonce:   nonce,
+			Return:  safeReturnURL(c.Query("rd"), cfg),
+			Expires: time.Now().Add(loginTTL).Unix(),
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		authURL, err := oidcProvider.AuthCodeURL(redirectURL(c.Request, cfg), state, nonce, cfg.OIDCScopes)
+		if err != nil {
+			logrus.Errorf("OIDC provider not available: %s", err.Error())
+			errorResponse(c, http.StatusBadGateway, "Identity provider not available")
+			return
+		}
+
+		setCookie(c, cfg, stateCookie, value, authPathPrefix, int(loginTTL.Seconds()), false)
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+func callbackHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		cookie, err := c.Request.Cookie(stateCookie)
+		if err != nil {
+			errorResponse(c, http.StatusBadRequest, "Login not started")
+			return
+		}
+		setCookie(c, cfg, stateCookie, "", authPathPrefix, -1, false)
+
+		state := new(loginState)
+		err = verifyValue(sessionKey, cookie.Value, state)
+		if err != nil || time.Now().Unix() > state.Expires || state.State != c.Query("state") {
+			errorResponse(c, http.StatusBadRequest, "Invalid login state")
+			return
+		}
+
+		if errCode := c.Query("error"); len(errCode) > 0 {
+			errorResponse(c, http.StatusUnauthorized, "Login failed: "+errCode)
+			return
+		}
+
+		idToken, err := oidcProvider.Exchange(c.Query("code"), redirectURL(c.Request, cfg))
+		if err != nil {
+			logrus.Warnf("OIDC code exchange failed: %s", err.Error())
+			errorResponse(c, http.StatusUnauthorized, "Login failed")
+			return
+		}
+
+		claims, err := oidcProvider.Verify(idToken, state.Nonce)
+		if err != nil {
+			logrus.Warnf("OIDC token refused: %s", err.Error())
+			errorResponse(c, http.StatusUnauthorized, "Login failed")
+			return
+		}
+
+		s := &session{
+			Principal: oidcPrincipal(claims, cfg),
+			Groups:    claims.Strings(cfg.OIDCGroupsClaim),
+			Expires:   time.Now().Add(cfg.SessionTTL).Unix(),
+		}
+		value, err := signValue(sessionKey, s)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		logrus.Debugf("Login of %s", s.Principal)
+		setCookie(c, cfg, sessionCookie, value, "/", int(cfg.SessionTTL.Seconds()), true)
+		c.Redirect(http.StatusFound, state.Return)
+	}
+}
+
+func logoutHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setCookie(c, cfg, sessionCookie, "", "/", -1, true)
+		c.Redirect(http.StatusFound, safeReturnURL(c.Query("rd"), cfg))
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+// instancePathPrefix serve instances at /instance/<name>/ with path routing
+const instancePathPrefix = "/instance/"
+
+type pathContextKey string
+
+// pathPrefixKey hold the prefix of path routed requests, responses are
+// rewritten under it
+const pathPrefixKey = pathContextKey("pathPrefix")
+
+// pathInstance return the instance of a path routed request and its prefix
+func pathInstance(req *http.Request, cfg *model.Config) (string, string) {
+
+	if cfg.RoutingMode != model.RoutingPath || !isRootDomain(req.Host, cfg.Domain) {
+		return "", ""
+	}
+
+	name := extractInstanceName(req.URL.Path, cfg)
+	if len(name) == 0 {
+		return "", ""
+	}
+
+	return name, instancePathPrefix + name
+}
+
+// isProxied check if a request is for an instance rather than the API
+func isProxied(req *http.Request, cfg *model.Config) bool {
+	if !isRootDomain(req.Host, cfg.Domain) {
+		return true
+	}
+	name, _ := pathInstance(req, cfg)
+	return len(name) > 0
+}
+
+// requestInstance return the instance a proxied request is for
+func requestInstance(req *http.Request, cfg *model.Config) string {
+	if name, _ := pathInstance(req, cfg); len(name) > 0 {
+		return name
+	}
+	return hostInstance(req.Host, cfg)
+}
+
+// nodeRedRoots return the Node-RED arguments serving the editor and the
+// HTTP nodes under the instance prefix
+func nodeRedRoots(name string) []string {
+	prefix := instancePathPrefix + name
+	return []string{
+		"-D", "httpAdminRoot=" + prefix,
+		"-D", "httpNodeRoot=" + prefix,
+	}
+}
+
+// adminRoot return the path Node-RED serves the editor and admin API at,
+// the instance prefix unless stripped by the proxy
+func adminRoot(name string, cfg *model.Config) string {
+	if cfg.RoutingMode == model.RoutingPath && !cfg.PathStrip {
+		return instancePathPrefix + name
+	}
+	return ""
+}
+
+// underPrefix check if a path is the prefix or below it
+func underPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// withPathPrefix mark the request for response rewriting, stripping the
+// prefix when the instance is served at the root
+func withPathPrefix(req *http.Request, prefix string, strip bool) *http.Request {
+
+	if strip {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+		req.URL.RawPath = ""
+		if !strings.HasPrefix(req.URL.Path, "/") {
+			req.URL.Path = "/" + req.URL.Path
+		}
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), pathPrefixKey, prefix))
+}
+
+// rewriteLocation move a root relative redirect under the prefix
+func rewriteLocation(location, prefix string) string {
+
+	u, err := url.Parse(location)
+	if err != nil || u.IsAbs() || len(u.Host) > 0 || !strings.HasPrefix(u.Path, "/") || underPrefix(u.Path, prefix) {
+		return location
+	}
+
+	u.Path = prefix + u.Path
+	u.RawPath = ""
+	return u.String()
+}
+
+// rewriteCookie move the path of a cookie under the prefix, cookies
+// without path default to the request path, already under it
+func rewriteCookie(cookie, prefix string) string {
+
+	parts := strings.Split(cookie, ";")
+	for i := 1; i < len(parts); i++ {
+		attr := strings.TrimSpace(parts[i])
+		if len(attr) < 5 || !strings.EqualFold(attr[:5], "path=") {
+			continue
+		}
+		path := attr[5:]
+		if !strings.HasPrefix(path, "/") || underPrefix(path, prefix) {
+			continue
+		}
+		if path == "/" {
+			path = ""
+		}
+		parts[i] = " Path=" + prefix + path
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// rewriteResponse rewrite redirects and cookies of path routed responses
+func rewriteResponse(resp *http.Response) error {
+
+	if resp.Request == nil {
+		return nil
+	}
+	prefix, ok := resp.Request.Context().Value(pathPrefixKey).(string)
+	if !ok || len(prefix) == 0 {
+		return nil
+	}
+
+	if location := resp.Header.Get("Location"); len(location) > 0 {
+		resp.Header.Set("Location", rewriteLocation(location, prefix))
+	}
+
+	cookies := resp.Header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookie(cookie, prefix)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+func TestPathInstance(t *testing.T) {
+	cfg := &model.Config{Domain: "redzilla.localhost", RoutingMode: model.RoutingPath}
+
+	req := httptest.NewRequest(http.MethodGet, "http://redzilla.localhost:3000/instance/tenant/red/comms", nil)
+	name, prefix := pathInstance(req, cfg)
+	if name != "tenant" || prefix != "/instance/tenant" || !isProxied(req, cfg) {
+		t.Fatalf("Unexpected instance %s prefix %s", name, prefix)
+	}
+
+	api := httptest.NewRequest(http.MethodGet, "http://redzilla.localhost:3000/v2/instances", nil)
+	if isProxied(api, cfg) || requestInstance(api, cfg) != "" {
+		t.Fatal("API requests are not proxied")
+	}
+
+	cfg.RoutingMode = model.RoutingSubdomain
+	if name, _ := pathInstance(req, cfg); name != "" {
+		t.Fatal("Paths should not be routed with subdomain routing")
+	}
+
+	stripped := withPathPrefix(req, "/instance/tenant", true)
+	if stripped.URL.Path != "/red/comms" || stripped.Context().Value(pathPrefixKey) != "/instance/tenant" {
+		t.Fatalf("Prefix should be stripped, got %s", stripped.URL.Path)
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	prefix := "/instance/tenant"
+
+	for location, expected := range map[string]string{
+		"/red/?a=1":                    "/instance/tenant/red/?a=1",
+		"/instance/tenant/red/":        "/instance/tenant/red/",
+		"red/":                         "red/",
+		"https://example.com/callback": "https://example.com/callback",
+	} {
+		if rewritten := rewriteLocation(location, prefix); rewritten != expected {
+			t.Fatalf("Location %s rewritten to %s", location, rewritten)
+		}
+	}
+
+	if cookie := rewriteCookie("sid=1; Path=/; HttpOnly", prefix); cookie != "sid=1; Path=/instance/tenant; HttpOnly" {
+		t.Fatalf("Unexpected cookie %s", cookie)
+	}
+	if cookie := rewriteCookie("sid=1; path=/red", prefix); cookie != "sid=1; Path=/instance/tenant/red" {
+		t.Fatalf("Unexpected cookie %s", cookie)
+	}
+	if cookie := rewriteCookie("sid=1; Path=/instance/tenant/red", prefix); cookie != "sid=1; Path=/instance/tenant/red" {
+		t.Fatalf("Cookie under the prefix should be kept, got %s", cookie)
+	}
+
+	req := withPathPrefix(httptest.NewRequest(http.MethodGet, "http://redzilla.localhost/instance/tenant/", nil), prefix, false)
+	resp := &http.Response{Request: req, Header: http.Header{}}
+	resp.Header.Set("Location", "/red/login")
+	resp.Header.Add("Set-Cookie", "a=1; Path=/")
+	rewriteResponse(resp)
+	if resp.Header.Get("Location") != "/instance/tenant/red/login" || resp.Header.Get("Set-Cookie") != "a=1; Path=/instance/tenant" {
+		t.Fatalf("Unexpected response headers %v", resp.Header)
+	}
+}
+
+func TestAdminRequestPathRouting(t *testing.T) {
+
+	paths := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Write([]byte("[]"))
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		cfg  *model.Config
+		path string
+	}{
+		{&model.Config{RoutingMode: model.RoutingSubdomain}, "/flows"},
+		{&model.Config{RoutingMode: model.RoutingPath, PathStrip: true}, "/flows"},
+		{&model.Config{RoutingMode: model.RoutingPath}, "/instance/tenant/flows"},
+	} {
+		record := model.NewInstance("tenant")
+		record.Status = model.InstanceStarted
+		record.Address = strings.TrimPrefix(backend.URL, "http://")
+		instance := &Instance{instance: record, cfg: tc.cfg}
+
+		resp, err := instance.AdminRequest(http.MethodGet, "/flows", nil, http.Header{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := <-paths; path != tc.path || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Admin API should be called at %s, got %s", tc.path, path)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package api
 
 import (
-	"io"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -15,49 +15,12 @@ import (
 
 var reverseProxy *httputil.ReverseProxy
 
-func websocketProxy(target string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		d, err := net.Dial("tcp", target)
-		if err != nil {
-			http.Error(w, "Error contacting backend server.", 500)
-			logrus.Printf("Error dialing websocket backend %s: %v", target, err)
-			return
-		}
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "Not a hijacker?", 500)
-			return
-		}
-		nc, _, err := hj.Hijack()
-		if err != nil {
-			logrus.Printf("Hijack error: %v", err)
-			return
-		}
-		defer nc.Close()
-		defer d.Close()
-
-		err = r.Write(d)
-		if err != nil {
-			logrus.Printf("Error copying request to target: %v", err)
-			return
-		}
-
-		errc := make(chan error, 2)
-		cp := func(dst io.Writer, src io.Reader) {
-			_, err := io.Copy(dst, src)
-			errc <- err
-		}
-		go cp(d, nc)
-		go cp(nc, d)
-		<-errc
-	})
-}
-
 // newReverseProxy creates a reverse proxy that will redirect request to sub instances
-func newReverseProxy(cfg *model.Config) *httputil.ReverseProxy {
+func newReverseProxy(cfg *model.Config, tlsConfig *tls.Config) *httputil.ReverseProxy {
 	director := func(req *http.Request) {}
 	return &httputil.ReverseProxy{
-		Director: director,
+		Director:       director,
+		ModifyResponse: rewriteResponse,
 		Transport: &http.Transport{
 			// Proxy: func(req *http.Request) (*url.URL, error) {
 			// 	return http.ProxyFromEnvironment(req)
@@ -86,40 +49,47 @@ func newReverseProxy(cfg *model.Config) *httputil.ReverseProxy {
 				}
 				return conn, err
 			},
-			// TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
 		},
 	}
 }
 
-func isWebsocket(req *http.Request) bool {
-	connHeader := ""
-	connHeaders := req.Header["Connection"]
-	if len(connHeaders) > 0 {
-		connHeader = connHeaders[0]
-	}
-
-	upgradeWebsocket := false
-	if strings.ToLower(connHeader) == "upgrade" {
-		upgradeHeaders := req.Header["Upgrade"]
-		if len(upgradeHeaders) > 0 {
-			upgradeWebsocket = (strings.ToLower(upgradeHeaders[0]) == "websocket")
-		}
-	}
-
-	return upgradeWebsocket
-}
-
 //Handler for proxyed router requests
-func proxyHandler(cfg *model.Config) func(c *gin.Context) {
-	reverseProxy = newReverseProxy(cfg)
+func proxyHandler(cfg *model.Config, tlsConfig *tls.Config, proxies []*net.IPNet) func(c *gin.Context) {
+	reverseProxy = newReverseProxy(cfg, tlsConfig)
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
 	return func(c *gin.Context) {
 
-		if !isSubdomain(c.Request.Host, cfg.Domain) || isRootDomain(c.Request.Host, cfg.Domain) {
+		if !isProxied(c.Request, cfg) {
 			c.Next()
 			return
 		}
 
-		name := extractSubdomain(c.Request.Host, cfg)
+		name, prefix := pathInstance(c.Request, cfg)
+		if len(name) > 0 {
+			if _, err := validateName(name); err != nil {
+				notFound(c)
+				return
+			}
+			// relative links of the editor need the trailing slash
+			if c.Request.URL.Path == prefix {
+				redirectURL := *c.Request.URL
+				redirectURL.Path = prefix + "/"
+				c.Redirect(http.StatusMovedPermanently, redirectURL.String())
+				return
+			}
+		} else {
+			// custom domains not verified are left to the router
+			name = hostInstance(c.Request.Host, cfg)
+			if !isSubdomain(c.Request.Host, cfg.Domain) && len(name) == 0 {
+				c.Next()
+				return
+			}
+		}
 		if len(name) == 0 {
 			logrus.Debugf("Empty subdomain name at %s", c.Request.URL.String())
 			notFound(c)
@@ -134,6 +104,11 @@ func proxyHandler(cfg *model.Config) func(c *gin.Context) {
 			return
 		}
 
+		// reading is enough to browse an instance, changes need write access
+		if !authorizeInstance(c, cfg, instance, !isSafeMethod(c.Request.Method)) {
+			return
+		}
+
 		running, err := instance.IsRunning()
 		if err != nil {
 			internalError(c, err)
@@ -142,9 +117,38 @@ func proxyHandler(cfg *model.Config) func(c *gin.Context) {
 
 		if !running {
 			logrus.Debugf("Container %s not running", name)
+
+			target, rerr := getRedirect(name, cfg)
+			if rerr != nil {
+				internalError(c, rerr)
+				return
+			}
+			if len(target) > 0 {
+				redirectURL := *c.Request.URL
+				redirectURL.Scheme = requestScheme(c.Request)
+				redirectURL.Host = c.Request.Host
+				if len(prefix) > 0 {
+					redirectURL.Path = instancePathPrefix + target + strings.TrimPrefix(redirectURL.Path, prefix)
+				} else {
+					redirectURL.Host = strings.Replace(c.Request.Host, name+".", target+".", 1)
+				}
+				logrus.Debugf("Redirecting renamed instance %s to %s", name, target)
+				c.Redirect(http.StatusTemporaryRedirect, redirectURL.String())
+				return
+			}
+
 			if cfg.Autostart {
 				logrus.Debugf("Starting stopped container %s", name)
-				serr := instance.Start()
+				if instance.GetStatus().Version == 0 {
+					// reaching a missing instance creates it
+					if !getAccess(c).canOperate() {
+						forbidden(c)
+						return
+					}
+					instance.GetStatus().Owner = getPrincipal(c)
+				}
+				serr := instance.Start(SystemPrincipal)
+				RecordSystemAudit(cfg, "instance.autostart", name, serr)
 				if serr != nil {
 					internalError(c, serr)
 					return
@@ -155,25 +159,46 @@ func proxyHandler(cfg *model.Config) func(c *gin.Context) {
 			}
 		}
 
-		ip, err := instance.GetIP()
+		addr, err := instance.GetAddress()
 		if err != nil {
 			internalError(c, err)
 			return
 		}
 
-		c.Request.Host = ip + ":" + NodeRedPort
+		proxyHeaders(c, instance.GetStatus(), proxies)
 
-		c.Request.URL.Scheme = "http"
-		c.Request.URL.Host = c.Request.Host
+		if !cfg.PreserveHost {
+			c.Request.Host = addr
+		}
+		c.Request.URL.Scheme = scheme
+		c.Request.URL.Host = addr
+
+		if len(prefix) > 0 {
+			c.Request = withPathPrefix(c.Request, prefix, cfg.PathStrip)
+		}
 
 		if isWebsocket(c.Request) {
-			wsURL := c.Request.URL.Hostname() + ":" + c.Request.URL.Port()
-			logrus.Debugf("Serving WS %s", wsURL)
-			p := websocketProxy(wsURL)
-			p.ServeHTTP(c.Writer, c.Request)
+			proxyWebsocket(c, name, tlsConfig, cfg)
 			return
 		}
 
 		reverseProxy.ServeHTTP(c.Writer, c.Request)
 	}
 }
+
+// requestScheme return the scheme used by the client
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// isSafeMethod check if a proxied request method does not change the instance
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
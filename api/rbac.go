@@ -0,0 +1,801 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const grantCollection = "grants"
+const teamCollection = "teams"
+
+// accessKey is the context key storing the resolved access of the principal
+const accessKey = "access"
+
+// permission is required by a route to proceed
+type permission int
+
+const (
+	// permList allow any role, listings are filtered to reachable instances
+	permList permission = iota
+	// permRead require read access to the :name instance
+	permRead
+	// permWrite require write access to the :name instance
+	permWrite
+	// permInstance require read access for GET, write access otherwise
+	permInstance
+	// permOperate require the operator role, targets are filtered
+	permOperate
+	// permAdmin require the admin role
+	permAdmin
+)
+
+// access is the role and teams of a principal, restricted by the scopes
+// and instances of an API token. A nil access allows everything, as when
+// RBAC is disabled
+type access struct {
+	Principal string
+	Role      string
+	Teams     []string
+	Scopes    []string `json:",omitempty"`
+	Instances []string `json:",omitempty"`
+}
+
+func (a *access) hasRole(role string) bool {
+	return a == nil || model.RoleRank(a.Role) >= model.RoleRank(role)
+}
+
+// hasScope check the token scopes, admin implies all scopes and lifecycle
+// implies read
+func (a *access) hasScope(scope string) bool {
+	if a == nil || a.Scopes == nil {
+		return true
+	}
+	for _, granted := range a.Scopes {
+		if granted == scope || granted == model.ScopeAdmin ||
+			(granted == model.ScopeLifecycle && scope == model.ScopeRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsName check the token instance restrictions
+func (a *access) allowsName(name string) bool {
+	if a == nil || len(a.Instances) == 0 {
+		return true
+	}
+	for _, allowed := range a.Instances {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsToken check a token issued by a scoped caller, like a token, is
+// limited to the caller scopes and instances
+func (a *access) allowsToken(scopes, instances []string) bool {
+	if a == nil || a.Scopes == nil {
+		return true
+	}
+	for _, scope := range scopes {
+		if !a.hasScope(scope) {
+			return false
+		}
+	}
+	if len(a.Instances) == 0 {
+		return true
+	}
+	if len(instances) == 0 {
+		return false
+	}
+	for _, name := range instances {
+		if !a.allowsName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAdmin check for an unrestricted admin
+func (a *access) isAdmin() bool {
+	return a == nil || (a.hasRole(model.RoleAdmin) && a.hasScope(model.ScopeAdmin) && len(a.Instances) == 0)
+}
+
+// canList check if the principal can read resources
+func (a *access) canList() bool {
+	return a.hasRole(model.RoleViewer) && a.hasScope(model.ScopeRead)
+}
+
+// canOperate check if the principal can create and change instances
+func (a *access) canOperate() bool {
+	return a.hasRole(model.RoleOperator) && a.hasScope(model.ScopeLifecycle)
+}
+
+func (a *access) inTeam(team string) bool {
+	if a == nil {
+		return true
+	}
+	for _, name := range a.Teams {
+		if name == team {
+			return true
+		}
+	}
+	return false
+}
+
+// reaches check if the instance is allowed to the token and owned by the
+// principal or shared with one of its teams, admins reach all instances
+func (a *access) reaches(instance *model.Instance) bool {
+	if !a.allowsName(instance.Name) {
+		return false
+	}
+	if a.hasRole(model.RoleAdmin) || instance.Owner == a.Principal {
+		return true
+	}
+	return len(instance.Team) > 0 && a.inTeam(instance.Team)
+}
+
+// canRead check if the principal can see and reach the instance
+func (a *access) canRead(instance *model.Instance) bool {
+	if a.isAdmin() {
+		return true
+	}
+	return a.canList() && a.reaches(instance)
+}
+
+// canWrite check if the principal can change the instance
+func (a *access) canWrite(instance *model.Instance) bool {
+	if a.isAdmin() {
+		return true
+	}
+	return a.canOperate() && a.reaches(instance)
+}
+
+// visibleInstances filter the instances the principal can read
+func (a *access) visibleInstances(list []model.Instance) []model.Instance {
+	if a.isAdmin() {
+		return list
+	}
+	visible := make([]model.Instance, 0)
+	for idx := range list {
+		if a.canRead(&list[idx]) {
+			visible = append(visible, list[idx])
+		}
+	}
+	return visible
+}
+
+// validateSubject check a grant subject can be used as a record id
+func validateSubject(subject string) error {
+	if len(subject) == 0 || len(subject) > maxLabelLength ||
+		strings.HasPrefix(subject, ".") || strings.ContainsAny(subject, "/\\\x00") {
+		return errors.New("Invalid subject")
+	}
+	if strings.HasPrefix(subject, model.TeamPrefix) {
+		team, err := validateName(strings.TrimPrefix(subject, model.TeamPrefix))
+		if err != nil || len(team) == 0 {
+			return errors.New("Invalid team name")
+		}
+	}
+	return nil
+}
+
+// ListGrants return all stored grants
+func ListGrants(cfg *model.Config) ([]model.Grant, error) {
+
+	jsonlist, err := storage.GetStore(grantCollection, cfg).List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Grant, 0)
+	for _, jsonstr := range jsonlist {
+		item := model.Grant{}
+		err = json.Unmarshal([]byte(jsonstr), &item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+// ListTeams return all stored teams
+func ListTeams(cfg *model.Config) ([]model.Team, error) {
+
+	jsonlist, err := storage.GetStore(teamCollection, cfg).List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Team, 0)
+	for _, jsonstr := range jsonlist {
+		item := model.Team{}
+		err = json.Unmarshal([]byte(jsonstr), &item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+// resolveAccess compute the teams and role of a principal. Teams are the
+// provider groups and the stored teams listing the principal, the role is
+// the highest granted to the principal or its teams, else the default one
+func resolveAccess(principal string, groups []string, cfg *model.Config) (*access, error) {
+
+	a := &access{
+		Principal: principal,
+		Teams:     append([]string{}, groups...),
+	}
+
+	teams, err := ListTeams(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, team := range teams {
+		if a.inTeam(team.Name) {
+			continue
+		}
+		for _, member := range team.Members {
+			if member == principal {
+				a.Teams = append(a.Teams, team.Name)
+				break
+			}
+		}
+	}
+
+	for _, admin := range cfg.RBACAdmins {
+		if admin == principal {
+			a.Role = model.RoleAdmin
+			return a, nil
+		}
+	}
+
+	subjects := []string{principal}
+	for _, team := range a.Teams {
+		subjects = append(subjects, model.TeamPrefix+team)
+	}
+
+	store := storage.GetStore(grantCollection, cfg)
+	granted := false
+	for _, subject := range subjects {
+		if validateSubject(subject) != nil {
+			continue
+		}
+		grant := new(model.Grant)
+		err = store.Load(subject, grant)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !granted || model.RoleRank(grant.Role) > model.RoleRank(a.Role) {
+			a.Role = grant.Role
+		}
+		granted = true
+	}
+
+	if !granted {
+		a.Role = cfg.RBACDefaultRole
+	}
+
+	return a, nil
+}
+
+// requestAccess resolve the access of the request principal once, nil
+// when RBAC is disabled and no API token is used
+func requestAccess(c *gin.Context, cfg *model.Config) (*access, error) {
+
+	if a := getAccess(c); a != nil {
+		return a, nil
+	}
+
+	token := getToken(c)
+	actions := getActions(c)
+	if !cfg.RBAC && token == nil && actions == nil {
+		return nil, nil
+	}
+
+	a := &access{Principal: getPrincipal(c), Role: model.RoleAdmin}
+	if cfg.RBAC {
+		var err error
+		a, err = resolveAccess(getPrincipal(c), getGroups(c), cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if token != nil {
+		a.Scopes = token.Scopes
+		a.Instances = token.Instances
+	} else if actions != nil {
+		a.Scopes = actions
+	}
+	c.Set(accessKey, a)
+
+	return a, nil
+}
+
+// getAccess return the access resolved for the request, if any
+func getAccess(c *gin.Context) *access {
+	if value, ok := c.Get(accessKey); ok {
+		if a, ok := value.(*access); ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// allowInstance check access to an instance, a missing one can be created
+// by operators
+func allowInstance(a *access, instance *Instance, write bool) (bool, error) {
+
+	if a.isAdmin() {
+		return true, nil
+	}
+
+	exists, err := instance.Exists()
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		if !a.allowsName(instance.GetStatus().Name) {
+			return false, nil
+		}
+		if write {
+			return a.canOperate(), nil
+		}
+		return a.canList(), nil
+	}
+
+	if write {
+		return a.canWrite(instance.GetStatus()), nil
+	}
+	return a.canRead(instance.GetStatus()), nil
+}
+
+// authorizeInstance check access to an instance, sending a forbidden
+// response if denied
+func authorizeInstance(c *gin.Context, cfg *model.Config, instance *Instance, write bool) bool {
+
+	a, err := requestAccess(c, cfg)
+	if err != nil {
+		internalError(c, err)
+		c.Abort()
+		return false
+	}
+
+	allowed, err := allowInstance(a, instance, write)
+	if err != nil {
+		internalError(c, err)
+		c.Abort()
+		return false
+	}
+	if !allowed {
+		forbidden(c)
+		c.Abort()
+		return false
+	}
+
+	return true
+}
+
+// authorizeSettings refuse to non admins the settings reaching resources
+// shared among instances: stored secrets, volumes not named after the
+// instance and volumes used by other instances
+func authorizeSettings(c *gin.Context, cfg *model.Config, name string, refs []model.SecretRef, dataVolume string, mounts []model.Mount) bool {
+
+	a := getAccess(c)
+	if a.isAdmin() {
+		return true
+	}
+
+	if len(refs) > 0 {
+		errorResponse(c, http.StatusForbidden, "Only admins can reference stored secrets")
+		return false
+	}
+
+	volumes := []string{}
+	if len(dataVolume) > 0 {
+		volumes = append(volumes, dataVolume)
+	}
+	for _, mount := range mounts {
+		if mount.Type == model.MountVolume {
+			volumes = append(volumes, mount.Source)
+		}
+	}
+	if len(volumes) == 0 {
+		return true
+	}
+
+	for _, volume := range volumes {
+		if !ownVolume(name, volume) {
+			errorResponse(c, http.StatusForbidden, "Volume "+volume+" must be named after the instance, eg. "+name+volumeSeparator+"data")
+			return false
+		}
+	}
+
+	list, err := ListInstances(cfg)
+	if err != nil {
+		internalError(c, err)
+		return false
+	}
+	for _, volume := range volumes {
+		if owner := volumeUser(*list, volume); len(owner) > 0 && owner != name {
+			errorResponse(c, http.StatusForbidden, "Volume "+volume+" is used by another instance")
+			return false
+		}
+	}
+
+	return true
+}
+
+// volumeSeparator follow the instance name in its volume names, it is not
+// allowed in instance names so that a name is not the prefix of another
+const volumeSeparator = "."
+
+// ownVolume check the volume is named after the instance
+func ownVolume(name, volume string) bool {
+	return volume == name || strings.HasPrefix(volume, name+volumeSeparator)
+}
+
+// volumeUser return the instance using the volume, if any
+func volumeUser(list []model.Instance, volume string) string {
+	for _, item := range list {
+		if item.DataVolume == volume {
+			return item.Name
+		}
+		for _, mount := range item.Mounts {
+			if mount.Type == model.MountVolume && mount.Source == volume {
+				return item.Name
+			}
+		}
+	}
+	return ""
+}
+
+// authorizeLimits refuse to non admins the settings overriding the image and
+// the limits set by admins, as a negative DiskQuota lifts the quota
+func authorizeLimits(c *gin.Context, image string, resources *model.InstanceResources, diskQuota *int64) bool {
+
+	if getAccess(c).isAdmin() {
+		return true
+	}
+
+	if len(image) > 0 || resources != nil || diskQuota != nil {
+		errorResponse(c, http.StatusForbidden, "Only admins can set Image, Resources and DiskQuota")
+		return false
+	}
+
+	return true
+}
+
+// authorizeOwnership check changes to the instance owner, allowed to admins,
+// and team, allowed to the team members
+func authorizeOwnership(c *gin.Context, owner, team *string) bool {
+
+	a := getAccess(c)
+
+	if owner != nil && !a.isAdmin() {
+		errorResponse(c, http.StatusForbidden, "Only admins can change the owner")
+		return false
+	}
+
+	if team != nil && len(*team) > 0 {
+		name, err := validateName(*team)
+		if err != nil {
+			errorResponse(c, http.StatusBadRequest, "Invalid team name")
+			return false
+		}
+		if !a.isAdmin() && !a.inTeam(name) {
+			errorResponse(c, http.StatusForbidden, "Not a member of team "+name)
+			return false
+		}
+	}
+
+	return true
+}
+
+// authorize enforce a permission on a v2 route, when RBAC is enabled
+func authorize(cfg *model.Config, perm permission) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			return
+		}
+
+		a, err := requestAccess(c, cfg)
+		if err != nil {
+			internalError(c, err)
+			c.Abort()
+			return
+		}
+		if a == nil {
+			return
+		}
+
+		switch perm {
+		case permRead, permWrite, permInstance:
+			name, err := validateName(c.Param("name"))
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			write := perm == permWrite || (perm == permInstance && c.Request.Method != http.MethodGet)
+			authorizeInstance(c, cfg, GetInstance(name, cfg), write)
+			return
+		case permOperate:
+			if a.canOperate() {
+				return
+			}
+		case permAdmin:
+			if a.isAdmin() {
+				return
+			}
+		default:
+			if a.canList() {
+				return
+			}
+		}
+
+		forbidden(c)
+		c.Abort()
+	}
+}
+
+// grantRequest is the body to grant a role
+type grantRequest struct {
+	Role string
+}
+
+// teamRequest is the body to set the team members
+type teamRequest struct {
+	Members []string
+}
+
+func accessHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		a, err := requestAccess(c, cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if a == nil {
+			a = &access{Principal: getPrincipal(c), Role: model.RoleAdmin, Teams: getGroups(c)}
+		}
+
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+func grantsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		list, err := ListGrants(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+func grantHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		subject := c.Param("subject")
+		if validateSubject(subject) != nil {
+			errorResponse(c, http.StatusBadRequest, "Invalid subject")
+			return
+		}
+
+		store := storage.GetStore(grantCollection, cfg)
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			grant := new(model.Grant)
+			err := store.Load(subject, grant)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Header("ETag", formatETag(grant.Version))
+			c.JSON(http.StatusOK, grant)
+		case http.MethodPut:
+			setAuditAction(c, "grant.update")
+
+			req := grantRequest{}
+			err := c.BindJSON(&req)
+			if err != nil {
+				return
+			}
+			role := strings.ToLower(req.Role)
+			if model.RoleRank(role) == 0 {
+				errorResponse(c, http.StatusBadRequest, "Invalid role")
+				return
+			}
+
+			version, err := store.Version(subject)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if ifMatch := c.GetHeader("If-Match"); len(ifMatch) > 0 && !matchETag(ifMatch, version) {
+				c.Header("ETag", formatETag(version))
+				conflict(c)
+				return
+			}
+
+			grant := &model.Grant{
+				Subject:   subject,
+				Role:      role,
+				Updated:   time.Now(),
+				UpdatedBy: getPrincipal(c),
+			}
+			err = store.Update(subject, grant, version)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			c.Header("ETag", formatETag(grant.Version))
+			c.JSON(http.StatusOK, grant)
+		case http.MethodDelete:
+			setAuditAction(c, "grant.delete")
+
+			err := store.Delete(subject)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func teamsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		list, err := ListTeams(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+func teamHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("team"))
+		if err != nil || len(name) == 0 {
+			errorResponse(c, http.StatusBadRequest, "Invalid team name")
+			return
+		}
+
+		store := storage.GetStore(teamCollection, cfg)
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			team := new(model.Team)
+			err = store.Load(name, team)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Header("ETag", formatETag(team.Version))
+			c.JSON(http.StatusOK, team)
+		case http.MethodPut:
+			setAuditAction(c, "team.update")
+
+			req := teamRequest{}
+			err = c.BindJSON(&req)
+			if err != nil {
+				return
+			}
+			for _, member := range req.Members {
+				if len(member) == 0 || strings.HasPrefix(member, model.TeamPrefix) {
+					errorResponse(c, http.StatusBadRequest, "Invalid member "+member)
+					return
+				}
+			}
+
+			version, err := store.Version(name)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if ifMatch := c.GetHeader("If-Match"); len(ifMatch) > 0 && !matchETag(ifMatch, version) {
+				c.Header("ETag", formatETag(version))
+				conflict(c)
+				return
+			}
+
+			team := &model.Team{
+				Name:      name,
+				Members:   req.Members,
+				Updated:   time.Now(),
+				UpdatedBy: getPrincipal(c),
+			}
+			err = store.Update(name, team, version)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			c.Header("ETag", formatETag(team.Version))
+			c.JSON(http.StatusOK, team)
+		case http.MethodDelete:
+			setAuditAction(c, "team.delete")
+
+			err = store.Delete(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const redirectCollection = "redirects"
+
+// renameRequest is the body of a rename call
+type renameRequest struct {
+	Target string
+}
+
+// rollback undo completed steps of an operation in reverse order
+type rollback []func() error
+
+func (r *rollback) add(fn func() error) {
+	*r = append(*r, fn)
+}
+
+func (r rollback) run() {
+	for idx := len(r) - 1; idx >= 0; idx-- {
+		if err := r[idx](); err != nil {
+			logrus.Errorf("Rollback step failed: %s", err.Error())
+		}
+	}
+}
+
+// isEmptyDataDir check if a data directory is missing or holds only the log
+func isEmptyDataDir(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() != instanceLogFile {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//RenameInstance move an instance to a new name: the container is stopped,
+//data and record moved, the old name redirected to the new one and the
+//instance started again if it was running. Completed steps are rolled
+//back on failure
+func RenameInstance(name, target, actor string, cfg *model.Config) (*Instance, error) {
+
+	instance := GetInstance(name, cfg)
+	store := storage.GetStore(instanceCollection, cfg)
+
+	err := store.Load(target, new(model.Instance))
+	if err == nil {
+		return nil, ErrInstanceExists
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	srcDir := storage.GetInstancesDataPath(name, cfg)
+	dstDir := storage.GetInstancesDataPath(target, cfg)
+
+	empty, err := isEmptyDataDir(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, ErrInstanceExists
+	}
+
+	var undo rollback
+
+	running, err := instance.IsRunning()
+	if err != nil {
+		return nil, err
+	}
+	if running {
+		err = instance.Stop()
+		if err != nil {
+			return nil, err
+		}
+		instance.StopLogsPipe()
+		instance.Reset()
+		undo.add(func() error {
+			return GetInstance(name, cfg).Start(actor)
+		})
+	}
+
+	// move data, the logger holds a file in the directory
+	CloseInstanceLogger(name)
+	CloseInstanceLogger(target)
+	os.RemoveAll(dstDir)
+	err = os.Rename(srcDir, dstDir)
+	if err != nil {
+		undo.run()
+		return nil, err
+	}
+	undo.add(func() error {
+		CloseInstanceLogger(target)
+		dropCachedInstances(name, target)
+		return os.Rename(dstDir, srcDir)
+	})
+
+	// write the new record, then drop the old one
+	record := *instance.GetStatus()
+	oldRecord := record
+	record.Name = target
+	record.Node = ""
+	record.Version = 0
+	record.Touch(actor, "rename")
+
+	err = store.Update(target, &record, 0)
+	if err != nil {
+		undo.run()
+		return nil, err
+	}
+	undo.add(func() error {
+		return store.Delete(target)
+	})
+
+	err = store.Delete(name)
+	if err != nil {
+		undo.run()
+		return nil, err
+	}
+	undo.add(func() error {
+		return store.Save(name, &oldRecord)
+	})
+
+	err = saveRedirect(name, target, cfg)
+	if err != nil {
+		undo.run()
+		return nil, err
+	}
+	undo.add(func() error {
+		return storage.GetStore(redirectCollection, cfg).Delete(name)
+	})
+
+	err = moveDomains(record.Domains, target, cfg)
+	if err != nil {
+		undo.run()
+		return nil, err
+	}
+	undo.add(func() error {
+		return moveDomains(record.Domains, name, cfg)
+	})
+
+	// refresh the cache with both names
+	dropCachedInstances(name, target)
+
+	renamed := GetInstance(target, cfg)
+
+	if running {
+		err = renamed.Start(actor)
+		if err != nil {
+			logrus.Warnf("Failed to start renamed instance %s, rolling back: %s", target, err.Error())
+			renamed.Stop()
+			undo.run()
+			return nil, err
+		}
+	}
+
+	// usage is measured again under the new name
+	err = storage.GetStore(usageCollection, cfg).Delete(name)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to remove usage of %s: %s", name, err.Error())
+	}
+
+	logrus.Infof("Renamed instance %s to %s", name, target)
+	return renamed, nil
+}
+
+// dropCachedInstances remove instances from the cache, they are loaded
+// again on next use
+func dropCachedInstances(names ...string) {
+	instancesCacheMutex.Lock()
+	defer instancesCacheMutex.Unlock()
+	for _, name := range names {
+		delete(instancesCache, name)
+	}
+}
+
+func saveRedirect(name, target string, cfg *model.Config) error {
+
+	ttl := cfg.RenameRedirectTTL
+	if ttl <= 0 {
+		return nil
+	}
+
+	return storage.GetStore(redirectCollection, cfg).Save(name, &model.Redirect{
+		Name:    name,
+		Target:  target,
+		Expires: time.Now().Add(ttl),
+	})
+}
+
+// getRedirect return the new name of a renamed instance, if still redirected
+func getRedirect(name string, cfg *model.Config) (string, error) {
+
+	store := storage.GetStore(redirectCollection, cfg)
+
+	redirect := new(model.Redirect)
+	err := store.Load(name, redirect)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if time.Now().After(redirect.Expires) {
+		logrus.Debugf("Redirect from %s to %s expired", name, redirect.Target)
+		store.Delete(name)
+		return "", nil
+	}
+
+	return redirect.Target, nil
+}
+
+func renameHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setAuditAction(c, "instance.rename")
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		req := renameRequest{}
+		err = c.BindJSON(&req)
+		if err != nil {
+			return
+		}
+
+		target, err := validateName(req.Target)
+		if err != nil || len(target) == 0 || target == name {
+			errorResponse(c, http.StatusBadRequest, "Invalid target name")
+			return
+		}
+
+		instance := GetInstance(name, cfg)
+		if !instanceExists(c, instance) {
+			return
+		}
+
+		if !matchVersion(c, instance) {
+			return
+		}
+
+		renamed, err := RenameInstance(name, target, getPrincipal(c), cfg)
+		if err != nil {
+			if err == ErrInstanceExists {
+				errorResponse(c, http.StatusConflict, err.Error())
+				return
+			}
+			saveError(c, err)
+			return
+		}
+
+		setETag(c, renamed.GetStatus())
+		c.JSON(http.StatusOK, renamed.GetStatus().Redact())
+	}
+}
@@ -13,6 +13,7 @@ import (
 func (i *Instance) Reset() error {
 
 	i.instance.IP = ""
+	i.instance.Address = ""
 	i.instance.Status = model.InstanceStopped
 
 	return nil
@@ -27,7 +28,7 @@ func (i *Instance) GetIP() (string, error) {
 		return i.instance.IP, nil
 	}
 
-	net, err := docker.GetNetwork(i.cfg.Network)
+	net, err := docker.GetNetwork(i.instance.Node, i.cfg.Network)
 	if err != nil {
 		return ip, err
 	}
@@ -48,3 +49,29 @@ func (i *Instance) GetIP() (string, error) {
 
 	return ip, nil
 }
+
+//GetAddress return the host:port to reach the Node-RED instance, either on
+//the docker network or published by a remote node. The address is cached
+//until the instance is reset
+func (i *Instance) GetAddress() (string, error) {
+
+	if len(i.instance.Address) > 0 {
+		return i.instance.Address, nil
+	}
+
+	addr, err := docker.GetPublishedAddress(i.instance.Node, i.instance.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(addr) == 0 {
+		ip, err := i.GetIP()
+		if err != nil {
+			return "", err
+		}
+		addr = ip + ":" + NodeRedPort
+	}
+
+	i.instance.Address = addr
+
+	return addr, nil
+}
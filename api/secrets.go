@@ -0,0 +1,457 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/ansriaz/redzilla/docker"
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/secrets"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const secretCollection = "secrets"
+
+// secretFilesPath is where secret files are mounted in the container
+const secretFilesPath = "/run/secrets"
+
+var envNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+var secretFileRegexp = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9._-]*$")
+
+// encryptSecrets encrypt the secret values received by the API, empty
+// values are kept to remove keys on merge
+func encryptSecrets(values map[string]string, cfg *model.Config) (map[string]string, error) {
+
+	if len(values) == 0 {
+		return values, nil
+	}
+
+	c, err := secrets.GetCipher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make(map[string]string)
+	for key, value := range values {
+		if len(value) == 0 {
+			encrypted[key] = value
+			continue
+		}
+		encrypted[key], err = c.Encrypt(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encrypted, nil
+}
+
+// containerOptions resolve env, secrets and the path routing settings for
+// the instance container. Secret files are written to a directory mounted
+// read-only
+func (i *Instance) containerOptions() (*docker.ContainerOptions, error) {
+
+	opts := &docker.ContainerOptions{
+		Env:   make(map[string]string),
+		Binds: make([]string, 0),
+	}
+	for key, value := range i.instance.Env {
+		opts.Env[key] = value
+	}
+
+	if i.cfg.RoutingMode == model.RoutingPath && !i.cfg.PathStrip {
+		opts.Cmd = nodeRedRoots(i.instance.Name)
+	}
+
+	if len(i.instance.Secrets) == 0 && len(i.instance.SecretRefs) == 0 {
+		return opts, nil
+	}
+
+	c, err := secrets.GetCipher(i.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range i.instance.Secrets {
+		opts.Env[key], err = c.Decrypt(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := make(map[string]string)
+	for _, ref := range i.instance.SecretRefs {
+		secret, err := GetSecret(ref.Secret, i.cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load secret %s: %s", ref.Secret, err)
+		}
+		value, err := c.Decrypt(secret.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(ref.Env) > 0 {
+			opts.Env[ref.Env] = value
+		}
+		if len(ref.File) > 0 {
+			files[ref.File] = value
+		}
+	}
+
+	if len(files) > 0 {
+		dir, err := i.writeSecretFiles(files)
+		if err != nil {
+			return nil, err
+		}
+		opts.Binds = append(opts.Binds, dir+":"+secretFilesPath+":ro")
+	}
+
+	return opts, nil
+}
+
+// writeSecretFiles replace the secret files of the instance
+func (i *Instance) writeSecretFiles(files map[string]string) (string, error) {
+
+	dir := storage.GetSecretsPath(i.instance.Name, i.cfg)
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	for name, value := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0400)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// removeSecretFiles remove the plain secret files once the container is stopped
+func (i *Instance) removeSecretFiles() error {
+	return os.RemoveAll(storage.GetSecretsPath(i.instance.Name, i.cfg))
+}
+
+//Recreate stop the instance and start it from a new container, applying
+//changes to image, env and secrets
+func (i *Instance) Recreate(actor, action string) error {
+
+	err := i.Stop()
+	if err != nil {
+		return err
+	}
+
+	err = docker.RemoveContainer(i.instance.Node, i.instance.Name)
+	if err != nil {
+		return err
+	}
+
+	// wait for an in progress removal to complete
+	for tries := 0; tries < 10; tries++ {
+		info, err := docker.GetContainer(i.instance.Node, i.instance.Name)
+		if err != nil {
+			return err
+		}
+		if info.ContainerJSONBase == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return i.start(actor, action)
+}
+
+// validateSecretRefs check references name a secret and a valid env
+// variable or file name
+func validateSecretRefs(refs []model.SecretRef) error {
+	for _, ref := range refs {
+		if name, err := validateName(ref.Secret); err != nil || len(name) == 0 {
+			return errors.New("Invalid secret name " + ref.Secret)
+		}
+		if len(ref.Env) == 0 && len(ref.File) == 0 {
+			return errors.New("Env or File required for secret " + ref.Secret)
+		}
+		if len(ref.Env) > 0 && !envNameRegexp.MatchString(ref.Env) {
+			return errors.New("Invalid env name " + ref.Env)
+		}
+		if len(ref.File) > 0 && !secretFileRegexp.MatchString(ref.File) {
+			return errors.New("Invalid file name " + ref.File)
+		}
+	}
+	return nil
+}
+
+//ListSecrets list stored secrets
+func ListSecrets(cfg *model.Config) ([]model.Secret, error) {
+
+	jsonlist, err := storage.GetStore(secretCollection, cfg).List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Secret, 0)
+	for _, jsonstr := range jsonlist {
+		item := model.Secret{}
+		err = json.Unmarshal([]byte(jsonstr), &item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+//GetSecret load a secret by name, the value is encrypted
+func GetSecret(name string, cfg *model.Config) (*model.Secret, error) {
+	secret := new(model.Secret)
+	err := storage.GetStore(secretCollection, cfg).Load(name, secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// rotationResult count the records encrypted again with the current key
+type rotationResult struct {
+	KeyID     string
+	Secrets   int
+	Instances int
+}
+
+//RotateSecrets encrypt again with the current key all the values encrypted
+//with an old key, in the secret store and instance records
+func RotateSecrets(actor string, cfg *model.Config) (*rotationResult, error) {
+
+	c, err := secrets.GetCipher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rotationResult{KeyID: c.KeyID()}
+	store := storage.GetStore(secretCollection, cfg)
+
+	list, err := ListSecrets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range list {
+		secret := &list[idx]
+		if !c.NeedsRotation(secret.Value) {
+			continue
+		}
+		secret.Value, err = c.Rotate(secret.Value)
+		if err != nil {
+			return res, fmt.Errorf("Failed to rotate secret %s: %s", secret.Name, err)
+		}
+		secret.Updated = time.Now()
+		secret.UpdatedBy = actor
+		err = store.Update(secret.Name, secret, secret.Version)
+		if err != nil {
+			return res, fmt.Errorf("Failed to store secret %s: %s", secret.Name, err)
+		}
+		res.Secrets++
+	}
+
+	instances, err := ListInstances(cfg)
+	if err != nil {
+		return res, err
+	}
+	for _, item := range *instances {
+
+		rotate := false
+		for _, value := range item.Secrets {
+			if c.NeedsRotation(value) {
+				rotate = true
+				break
+			}
+		}
+		if !rotate {
+			continue
+		}
+
+		instance := GetInstance(item.Name, cfg)
+		err = instance.Reload()
+		if err != nil {
+			return res, err
+		}
+
+		record := instance.GetStatus()
+		for key, value := range record.Secrets {
+			record.Secrets[key], err = c.Rotate(value)
+			if err != nil {
+				return res, fmt.Errorf("Failed to rotate secrets of %s: %s", item.Name, err)
+			}
+		}
+
+		err = instance.Save(actor, "rotate")
+		if err != nil {
+			return res, fmt.Errorf("Failed to store instance %s: %s", item.Name, err)
+		}
+		res.Instances++
+	}
+
+	logrus.Infof("Rotated %d secrets and %d instances to key %s", res.Secrets, res.Instances, res.KeyID)
+	return res, nil
+}
+
+// secretRequest is the body to write a secret
+type secretRequest struct {
+	Value       string
+	Description string
+}
+
+func secretsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		list, err := ListSecrets(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		redacted := make([]*model.Secret, 0, len(list))
+		for idx := range list {
+			redacted = append(redacted, list[idx].Redact())
+		}
+
+		c.JSON(http.StatusOK, redacted)
+	}
+}
+
+func secretHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("secret"))
+		if err != nil || len(name) == 0 {
+			errorResponse(c, http.StatusBadRequest, "Invalid secret name")
+			return
+		}
+
+		store := storage.GetStore(secretCollection, cfg)
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			secret, err := GetSecret(name, cfg)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Header("ETag", formatETag(secret.Version))
+			c.JSON(http.StatusOK, secret.Redact())
+		case http.MethodPut:
+			setAuditAction(c, "secret.update")
+
+			req := secretRequest{}
+			err = c.BindJSON(&req)
+			if err != nil {
+				return
+			}
+			if len(req.Value) == 0 {
+				errorResponse(c, http.StatusBadRequest, "Value is required")
+				return
+			}
+
+			cipher, err := secrets.GetCipher(cfg)
+			if err != nil {
+				secretsError(c, err)
+				return
+			}
+
+			version, err := store.Version(name)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if ifMatch := c.GetHeader("If-Match"); len(ifMatch) > 0 && !matchETag(ifMatch, version) {
+				c.Header("ETag", formatETag(version))
+				conflict(c)
+				return
+			}
+
+			secret := &model.Secret{
+				Name:        name,
+				Description: req.Description,
+				Updated:     time.Now(),
+				UpdatedBy:   getPrincipal(c),
+			}
+			secret.Value, err = cipher.Encrypt(req.Value)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+
+			err = store.Update(name, secret, version)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			c.Header("ETag", formatETag(secret.Version))
+			c.JSON(http.StatusOK, secret.Redact())
+		case http.MethodDelete:
+			setAuditAction(c, "secret.delete")
+
+			err = store.Delete(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func rotateSecretsHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		setAuditAction(c, "secret.rotate")
+
+		res, err := RotateSecrets(getPrincipal(c), cfg)
+		if err != nil {
+			secretsError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
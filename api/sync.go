@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// SyncInstances periodically reload cached instances modified in the shared
+// store by other replicas
+func SyncInstances(cfg *model.Config) {
+
+	interval := cfg.CacheSyncInterval
+	if interval <= 0 {
+		interval = time.Second * 5
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			syncInstancesCache()
+		}
+	}()
+}
+
+func syncInstancesCache() {
+
+	instancesCacheMutex.Lock()
+	cached := make([]*Instance, 0, len(instancesCache))
+	for _, instance := range instancesCache {
+		cached = append(cached, instance)
+	}
+	instancesCacheMutex.Unlock()
+
+	for _, instance := range cached {
+
+		name := instance.GetStatus().Name
+
+		version, err := instance.StoredVersion()
+		if err != nil {
+			logrus.Warnf("Failed to check version of %s: %s", name, err.Error())
+			continue
+		}
+
+		if version == instance.GetStatus().Version {
+			continue
+		}
+
+		exists, err := instance.Exists()
+		if err != nil {
+			continue
+		}
+
+		if !exists {
+			logrus.Debugf("Instance %s removed, dropping from cache", name)
+			instancesCacheMutex.Lock()
+			delete(instancesCache, name)
+			instancesCacheMutex.Unlock()
+			continue
+		}
+
+		logrus.Debugf("Instance %s changed (version %d), reloading", name, version)
+		err = instance.Reload()
+		if err != nil {
+			logrus.Warnf("Failed to reload %s: %s", name, err.Error())
+			continue
+		}
+		// runtime informations may be stale, resolve them again on next use
+		instance.Reset()
+	}
+}
+
+// ResyncInstances resume tracking of running instances, used when this
+// replica becomes the leader
+func ResyncInstances(cfg *model.Config) {
+
+	store := storage.GetStore(instanceCollection, cfg)
+	jsonlist, err := store.List()
+	if err != nil {
+		logrus.Errorf("Failed to list instances: %s", err.Error())
+		return
+	}
+
+	for _, jsonstr := range jsonlist {
+
+		item := new(model.Instance)
+		err = json.Unmarshal([]byte(jsonstr), item)
+		if err != nil {
+			continue
+		}
+
+		instance := GetInstance(item.Name, cfg)
+		instance.Reset()
+
+		running, err := instance.IsRunning()
+		if err != nil || !running {
+			continue
+		}
+
+		err = instance.StartLogsPipe()
+		if err != nil {
+			logrus.Warnf("Cannot start logs pipe for %s: %s", item.Name, err.Error())
+		}
+	}
+}
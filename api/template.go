@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const templateCollection = "templates"
+
+//ListTemplates list available templates
+func ListTemplates(cfg *model.Config) ([]model.Template, error) {
+
+	jsonlist, err := storage.GetStore(templateCollection, cfg).List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Template, 0)
+	for _, jsonstr := range jsonlist {
+		item := model.Template{}
+		err = json.Unmarshal([]byte(jsonstr), &item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+//GetTemplate load a template by name
+func GetTemplate(name string, cfg *model.Config) (*model.Template, error) {
+	tpl := new(model.Template)
+	err := storage.GetStore(templateCollection, cfg).Load(name, tpl)
+	if err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// writeTemplateFile write a provisioning file unless the instance has one
+func writeTemplateFile(dir, filename string, content []byte) error {
+
+	if len(content) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(dir, filename)
+	exists, err := storage.PathExists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		logrus.Debugf("Keeping existing %s", path)
+		return nil
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+//ApplyTemplate provision the instance from a template: files are written
+//to the data directory if missing, env and resources used as defaults
+func (i *Instance) ApplyTemplate(tpl *model.Template) error {
+
+	datadir := storage.GetInstancesDataPath(i.instance.Name, i.cfg)
+
+	err := writeTemplateFile(datadir, "flows.json", tpl.Flows)
+	if err != nil {
+		return err
+	}
+	err = writeTemplateFile(datadir, "settings.js", []byte(tpl.Settings))
+	if err != nil {
+		return err
+	}
+	err = writeTemplateFile(datadir, "package.json", tpl.Package)
+	if err != nil {
+		return err
+	}
+
+	if len(tpl.Env) > 0 {
+		env := make(map[string]string)
+		for key, value := range tpl.Env {
+			env[key] = value
+		}
+		for key, value := range i.instance.Env {
+			env[key] = value
+		}
+		i.instance.Env = env
+	}
+
+	if len(i.instance.Image) == 0 {
+		i.instance.Image = tpl.Image
+	}
+	if i.instance.Resources.Memory == 0 {
+		i.instance.Resources.Memory = tpl.Resources.Memory
+	}
+	if i.instance.Resources.CPUs == 0 {
+		i.instance.Resources.CPUs = tpl.Resources.CPUs
+	}
+
+	i.instance.Template = tpl.Name
+	i.instance.InstallPending = len(tpl.Package) > 0
+
+	return nil
+}
+
+func templatesHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		list, err := ListTemplates(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+func templateHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("template"))
+		if err != nil || len(name) == 0 {
+			errorResponse(c, http.StatusBadRequest, "Invalid template name")
+			return
+		}
+
+		store := storage.GetStore(templateCollection, cfg)
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			tpl, err := GetTemplate(name, cfg)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Header("ETag", formatETag(tpl.Version))
+			c.JSON(http.StatusOK, tpl)
+		case http.MethodPut:
+			setAuditAction(c, "template.update")
+
+			tpl := new(model.Template)
+			err = c.BindJSON(tpl)
+			if err != nil {
+				return
+			}
+
+			if len(tpl.Package) > 0 && !json.Valid(tpl.Package) {
+				errorResponse(c, http.StatusBadRequest, "Invalid package.json")
+				return
+			}
+
+			version, err := store.Version(name)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if ifMatch := c.GetHeader("If-Match"); len(ifMatch) > 0 && !matchETag(ifMatch, version) {
+				c.Header("ETag", formatETag(version))
+				conflict(c)
+				return
+			}
+
+			tpl.Name = name
+			tpl.Updated = time.Now()
+			tpl.UpdatedBy = getPrincipal(c)
+
+			err = store.Update(name, tpl, version)
+			if err != nil {
+				saveError(c, err)
+				return
+			}
+
+			c.Header("ETag", formatETag(tpl.Version))
+			c.JSON(http.StatusOK, tpl)
+		case http.MethodDelete:
+			setAuditAction(c, "template.delete")
+
+			err = store.Delete(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					notFound(c)
+					return
+				}
+				internalError(c, err)
+				return
+			}
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
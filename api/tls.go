@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ansriaz/redzilla/certs"
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// hostPolicy allow certificates for existing instances, names still
+// redirected after a rename and verified custom domains
+func hostPolicy(cfg *model.Config) func(host string) error {
+	return func(host string) error {
+
+		if isCustomDomain(host, cfg) {
+			if len(lookupDomain(host, cfg)) == 0 {
+				return certs.ErrHostNotAllowed
+			}
+			return nil
+		}
+		if !isSubdomain(host, cfg.Domain) {
+			return certs.ErrHostNotAllowed
+		}
+
+		name := strings.TrimSuffix(host, "."+cfg.Domain)
+		if _, err := validateName(name); err != nil || len(name) == 0 {
+			return certs.ErrHostNotAllowed
+		}
+
+		err := storage.GetStore(instanceCollection, cfg).Load(name, model.NewInstance(name))
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		target, err := getRedirect(name, cfg)
+		if err != nil {
+			return err
+		}
+		if len(target) == 0 {
+			return certs.ErrHostNotAllowed
+		}
+
+		return nil
+	}
+}
+
+// hstsHandler ask browsers to use HTTPS only for the domain and instances
+func hstsHandler(cfg *model.Config) func(c *gin.Context) {
+	value := fmt.Sprintf("max-age=%d; includeSubDomains", int64(cfg.HSTSMaxAge.Seconds()))
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil {
+			c.Header("Strict-Transport-Security", value)
+		}
+		c.Next()
+	}
+}
+
+// serveTLS serve the router over HTTPS, the plain HTTP listener answers
+// ACME challenges and redirects to HTTPS unless TLSRedirect is disabled
+func serveTLS(router http.Handler, cfg *model.Config) error {
+
+	manager, err := certs.GetManager(cfg)
+	if err != nil {
+		return err
+	}
+	manager.HostPolicy = hostPolicy(cfg)
+
+	var fallback http.Handler = router
+	if cfg.TLSRedirect {
+		fallback = certs.RedirectHandler(cfg.TLSPort)
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		logrus.Infof("Starting HTTP at %s", cfg.APIPort)
+		errs <- http.ListenAndServe(cfg.APIPort, manager.HTTPHandler(fallback))
+	}()
+
+	go func() {
+		server := &http.Server{
+			Addr:      cfg.TLSPort,
+			Handler:   router,
+			TLSConfig: manager.TLSConfig(),
+		}
+		logrus.Infof("Starting HTTPS at %s", cfg.TLSPort)
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+
+	return <-errs
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const tokenCollection = "tokens"
+
+// apiTokenPrefix marks tokens issued by redzilla, as rzt_<id>_<secret>
+const apiTokenPrefix = "rzt_"
+
+// tokenKey is the context key storing the API token of the request
+const tokenKey = "token"
+
+var tokenIDRegexp = regexp.MustCompile("^[0-9a-f]{16}$")
+
+//ErrInvalidToken is returned for unknown, malformed or expired tokens
+var ErrInvalidToken = errors.New("Invalid token")
+
+// hashToken return the stored hash of a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken generate a token id and value
+func newToken() (string, string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", "", err
+	}
+	id := hex.EncodeToString(raw[:8])
+	return id, apiTokenPrefix + id + "_" + hex.EncodeToString(raw[8:]), nil
+}
+
+// validateScopes check scopes are known and not empty
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("Scopes are required")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case model.ScopeRead, model.ScopeLifecycle, model.ScopeAdmin:
+		default:
+			return errors.New("Invalid scope " + scope)
+		}
+	}
+	return nil
+}
+
+//VerifyToken return the stored token matching value, if valid
+func VerifyToken(value string, cfg *model.Config) (*model.Token, error) {
+
+	parts := strings.Split(strings.TrimPrefix(value, apiTokenPrefix), "_")
+	if !strings.HasPrefix(value, apiTokenPrefix) || len(parts) != 2 || !tokenIDRegexp.MatchString(parts[0]) {
+		return nil, ErrInvalidToken
+	}
+
+	token := new(model.Token)
+	err := storage.GetStore(tokenCollection, cfg).Load(parts[0], token)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(value)), []byte(token.Hash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if token.Expired() {
+		return nil, ErrInvalidToken
+	}
+
+	return token, nil
+}
+
+//ListTokens return all stored tokens, sorted by creation
+func ListTokens(cfg *model.Config) ([]model.Token, error) {
+
+	jsonlist, err := storage.GetStore(tokenCollection, cfg).List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Token, 0)
+	for _, jsonstr := range jsonlist {
+		item := model.Token{}
+		err = json.Unmarshal([]byte(jsonstr), &item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *item.Redact())
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Created.Before(list[b].Created)
+	})
+
+	return list, nil
+}
+
+// tokenAuthenticate accept a redzilla API token as bearer token
+func tokenAuthenticate(c *gin.Context, cfg *model.Config) bool {
+
+	value := bearerToken(c.Request)
+	if !strings.HasPrefix(value, apiTokenPrefix) {
+		return false
+	}
+
+	token, err := VerifyToken(value, cfg)
+	if err != nil {
+		if err != ErrInvalidToken {
+			logrus.Errorf("Failed to verify token: %s", err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return true
+		}
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return true
+	}
+
+	c.Set(principalKey, token.Principal)
+	c.Set(tokenKey, token)
+	if isProxied(c.Request, cfg) {
+		c.Request.Header.Del("Authorization")
+	}
+	return true
+}
+
+// getToken return the API token of the request, if any
+func getToken(c *gin.Context) *model.Token {
+	if value, ok := c.Get(tokenKey); ok {
+		if token, ok := value.(*model.Token); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// manageTokens refuse token management to API tokens without the admin
+// scope, so a leaked token cannot issue others
+func manageTokens(c *gin.Context) bool {
+	if token := getToken(c); token != nil && !getAccess(c).hasScope(model.ScopeAdmin) {
+		forbidden(c)
+		return false
+	}
+	return true
+}
+
+// tokenExpiry cap expires to the expiry of the token used to issue it, so
+// a token cannot outlive its parent
+func tokenExpiry(parent *model.Token, expires time.Time) (time.Time, error) {
+	if parent == nil || parent.Expires.IsZero() {
+		return expires, nil
+	}
+	if expires.IsZero() {
+		return expires, errors.New("Expires or TTL is required, the caller token expires")
+	}
+	if expires.After(parent.Expires) {
+		return parent.Expires, nil
+	}
+	return expires, nil
+}
+
+// tokenRequest is the body to create a token
+type tokenRequest struct {
+	Name      string
+	Scopes    []string
+	Instances []string
+	// Expires is optional, TTL like 720h is relative to now
+	Expires time.Time
+	TTL     string
+	// Principal is set by admins to issue tokens for service accounts
+	Principal string
+}
+
+// tokenResponse return the token value, shown only on creation
+type tokenResponse struct {
+	*model.Token
+	Value string
+}
+
+func tokensHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		if !manageTokens(c) {
+			return
+		}
+
+		a := getAccess(c)
+		principal := getPrincipal(c)
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			list, err := ListTokens(cfg)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			owned := make([]model.Token, 0)
+			for _, item := range list {
+				if a.isAdmin() || item.Principal == principal {
+					owned = append(owned, item)
+				}
+			}
+			c.JSON(http.StatusOK, owned)
+		case http.MethodPost:
+			setAuditAction(c, "token.create")
+
+			req := tokenRequest{}
+			err := c.BindJSON(&req)
+			if err != nil {
+				return
+			}
+
+			req.Scopes = lowerAll(req.Scopes)
+			err = validateScopes(req.Scopes)
+			if err != nil {
+				errorResponse(c, http.StatusBadRequest, err.Error())
+				return
+			}
+			for _, name := range req.Instances {
+				if _, err := validateName(name); err != nil || len(name) == 0 {
+					errorResponse(c, http.StatusBadRequest, "Invalid instance name "+name)
+					return
+				}
+			}
+			if !a.allowsToken(req.Scopes, req.Instances) {
+				errorResponse(c, http.StatusForbidden, "Token scopes and instances must be within the caller ones")
+				return
+			}
+			if len(req.TTL) > 0 {
+				ttl, err := time.ParseDuration(req.TTL)
+				if err != nil || ttl <= 0 {
+					errorResponse(c, http.StatusBadRequest, "Invalid TTL")
+					return
+				}
+				req.Expires = time.Now().Add(ttl)
+			}
+			if !req.Expires.IsZero() && req.Expires.Before(time.Now()) {
+				errorResponse(c, http.StatusBadRequest, "Expires is in the past")
+				return
+			}
+			req.Expires, err = tokenExpiry(getToken(c), req.Expires)
+			if err != nil {
+				errorResponse(c, http.StatusBadRequest, err.Error())
+				return
+			}
+			if len(req.Principal) > 0 && req.Principal != principal {
+				if !a.isAdmin() {
+					errorResponse(c, http.StatusForbidden, "Only admins can issue tokens for other principals")
+					return
+				}
+				principal = req.Principal
+			}
+
+			id, value, err := newToken()
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+
+			token := &model.Token{
+				ID:        id,
+				Name:      req.Name,
+				Principal: principal,
+				Scopes:    req.Scopes,
+				Instances: req.Instances,
+				Expires:   req.Expires,
+				Hash:      hashToken(value),
+				Created:   time.Now(),
+				CreatedBy: getPrincipal(c),
+			}
+			err = storage.GetStore(tokenCollection, cfg).Save(id, token)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+
+			logrus.Infof("Token %s issued to %s by %s", id, principal, token.CreatedBy)
+			c.JSON(http.StatusCreated, tokenResponse{Token: token.Redact(), Value: value})
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+func tokenHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		if !manageTokens(c) {
+			return
+		}
+
+		id := c.Param("token")
+		if !tokenIDRegexp.MatchString(id) {
+			notFound(c)
+			return
+		}
+
+		store := storage.GetStore(tokenCollection, cfg)
+		token := new(model.Token)
+		err := store.Load(id, token)
+		if err != nil {
+			if os.IsNotExist(err) {
+				notFound(c)
+				return
+			}
+			internalError(c, err)
+			return
+		}
+		if !getAccess(c).isAdmin() && token.Principal != getPrincipal(c) {
+			notFound(c)
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet:
+			c.JSON(http.StatusOK, token.Redact())
+		case http.MethodDelete:
+			setAuditAction(c, "token.revoke")
+
+			err = store.Delete(id)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			logrus.Infof("Token %s of %s revoked", id, token.Principal)
+			c.Status(http.StatusAccepted)
+		default:
+			badRequest(c)
+		}
+	}
+}
+
+// lowerAll return the values in lower case
+func lowerAll(values []string) []string {
+	lower := make([]string, 0, len(values))
+	for _, value := range values {
+		lower = append(lower, strings.ToLower(value))
+	}
+	return lower
+}
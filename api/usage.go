@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const usageCollection = "usage"
+
+//ErrQuotaExceeded is returned when starting an instance over its disk quota
+var ErrQuotaExceeded = errors.New("Disk quota exceeded")
+
+// dirSize sum the size of regular files in dir, skipping the log file
+func dirSize(dir string) (int64, error) {
+
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files may be removed by the instance while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == filepath.Join(dir, instanceLogFile) {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	return size, err
+}
+
+// quota return the disk quota applied to the instance, zero is unlimited
+func (i *Instance) quota() int64 {
+	if i.instance.DiskQuota < 0 {
+		return 0
+	}
+	if i.instance.DiskQuota > 0 {
+		return i.instance.DiskQuota
+	}
+	return i.cfg.DiskQuota
+}
+
+//ComputeUsage measure and store the disk space used by the instance. Data
+//on a docker volume is not measured
+func (i *Instance) ComputeUsage() (*model.Usage, error) {
+
+	datadir := storage.GetInstancesDataPath(i.instance.Name, i.cfg)
+
+	usage := &model.Usage{
+		Instance: i.instance.Name,
+		Quota:    i.quota(),
+		Updated:  time.Now(),
+	}
+
+	var err error
+	usage.Data, err = dirSize(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filepath.Join(datadir, instanceLogFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		usage.Log = info.Size()
+	}
+
+	usage.Exceeded = usage.Quota > 0 && usage.Total() > usage.Quota
+
+	err = storage.GetStore(usageCollection, i.cfg).Save(i.instance.Name, usage)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+//GetUsage return the last measured usage of an instance, nil if unknown
+func GetUsage(name string, cfg *model.Config) (*model.Usage, error) {
+	usage := new(model.Usage)
+	err := storage.GetStore(usageCollection, cfg).Load(name, usage)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return usage, nil
+}
+
+// ListUsage return the last measured usage of all instances
+func ListUsage(cfg *model.Config) ([]model.Usage, error) {
+
+	jsonlist, err := storage.GetStore(usageCollection, cfg).List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]model.Usage, 0)
+	for _, jsonstr := range jsonlist {
+		item := model.Usage{}
+		err = json.Unmarshal([]byte(jsonstr), &item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+// checkQuota refuse to start an instance over quota, unless the action
+// is only to warn
+func (i *Instance) checkQuota() error {
+
+	if i.quota() == 0 || i.cfg.DiskQuotaAction == model.QuotaWarn {
+		return nil
+	}
+
+	usage, err := i.ComputeUsage()
+	if err != nil {
+		return err
+	}
+	if usage.Exceeded {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// enforceQuota apply the quota action to an instance over quota
+func (i *Instance) enforceQuota(usage *model.Usage, previous *model.Usage) {
+
+	name := i.instance.Name
+	notified := previous != nil && previous.Exceeded
+
+	if !notified {
+		logrus.Warnf("Instance %s uses %d bytes over quota of %d", name, usage.Total(), usage.Quota)
+		RecordSystemAudit(i.cfg, "instance.quota.exceeded", name,
+			fmt.Errorf("Using %d bytes of %d", usage.Total(), usage.Quota))
+	}
+
+	if i.cfg.DiskQuotaAction != model.QuotaStop {
+		return
+	}
+
+	running, err := i.IsRunning()
+	if err != nil {
+		logrus.Warnf("Failed to check status of %s: %s", name, err.Error())
+		return
+	}
+	if !running {
+		return
+	}
+
+	err = i.Stop()
+	RecordSystemAudit(i.cfg, "instance.quota.stop", name, err)
+	if err != nil {
+		logrus.Warnf("Failed to stop %s over quota: %s", name, err.Error())
+	}
+}
+
+//CheckUsage measure all instances and enforce the disk quota
+func CheckUsage(cfg *model.Config) {
+
+	list, err := ListInstances(cfg)
+	if err != nil {
+		logrus.Errorf("Failed to list instances for usage: %s", err.Error())
+		return
+	}
+
+	for _, item := range *list {
+		instance := GetInstance(item.Name, cfg)
+
+		previous, err := GetUsage(item.Name, cfg)
+		if err != nil {
+			logrus.Warnf("Failed to load usage of %s: %s", item.Name, err.Error())
+		}
+
+		usage, err := instance.ComputeUsage()
+		if err != nil {
+			logrus.Warnf("Failed to compute usage of %s: %s", item.Name, err.Error())
+			continue
+		}
+
+		if usage.Exceeded {
+			instance.enforceQuota(usage, previous)
+		}
+	}
+}
+
+// withUsage return the instance for API responses with its last usage and
+// its websockets
+func withUsage(instance *Instance) *model.Instance {
+	res := instance.GetStatus().Redact()
+	usage, err := GetUsage(res.Name, instance.cfg)
+	if err != nil {
+		logrus.Warnf("Failed to load usage of %s: %s", res.Name, err.Error())
+	}
+	res.Usage = usage
+	res.Connections = ActiveConnections(res.Name)
+	return res
+}
+
+func usageHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		list, err := ListUsage(cfg)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if a := getAccess(c); !a.isAdmin() {
+			instances, err := ListInstances(cfg)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			visible := make(map[string]bool)
+			for _, item := range a.visibleInstances(*instances) {
+				visible[item.Name] = true
+			}
+			filtered := make([]model.Usage, 0)
+			for _, item := range list {
+				if visible[item.Instance] {
+					filtered = append(filtered, item)
+				}
+			}
+			list = filtered
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+func instanceUsageHandler(cfg *model.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		if !isRootDomain(c.Request.Host, cfg.Domain) {
+			c.Next()
+			return
+		}
+
+		name, err := validateName(c.Param("name"))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		instance := GetInstance(name, cfg)
+		if !instanceExists(c, instance) {
+			return
+		}
+
+		var usage *model.Usage
+		if c.Query("refresh") == "true" {
+			usage, err = instance.ComputeUsage()
+		} else {
+			usage, err = GetUsage(name, cfg)
+		}
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if usage == nil {
+			notFound(c)
+			return
+		}
+
+		c.JSON(http.StatusOK, usage)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/ansriaz/redzilla/model"
@@ -37,6 +38,33 @@ func badRequest(c *gin.Context) {
 	errorResponse(c, code, http.StatusText(code))
 }
 
+func conflict(c *gin.Context) {
+	code := http.StatusConflict
+	errorResponse(c, code, http.StatusText(code))
+}
+
+// formatETag return a strong ETag for a record version
+func formatETag(version int64) string {
+	return "\"" + strconv.FormatInt(version, 10) + "\""
+}
+
+// setETag add the ETag header for an instance record
+func setETag(c *gin.Context, instance *model.Instance) {
+	c.Header("ETag", formatETag(instance.Version))
+}
+
+// matchETag check if an If-Match header value matches a version
+func matchETag(ifMatch string, version int64) bool {
+	etag := formatETag(version)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func extractSubdomain(host string, cfg *model.Config) string {
 	if len(host) == 0 {
 		return ""
@@ -51,11 +79,19 @@ func extractSubdomain(host string, cfg *model.Config) string {
 	return name
 }
 
+// extractInstanceName return the instance of a /instance/<name>/ path
 func extractInstanceName(path string, cfg *model.Config) string {
-	if len(path) == 0 {
+	if !strings.HasPrefix(path, instancePathPrefix) {
 		return ""
 	}
-	strFind := "/instance/"
-	hostname := path[strings.Index(path, strFind)+len(strFind):]
-	return hostname
+	name := strings.TrimPrefix(path, instancePathPrefix)
+	if idx := strings.Index(name, "/"); idx > -1 {
+		name = name[:idx]
+	}
+	return name
+}
+
+func forbidden(c *gin.Context) {
+	code := http.StatusForbidden
+	errorResponse(c, code, http.StatusText(code))
 }
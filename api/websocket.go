@@ -0,0 +1,378 @@
+package api
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// backendDialTimeout bound the time to connect to an instance
+const backendDialTimeout = 10 * time.Second
+
+// handshakeTimeout bound the time for the instance to accept an upgrade
+const handshakeTimeout = 10 * time.Second
+
+// closeGoingAway is a websocket close frame with status 1001, sent to
+// clients when redzilla ends the connection
+var closeGoingAway = []byte{0x88, 0x02, 0x03, 0xe9}
+
+var errIdle = errors.New("Websocket idle")
+
+// wsConn is a websocket relayed to an instance
+type wsConn struct {
+	instance string
+	client   net.Conn
+	backend  net.Conn
+	idle     time.Duration
+	// activity is the unix nano time of the last relayed bytes
+	activity int64
+	// expired is set when redzilla ends the connection
+	expired int32
+	// done is set once a direction ended, the other one stops on its
+	// next read instead of waiting for the idle timeout
+	done int32
+}
+
+// wsTracker holds the relayed connections by instance
+type wsTracker struct {
+	mutex sync.Mutex
+	conns map[string]map[*wsConn]bool
+	stats map[string]*model.Connections
+}
+
+var wsConnections = &wsTracker{
+	conns: make(map[string]map[*wsConn]bool),
+	stats: make(map[string]*model.Connections),
+}
+
+func (t *wsTracker) add(conn *wsConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.conns[conn.instance]; !ok {
+		t.conns[conn.instance] = make(map[*wsConn]bool)
+	}
+	t.conns[conn.instance][conn] = true
+
+	stats, ok := t.stats[conn.instance]
+	if !ok {
+		stats = new(model.Connections)
+		t.stats[conn.instance] = stats
+	}
+	stats.Active++
+	stats.Total++
+	stats.LastActivity = time.Now()
+}
+
+func (t *wsTracker) remove(conn *wsConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.conns[conn.instance], conn)
+	if len(t.conns[conn.instance]) == 0 {
+		delete(t.conns, conn.instance)
+	}
+
+	if stats, ok := t.stats[conn.instance]; ok {
+		stats.Active--
+		if last := conn.lastActivity(); last.After(stats.LastActivity) {
+			stats.LastActivity = last
+		}
+	}
+}
+
+// get return a copy of the instance connections counters
+func (t *wsTracker) get(instance string) *model.Connections {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats, ok := t.stats[instance]
+	if !ok {
+		return nil
+	}
+
+	res := *stats
+	for conn := range t.conns[instance] {
+		if last := conn.lastActivity(); last.After(res.LastActivity) {
+			res.LastActivity = last
+		}
+	}
+	return &res
+}
+
+// close end the connections of an instance
+func (t *wsTracker) close(instance string) {
+	t.mutex.Lock()
+	conns := make([]*wsConn, 0, len(t.conns[instance]))
+	for conn := range t.conns[instance] {
+		conns = append(conns, conn)
+	}
+	t.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.expire()
+	}
+	if len(conns) > 0 {
+		logrus.Debugf("Closed %d websockets of %s", len(conns), instance)
+	}
+}
+
+//ActiveConnections return the websockets relayed to an instance by this
+//replica
+func ActiveConnections(instance string) *model.Connections {
+	return wsConnections.get(instance)
+}
+
+// closeConnections end the websockets of a stopped instance
+func closeConnections(instance string) {
+	wsConnections.close(instance)
+}
+
+func (w *wsConn) touch() {
+	atomic.StoreInt64(&w.activity, time.Now().UnixNano())
+}
+
+func (w *wsConn) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&w.activity))
+}
+
+// expire end the connection, the client gets a going away close frame
+func (w *wsConn) expire() {
+	atomic.StoreInt32(&w.expired, 1)
+	w.backend.Close()
+}
+
+// pipe copy bytes from src to dst until either fails or the connection
+// stays idle
+func (w *wsConn) pipe(dst, src net.Conn, errc chan<- error) {
+	buf := make([]byte, 32*1024)
+	for {
+		if w.idle > 0 {
+			src.SetReadDeadline(time.Now().Add(w.idle))
+		}
+		// checked after the deadline, which could override the one
+		// unblocking the read
+		if atomic.LoadInt32(&w.done) == 1 {
+			errc <- io.EOF
+			return
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			w.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				errc <- werr
+				return
+			}
+		}
+		if err != nil {
+			if atomic.LoadInt32(&w.done) == 1 {
+				errc <- err
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && atomic.LoadInt32(&w.expired) == 0 {
+				// the other direction may be active
+				if time.Since(w.lastActivity()) < w.idle {
+					continue
+				}
+				atomic.StoreInt32(&w.expired, 1)
+				err = errIdle
+			}
+			errc <- err
+			return
+		}
+	}
+}
+
+// relay copy both directions until one ends, then close both
+func (w *wsConn) relay(maxLifetime time.Duration) {
+
+	if maxLifetime > 0 {
+		timer := time.AfterFunc(maxLifetime, w.expire)
+		defer timer.Stop()
+	}
+
+	errc := make(chan error, 2)
+	go w.pipe(w.backend, w.client, errc)
+	go w.pipe(w.client, w.backend, errc)
+
+	err := <-errc
+	if err != nil && err != io.EOF {
+		logrus.Debugf("Websocket of %s ended: %s", w.instance, err.Error())
+	}
+
+	// unblock the other direction
+	atomic.StoreInt32(&w.done, 1)
+	w.backend.Close()
+	w.client.SetReadDeadline(time.Now())
+	<-errc
+
+	if atomic.LoadInt32(&w.expired) == 1 {
+		w.client.SetWriteDeadline(time.Now().Add(time.Second))
+		w.client.Write(closeGoingAway)
+	}
+	w.client.Close()
+}
+
+// newBackendTLSConfig return the TLS configuration to reach instances, nil
+// when instances serve plain HTTP
+func newBackendTLSConfig(cfg *model.Config) (*tls.Config, error) {
+
+	if !cfg.BackendTLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.BackendInsecure}
+	if len(cfg.BackendCAFile) > 0 {
+		raw, err := ioutil.ReadFile(cfg.BackendCAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.BackendCAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	return tlsConfig, nil
+}
+
+// dialBackend connect to an instance
+func dialBackend(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: backendDialTimeout, KeepAlive: 30 * time.Second}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// headerHasToken check if a comma separated header lists the token
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebsocket(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+// proxyWebsocket forward the upgrade to the instance and relay the
+// connection once accepted. Refused upgrades are passed to the client
+func proxyWebsocket(c *gin.Context, name string, tlsConfig *tls.Config, cfg *model.Config) {
+
+	req := c.Request
+
+	backend, err := dialBackend(req.URL.Host, tlsConfig)
+	if err != nil {
+		logrus.Warnf("Error dialing websocket backend %s: %s", req.URL.Host, err.Error())
+		errorResponse(c, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+		return
+	}
+
+	backend.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	appendForwardedFor(req)
+	err = req.Write(backend)
+	if err != nil {
+		backend.Close()
+		logrus.Warnf("Error forwarding websocket upgrade to %s: %s", name, err.Error())
+		errorResponse(c, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+		return
+	}
+
+	backendBuf := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(backendBuf, req)
+	if err != nil {
+		backend.Close()
+		logrus.Warnf("Error reading websocket upgrade of %s: %s", name, err.Error())
+		errorResponse(c, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+		return
+	}
+	rewriteResponse(resp)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer backend.Close()
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	hj, ok := c.Writer.(http.Hijacker)
+	if !ok {
+		backend.Close()
+		internalError(c, errors.New("Websocket upgrade not supported"))
+		return
+	}
+	client, clientBuf, err := hj.Hijack()
+	if err != nil {
+		backend.Close()
+		logrus.Warnf("Hijack error: %s", err.Error())
+		return
+	}
+
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+
+	// frames sent by the instance along with the handshake
+	if n := backendBuf.Buffered(); n > 0 {
+		buffered, _ := backendBuf.Peek(n)
+		clientBuf.Write(buffered)
+	}
+	err = clientBuf.Flush()
+	if err == nil {
+		// frames sent by the client before the handshake completed
+		if n := clientBuf.Reader.Buffered(); n > 0 {
+			buffered, _ := clientBuf.Reader.Peek(n)
+			_, err = backend.Write(buffered)
+		}
+	}
+	if err != nil {
+		client.Close()
+		backend.Close()
+		return
+	}
+
+	backend.SetDeadline(time.Time{})
+	client.SetDeadline(time.Time{})
+
+	conn := &wsConn{
+		instance: name,
+		client:   client,
+		backend:  backend,
+		idle:     cfg.WebsocketIdle,
+	}
+	conn.touch()
+
+	wsConnections.add(conn)
+	defer wsConnections.remove(conn)
+
+	logrus.Debugf("Relaying websocket of %s", name)
+	conn.relay(cfg.WebsocketLifetime)
+}
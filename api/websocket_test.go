@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/gin-gonic/gin"
+)
+
+// echoUpgrade accept the upgrade, greet and echo the client
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !isWebsocket(r) {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nhello")
+	buf.Flush()
+	io.Copy(conn, buf)
+}
+
+func TestWebsocketProxy(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer backend.Close()
+
+	var total int64
+	if stats := ActiveConnections("tenant"); stats != nil {
+		total = stats.Total
+	}
+
+	cfg := &model.Config{WebsocketIdle: time.Minute}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request.URL.Host = strings.TrimPrefix(backend.URL, "http://")
+		proxyWebsocket(c, "tenant", nil, cfg)
+	})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the first frame travels with the handshake
+	_, err = conn.Write([]byte("GET /comms HTTP/1.1\r\nHost: tenant\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\nping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Upgrade should be accepted, got %d", resp.StatusCode)
+	}
+
+	data := make([]byte, len("helloping"))
+	if _, err := io.ReadFull(reader, data); err != nil || string(data) != "helloping" {
+		t.Fatalf("Buffered bytes should be relayed, got %q %v", data, err)
+	}
+
+	if stats := ActiveConnections("tenant"); stats == nil || stats.Active != 1 {
+		t.Fatalf("Connection should be tracked, got %+v", stats)
+	}
+
+	closeConnections("tenant")
+
+	frame := make([]byte, len(closeGoingAway))
+	if _, err := io.ReadFull(reader, frame); err != nil || string(frame) != string(closeGoingAway) {
+		t.Fatalf("Client should get a close frame, got %v %v", frame, err)
+	}
+
+	for i := 0; i < 100 && ActiveConnections("tenant").Active > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := ActiveConnections("tenant"); stats.Active != 0 || stats.Total != total+1 {
+		t.Fatalf("Connection should be released, got %+v", stats)
+	}
+}
+
+func TestWebsocketRefused(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer backend.Close()
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request.URL.Host = strings.TrimPrefix(backend.URL, "http://")
+		c.Request.Header.Del("Upgrade")
+		proxyWebsocket(c, "refused", nil, &model.Config{})
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://refused/comms", nil)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUpgradeRequired {
+		t.Fatalf("Refused upgrade should be passed through, got %d", w.Code)
+	}
+	if ActiveConnections("refused") != nil {
+		t.Fatal("Refused upgrade should not be tracked")
+	}
+}
+
+func TestWebsocketRelayEnds(t *testing.T) {
+
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+
+	w := &wsConn{instance: "relay", client: client, backend: backend, idle: time.Hour}
+	// recent activity must not keep the client side waiting
+	w.touch()
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(clientPeer)
+		received <- data
+	}()
+
+	done := make(chan bool)
+	go func() {
+		w.relay(0)
+		close(done)
+	}()
+
+	backendPeer.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Relay should end once the backend closes")
+	}
+	if data := <-received; len(data) > 0 {
+		t.Fatalf("Backend close should not send a going away frame, got %v", data)
+	}
+}
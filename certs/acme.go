@@ -0,0 +1,389 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+const accountCollection = "acme"
+
+// obtainTimeout bound the time to obtain a certificate
+const obtainTimeout = 5 * time.Minute
+
+// account is the ACME account of a directory
+type account struct {
+	Directory string
+	// Key is the PEM encoded account key, encrypted when a secret key is set
+	Key string
+	URI string
+}
+
+// accountID identify the account of a directory, so switching between a
+// staging and a production directory keeps both
+func accountID(directory string) string {
+	sum := sha256.Sum256([]byte(directory))
+	return "account-" + hex.EncodeToString(sum[:8])
+}
+
+// httpClient return the client to reach the ACME directory, trusting
+// ACMECAFile in addition to the system roots
+func httpClient(cfg *model.Config) (*http.Client, error) {
+
+	if len(cfg.ACMECAFile) == 0 {
+		return &http.Client{Timeout: 30 * time.Second}, nil
+	}
+
+	raw, err := ioutil.ReadFile(cfg.ACMECAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("No certificates found in %s", cfg.ACMECAFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}, nil
+}
+
+// encodeKey PEM encode an ECDSA private key
+func encodeKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
+
+// acmeClient return the client registered with the directory, creating the
+// account on first use
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	store := storage.GetStore(accountCollection, m.cfg)
+	id := accountID(m.cfg.ACMEDirectoryURL)
+
+	acct := new(account)
+	err := store.Load(id, acct)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var key *ecdsa.PrivateKey
+	if len(acct.Key) == 0 {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		acct.Directory = m.cfg.ACMEDirectoryURL
+		acct.Key, err = m.sealKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		encoded, err := m.openKey(acct.Key)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			return nil, fmt.Errorf("Invalid ACME account key %s", id)
+		}
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hc, err := httpClient(m.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.cfg.ACMEDirectoryURL,
+		HTTPClient:   hc,
+		UserAgent:    "redzilla",
+	}
+
+	if len(acct.URI) == 0 {
+
+		contact := []string{}
+		if len(m.cfg.ACMEEmail) > 0 {
+			contact = append(contact, "mailto:"+m.cfg.ACMEEmail)
+		}
+
+		a, err := client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+		if err == acme.ErrAccountAlreadyExists {
+			a, err = client.GetReg(ctx, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.Infof("Registered ACME account at %s", m.cfg.ACMEDirectoryURL)
+		acct.URI = a.URI
+
+		err = store.Save(id, acct)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.client = client
+	return m.client, nil
+}
+
+// runHook call the DNS hook to present or clean up a TXT record
+func (m *Manager) runHook(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, m.cfg.ACMEDNSHook, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("DNS hook %s %s failed: %s %s", action, fqdn, err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// present publish the challenge answer, the returned function removes it
+func (m *Manager) present(ctx context.Context, client *acme.Client, z *acme.Authorization, chal *acme.Challenge) (func(), error) {
+
+	switch chal.Type {
+	case model.ChallengeHTTP:
+
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		store := storage.GetStore(challengeCollection, m.cfg)
+		err = store.Save(chal.Token, &challenge{
+			Token:   chal.Token,
+			KeyAuth: keyAuth,
+			Domain:  z.Identifier.Value,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return func() {
+			store.Delete(chal.Token)
+		}, nil
+
+	case model.ChallengeDNS:
+
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		fqdn := "_acme-challenge." + z.Identifier.Value
+		err = m.runHook(ctx, "present", fqdn, value)
+		if err != nil {
+			return nil, err
+		}
+
+		cleanup := func() {
+			err := m.runHook(context.Background(), "cleanup", fqdn, value)
+			if err != nil {
+				logrus.Warnf("%s", err.Error())
+			}
+		}
+
+		// let the record propagate before the ACME server looks it up
+		select {
+		case <-time.After(m.cfg.ACMEDNSWait):
+		case <-ctx.Done():
+			cleanup()
+			return nil, ctx.Err()
+		}
+
+		return cleanup, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported challenge %s", chal.Type)
+}
+
+// challengeType return the challenge validating a domain, hosts outside
+// the redzilla domain are not managed by the DNS hook
+func (m *Manager) challengeType(domain string) string {
+	root := strings.ToLower(m.cfg.Domain)
+	if domain == root || strings.HasSuffix(domain, "."+root) {
+		return m.cfg.ACMEChallenge
+	}
+	return model.ChallengeHTTP
+}
+
+// authorize complete the pending authorizations of an order, one at a time
+// so DNS hooks handling a single TXT value work with wildcards
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, order *acme.Order) error {
+
+	for _, uri := range order.AuthzURLs {
+
+		z, err := client.GetAuthorization(ctx, uri)
+		if err != nil {
+			return err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+
+		challengeType := m.challengeType(z.Identifier.Value)
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == challengeType {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("No %s challenge offered for %s", challengeType, z.Identifier.Value)
+		}
+
+		cleanup, err := m.present(ctx, client, z, chal)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.Accept(ctx, chal)
+		if err == nil {
+			_, err = client.WaitAuthorization(ctx, z.URI)
+		}
+		cleanup()
+
+		if err != nil {
+			return fmt.Errorf("Authorization of %s failed: %s", z.Identifier.Value, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// issue obtain a certificate for the domains and store it
+func (m *Manager) issue(name string, domains []string) (*tls.Certificate, error) {
+
+	logrus.Infof("Obtaining certificate for %s", strings.Join(domains, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.authorize(ctx, client, order)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := ""
+	for _, b := range der {
+		chain += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}))
+	}
+
+	encoded, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.save(name, domains, chain, encoded)
+}
+
+// save store a certificate and cache it
+func (m *Manager) save(name string, domains []string, chain, key string) (*tls.Certificate, error) {
+
+	sealed, err := m.sealKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &model.Certificate{
+		Name:        name,
+		Domains:     domains,
+		Certificate: chain,
+		Key:         sealed,
+		Updated:     time.Now(),
+	}
+
+	cert, err := m.parse(record)
+	if err != nil {
+		return nil, err
+	}
+	record.NotAfter = cert.Leaf.NotAfter
+
+	err = storage.GetStore(certificateCollection, m.cfg).Save(name, record)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	m.certs[name] = &entry{cert: cert, record: record, checked: time.Now()}
+	m.mutex.Unlock()
+
+	logrus.Infof("Stored certificate %s valid until %s", name, record.NotAfter.Format(time.RFC3339))
+
+	return cert, nil
+}
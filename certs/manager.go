@@ -0,0 +1,423 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/secrets"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+const certificateCollection = "certificates"
+const challengeCollection = "acme-challenges"
+
+// challengePath is where ACME servers fetch HTTP-01 tokens
+const challengePath = "/.well-known/acme-challenge/"
+
+// reloadInterval limit store reads of certificates due for renewal, the
+// leader replica renews them and the others pick them up from the store
+const reloadInterval = time.Minute
+
+//ErrHostNotAllowed is returned for hosts certificates are not obtained for
+var ErrHostNotAllowed = errors.New("Host not allowed")
+
+var tokenRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var defaultManager *Manager
+var defaultManagerMutex sync.Mutex
+
+// entry is a parsed certificate with its record
+type entry struct {
+	cert    *tls.Certificate
+	record  *model.Certificate
+	checked time.Time
+}
+
+// pendingCert is a certificate being obtained, shared by concurrent handshakes
+type pendingCert struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// challenge is an HTTP-01 token answer, stored so any replica can serve it
+type challenge struct {
+	Token   string
+	KeyAuth string
+	Domain  string
+}
+
+//Manager provide TLS certificates for the root domain and the instances
+//subdomains, loaded from files or obtained with ACME and kept in the store
+type Manager struct {
+	cfg *model.Config
+
+	// HostPolicy refuse hosts certificates should not be obtained for, the
+	// root domain is always allowed
+	HostPolicy func(host string) error
+
+	static *tls.Certificate
+
+	mutex   sync.Mutex
+	certs   map[string]*entry
+	pending map[string]*pendingCert
+
+	clientMutex sync.Mutex
+	client      *acme.Client
+}
+
+//NewManager create a manager for the configured TLS mode
+func NewManager(cfg *model.Config) (*Manager, error) {
+
+	m := &Manager{
+		cfg:     cfg,
+		certs:   make(map[string]*entry),
+		pending: make(map[string]*pendingCert),
+	}
+
+	switch cfg.TLSMode {
+	case model.TLSStatic:
+		if len(cfg.TLSCertFile) == 0 || len(cfg.TLSKeyFile) == 0 {
+			return nil, errors.New("TLSCertFile and TLSKeyFile are required by static TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		m.static = &cert
+	case model.TLSACME:
+		switch cfg.ACMEChallenge {
+		case model.ChallengeHTTP:
+		case model.ChallengeDNS:
+			if len(cfg.ACMEDNSHook) == 0 {
+				return nil, errors.New("ACMEDNSHook is required by the dns-01 challenge")
+			}
+		default:
+			return nil, fmt.Errorf("Unknown ACME challenge %s", cfg.ACMEChallenge)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown TLS mode %s", cfg.TLSMode)
+	}
+
+	return m, nil
+}
+
+//GetManager return the manager for the configured TLS mode
+func GetManager(cfg *model.Config) (*Manager, error) {
+	defaultManagerMutex.Lock()
+	defer defaultManagerMutex.Unlock()
+
+	if defaultManager != nil {
+		return defaultManager, nil
+	}
+
+	m, err := NewManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultManager = m
+	return defaultManager, nil
+}
+
+//TLSConfig return the server TLS configuration
+func (m *Manager) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+	// client certificates are verified by the mtls auth provider
+	if m.cfg.UsesAuth(model.AuthMTLS) {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	return tlsConfig
+}
+
+// isInstanceHost check if host is a single label below domain
+func isInstanceHost(host, domain string) bool {
+	if !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	label := strings.TrimSuffix(host, "."+domain)
+	return len(label) > 0 && !strings.Contains(label, ".")
+}
+
+// certName return the certificate name and domains serving host. With
+// dns-01 a wildcard certificate serves the root domain and the instances
+func (m *Manager) certName(host string) (string, []string, error) {
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	domain := strings.ToLower(m.cfg.Domain)
+	if len(host) == 0 {
+		host = domain
+	}
+
+	if m.cfg.ACMEChallenge == model.ChallengeDNS && (host == domain || isInstanceHost(host, domain)) {
+		return domain, []string{domain, "*." + domain}, nil
+	}
+
+	if host != domain {
+		if m.HostPolicy == nil {
+			return "", nil, ErrHostNotAllowed
+		}
+		err := m.HostPolicy(host)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return host, []string{host}, nil
+}
+
+//GetCertificate return the certificate for a TLS handshake, obtaining it
+//on first use
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	if m.static != nil {
+		return m.static, nil
+	}
+
+	name, domains, err := m.certName(hello.ServerName)
+	if err != nil {
+		logrus.Debugf("No certificate for %s: %s", hello.ServerName, err.Error())
+		return nil, err
+	}
+
+	return m.get(name, domains)
+}
+
+// sameDomains check if a certificate covers exactly the domains
+func sameDomains(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// get return a cached or stored certificate, obtaining it when missing or
+// expired
+func (m *Manager) get(name string, domains []string) (*tls.Certificate, error) {
+
+	m.mutex.Lock()
+	e, ok := m.certs[name]
+	m.mutex.Unlock()
+
+	if ok && sameDomains(e.record.Domains, domains) &&
+		(!e.record.Due(m.cfg.ACMERenewBefore) || time.Since(e.checked) < reloadInterval) {
+		return e.cert, nil
+	}
+
+	e, err := m.load(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if e != nil && sameDomains(e.record.Domains, domains) && time.Now().Before(e.record.NotAfter) {
+		return e.cert, nil
+	}
+
+	return m.obtain(name, domains)
+}
+
+// load read a certificate from the store and cache it
+func (m *Manager) load(name string) (*entry, error) {
+
+	record := new(model.Certificate)
+	err := storage.GetStore(certificateCollection, m.cfg).Load(name, record)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := m.parse(record)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &entry{cert: cert, record: record, checked: time.Now()}
+	m.mutex.Lock()
+	m.certs[name] = e
+	m.mutex.Unlock()
+
+	return e, nil
+}
+
+// parse decode a stored certificate and its key
+func (m *Manager) parse(record *model.Certificate) (*tls.Certificate, error) {
+
+	key, err := m.openKey(record.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair([]byte(record.Certificate), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// sealKey encrypt a private key when a secret key is configured
+func (m *Manager) sealKey(key string) (string, error) {
+	c, err := secrets.GetCipher(m.cfg)
+	if err == secrets.ErrNoKey {
+		return key, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return c.Encrypt(key)
+}
+
+// openKey decrypt a private key sealed by sealKey
+func (m *Manager) openKey(value string) (string, error) {
+	if !secrets.IsEncrypted(value) {
+		return value, nil
+	}
+	c, err := secrets.GetCipher(m.cfg)
+	if err != nil {
+		return "", err
+	}
+	return c.Decrypt(value)
+}
+
+// obtain request a certificate, handshakes for the same name wait for the
+// first request
+func (m *Manager) obtain(name string, domains []string) (*tls.Certificate, error) {
+
+	m.mutex.Lock()
+	if p, ok := m.pending[name]; ok {
+		m.mutex.Unlock()
+		<-p.done
+		return p.cert, p.err
+	}
+	p := &pendingCert{done: make(chan struct{})}
+	m.pending[name] = p
+	m.mutex.Unlock()
+
+	p.cert, p.err = m.issue(name, domains)
+
+	m.mutex.Lock()
+	delete(m.pending, name)
+	m.mutex.Unlock()
+	close(p.done)
+
+	return p.cert, p.err
+}
+
+//Renew obtain again the stored certificates due for renewal. Certificates
+//of hosts no longer allowed are removed
+func (m *Manager) Renew() {
+
+	if m.static != nil {
+		return
+	}
+
+	store := storage.GetStore(certificateCollection, m.cfg)
+	names, err := store.List()
+	if err != nil {
+		logrus.Warnf("Failed to list certificates: %s", err.Error())
+		return
+	}
+
+	for _, name := range names {
+
+		record := new(model.Certificate)
+		err := store.Load(name, record)
+		if err != nil {
+			logrus.Warnf("Failed to load certificate %s: %s", name, err.Error())
+			continue
+		}
+
+		if !record.Due(m.cfg.ACMERenewBefore) {
+			continue
+		}
+
+		current, domains, err := m.certName(record.Name)
+		if err != nil && err != ErrHostNotAllowed {
+			logrus.Warnf("Failed to check certificate %s: %s", record.Name, err.Error())
+			continue
+		}
+		if err == ErrHostNotAllowed || current != record.Name {
+			logrus.Infof("Removing certificate %s", record.Name)
+			m.mutex.Lock()
+			delete(m.certs, record.Name)
+			m.mutex.Unlock()
+			store.Delete(name)
+			continue
+		}
+
+		_, err = m.obtain(record.Name, domains)
+		if err != nil {
+			logrus.Warnf("Failed to renew certificate %s: %s", record.Name, err.Error())
+		}
+	}
+}
+
+//HTTPHandler answer ACME HTTP-01 challenges, passing other requests to
+//fallback
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !strings.HasPrefix(r.URL.Path, challengePath) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.URL.Path, challengePath)
+		if !tokenRegex.MatchString(token) {
+			http.NotFound(w, r)
+			return
+		}
+
+		ch := new(challenge)
+		err := storage.GetStore(challengeCollection, m.cfg).Load(token, ch)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(ch.KeyAuth))
+	})
+}
+
+//RedirectHandler send plain HTTP requests to the HTTPS listener at tlsPort
+func RedirectHandler(tlsPort string) http.Handler {
+
+	_, port, _ := net.SplitHostPort(tlsPort)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(port) > 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,173 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+)
+
+// selfSigned create a PEM certificate and key for the domains
+func selfSigned(t *testing.T, notAfter time.Time, domains ...string) (string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := encodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), encoded
+}
+
+// storePath is shared by the tests, the store backend is initialized once
+var storePath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "redzilla-certs")
+	if err != nil {
+		panic(err)
+	}
+	storePath = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testManager(t *testing.T, challenge string) *Manager {
+
+	cfg := &model.Config{
+		Domain:          "redzilla.localhost",
+		StorePath:       storePath,
+		TLSMode:         model.TLSACME,
+		ACMEChallenge:   challenge,
+		ACMEDNSHook:     "/bin/true",
+		ACMERenewBefore: 24 * time.Hour,
+	}
+
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestCertName(t *testing.T) {
+
+	m := testManager(t, model.ChallengeHTTP)
+
+	name, domains, err := m.certName("")
+	if err != nil || name != "redzilla.localhost" || len(domains) != 1 {
+		t.Fatalf("Root domain expected, got %s %v %v", name, domains, err)
+	}
+
+	if _, _, err := m.certName("tenant.redzilla.localhost"); err != ErrHostNotAllowed {
+		t.Fatal("Hosts should be refused without a policy")
+	}
+
+	m.HostPolicy = func(host string) error { return nil }
+	name, domains, err = m.certName("Tenant.redzilla.localhost.")
+	if err != nil || name != "tenant.redzilla.localhost" || domains[0] != name {
+		t.Fatalf("Per instance certificate expected, got %s %v", name, domains)
+	}
+
+	m.cfg.ACMEChallenge = model.ChallengeDNS
+	name, domains, err = m.certName("tenant.redzilla.localhost")
+	if err != nil || name != "redzilla.localhost" || len(domains) != 2 || domains[1] != "*.redzilla.localhost" {
+		t.Fatalf("Wildcard certificate expected, got %s %v", name, domains)
+	}
+}
+
+func TestStoredCertificate(t *testing.T) {
+
+	m := testManager(t, model.ChallengeHTTP)
+
+	domains := []string{"redzilla.localhost"}
+	chain, key := selfSigned(t, time.Now().Add(90*24*time.Hour), domains...)
+
+	_, err := m.save("redzilla.localhost", domains, chain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh manager, as another replica, reads it from the store
+	other, err := NewManager(m.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := other.GetCertificate(&tls.ClientHelloInfo{ServerName: "redzilla.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Subject.CommonName != "redzilla.localhost" {
+		t.Fatalf("Unexpected certificate %s", cert.Leaf.Subject.CommonName)
+	}
+
+	record := new(model.Certificate)
+	err = storage.GetStore(certificateCollection, m.cfg).Load("redzilla.localhost", record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Due(m.cfg.ACMERenewBefore) || !record.Due(100*24*time.Hour) {
+		t.Fatalf("Unexpected renewal date %s", record.NotAfter)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+
+	m := testManager(t, model.ChallengeHTTP)
+
+	err := storage.GetStore(challengeCollection, m.cfg).Save("tok-en_1", &challenge{Token: "tok-en_1", KeyAuth: "tok-en_1.thumb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := m.HTTPHandler(RedirectHandler(":8443"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://tenant.redzilla.localhost"+challengePath+"tok-en_1", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "tok-en_1.thumb" {
+		t.Fatalf("Challenge answer expected, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://tenant.redzilla.localhost"+challengePath+"..%2Fx", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Unknown token should not be found, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://tenant.redzilla.localhost:3000/red/?a=1", nil))
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "https://tenant.redzilla.localhost:8443/red/?a=1" {
+		t.Fatalf("Redirect expected, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,139 @@
+package cluster
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const leaseCollection = "leases"
+
+// leaderLease is the lease held by the replica handling docker events and
+// background tasks
+const leaderLease = "leader"
+
+var elector *Elector
+
+var callbacksMutex sync.Mutex
+var onElected []func()
+
+// Elector acquire and renew a lease in the shared store so that a single
+// replica act as leader
+type Elector struct {
+	id    string
+	ttl   time.Duration
+	store *storage.Store
+
+	mu      sync.Mutex
+	leader  bool
+	expires time.Time
+}
+
+// StartElection join the leader election with the configured replica ID
+func StartElection(cfg *model.Config) *Elector {
+
+	ttl := cfg.LeaseTTL
+	if ttl <= 0 {
+		ttl = time.Second * 15
+	}
+
+	elector = &Elector{
+		id:    cfg.ReplicaID,
+		ttl:   ttl,
+		store: storage.GetStore(leaseCollection, cfg),
+	}
+
+	logrus.Infof("Replica %s joining leader election", elector.id)
+
+	go func() {
+		for {
+			elector.campaign()
+			time.Sleep(elector.ttl / 3)
+		}
+	}()
+
+	return elector
+}
+
+// IsLeader return true if this replica currently holds the leader lease.
+// Without a running election the replica is always the leader
+func IsLeader() bool {
+	if elector == nil {
+		return true
+	}
+	return elector.IsLeader()
+}
+
+// OnElected register a callback invoked each time this replica becomes leader
+func OnElected(fn func()) {
+	callbacksMutex.Lock()
+	defer callbacksMutex.Unlock()
+	onElected = append(onElected, fn)
+}
+
+// IsLeader return true if the lease is held and not expired
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader && time.Now().Before(e.expires)
+}
+
+// campaign try to acquire or renew the lease
+func (e *Elector) campaign() {
+
+	lease := new(model.Lease)
+	err := e.store.Load(leaderLease, lease)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to load leader lease: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	if lease.Holder != e.id && now.Before(lease.Expires) {
+		e.setLeader(false, time.Time{})
+		return
+	}
+
+	lease.Name = leaderLease
+	lease.Holder = e.id
+	lease.Expires = now.Add(e.ttl)
+
+	err = e.store.Update(leaderLease, lease, lease.Version)
+	if err != nil {
+		if err != storage.ErrConflict {
+			logrus.Warnf("Failed to acquire leader lease: %s", err.Error())
+		}
+		return
+	}
+
+	e.setLeader(true, lease.Expires)
+}
+
+func (e *Elector) setLeader(leader bool, expires time.Time) {
+
+	e.mu.Lock()
+	wasLeader := e.leader && time.Now().Before(e.expires)
+	e.leader = leader
+	if leader {
+		e.expires = expires
+	}
+	e.mu.Unlock()
+
+	if wasLeader && !leader {
+		logrus.Infof("Replica %s is no longer leader", e.id)
+	}
+
+	if !wasLeader && leader {
+		logrus.Infof("Replica %s elected leader", e.id)
+		callbacksMutex.Lock()
+		callbacks := append([]func(){}, onElected...)
+		callbacksMutex.Unlock()
+		for _, fn := range callbacks {
+			go fn()
+		}
+	}
+}
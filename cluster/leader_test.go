@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ansriaz/redzilla/storage"
+)
+
+func TestSingleLeader(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "redzilla-leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := storage.NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newElector := func(id string) *Elector {
+		return &Elector{
+			id:    id,
+			ttl:   time.Millisecond * 300,
+			store: storage.NewStore(leaseCollection, b),
+		}
+	}
+
+	e1 := newElector("replica1")
+	e2 := newElector("replica2")
+
+	e1.campaign()
+	e2.campaign()
+
+	if !e1.IsLeader() || e2.IsLeader() {
+		t.Fatal("Expected replica1 to be the only leader")
+	}
+
+	// replica1 stops renewing, replica2 takes over once the lease expires
+	time.Sleep(time.Millisecond * 400)
+	e2.campaign()
+
+	if e1.IsLeader() || !e2.IsLeader() {
+		t.Fatal("Expected replica2 to take over")
+	}
+}
@@ -3,14 +3,16 @@ package docker
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ansriaz/redzilla/model"
-	"github.com/ansriaz/redzilla/storage"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
@@ -26,24 +28,38 @@ import (
 type ContainerEvent struct {
 	ID      string
 	Name    string
+	Node    string
 	Action  string
 	Message events.Message
 }
 
 var eventsChannel = make(chan ContainerEvent)
-var dockerClient *client.Client
 
 //GetEventsChannel return the main channel reporting docker events
 func GetEventsChannel() <-chan ContainerEvent {
 	return eventsChannel
 }
 
-// ListenEvents watches docker events an handle state modifications
+// ListenEvents watches docker events on all nodes an handle state modifications
 func ListenEvents(cfg *model.Config) <-chan ContainerEvent {
 
-	cli, err := getClient()
+	InitNodes(cfg)
+
+	for _, node := range GetNodeConfigs() {
+		err := listenNodeEvents(node.Name)
+		if err != nil {
+			logrus.Errorf("Cannot listen events on node %s: %s", node.Name, err.Error())
+		}
+	}
+
+	return eventsChannel
+}
+
+func listenNodeEvents(node string) error {
+
+	cli, err := getClient(node)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	ctx := context.Background()
@@ -63,7 +79,7 @@ func ListenEvents(cfg *model.Config) <-chan ContainerEvent {
 			case event := <-msgChan:
 				if &event != nil {
 
-					logrus.Infof("Event recieved: %s %s ", event.Action, event.Type)
+					logrus.Infof("Event recieved on %s: %s %s ", node, event.Action, event.Type)
 					if event.Actor.Attributes != nil {
 
 						// logrus.Infof("%s: %s | %s | %s | %s | %s", event.Actor.Attributes["name"], event.Action, event.From, event.ID, event.Status, event.Type)
@@ -82,6 +98,7 @@ func ListenEvents(cfg *model.Config) <-chan ContainerEvent {
 							Action:  event.Action,
 							ID:      event.ID,
 							Name:    name,
+							Node:    node,
 							Message: event,
 						}
 						eventsChannel <- ev
@@ -90,27 +107,13 @@ func ListenEvents(cfg *model.Config) <-chan ContainerEvent {
 				}
 			case err := <-errChan:
 				if err != nil {
-					logrus.Errorf("Error event recieved: %s", err.Error())
+					logrus.Errorf("Error event recieved on %s: %s", node, err.Error())
 				}
 			}
 		}
 	}()
 
-	return eventsChannel
-}
-
-//return a docker client
-func getClient() (*client.Client, error) {
-
-	if dockerClient == nil {
-		cli, err := client.NewEnvClient()
-		if err != nil {
-			return nil, err
-		}
-		dockerClient = cli
-	}
-
-	return dockerClient, nil
+	return nil
 }
 
 func extractEnv(cfg *model.Config) []string {
@@ -144,12 +147,56 @@ func extractEnv(cfg *model.Config) []string {
 	return env
 }
 
-//StartContainer start a container
-func StartContainer(name string, cfg *model.Config) error {
+// mergeEnv add instance variables to the global ones, overriding
+// variables with the same name
+func mergeEnv(global []string, vars map[string]string) []string {
+
+	env := make([]string, 0, len(global)+len(vars))
+	for _, e := range global {
+		key := e
+		if idx := strings.Index(e, "="); idx > -1 {
+			key = e[:idx]
+		}
+		if _, ok := vars[key]; ok {
+			continue
+		}
+		env = append(env, e)
+	}
+
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+vars[key])
+	}
+
+	return env
+}
+
+//ContainerOptions are settings resolved by redzilla for the container
+type ContainerOptions struct {
+	// Env is added to the EnvPrefix variables
+	Env map[string]string
+	// Binds are added to the data and config binds
+	Binds []string
+	// Cmd is passed as arguments to the image entrypoint
+	Cmd []string
+}
+
+//StartContainer start a container for the instance on its node
+func StartContainer(instance *model.Instance, opts *ContainerOptions, cfg *model.Config) error {
 
-	logrus.Debugf("Starting docker container %s", name)
+	name := instance.Name
+	logrus.Debugf("Starting docker container %s on %s", name, instance.Node)
+
+	nodeCfg, err := GetNodeConfig(instance.Node)
+	if err != nil {
+		return err
+	}
 
-	cli, err := getClient()
+	cli, err := getClient(instance.Node)
 	if err != nil {
 		return err
 	}
@@ -158,15 +205,26 @@ func StartContainer(name string, cfg *model.Config) error {
 	// options := types.ContainerStartOptions{}
 	ctx := context.Background()
 
-	logrus.Debugf("Pulling image %s if not available", cfg.ImageName)
-	_, err = cli.ImagePull(ctx, cfg.ImageName, types.ImagePullOptions{})
+	image := cfg.ImageName
+	if len(instance.Image) > 0 {
+		image = instance.Image
+	}
+
+	logrus.Debugf("Pulling image %s if not available", image)
+	pull, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	// the pull completes once the progress stream is consumed
+	_, err = io.Copy(ioutil.Discard, pull)
+	pull.Close()
 	if err != nil {
 		return err
 	}
 
-	logrus.Debugf("Pulled image %s", cfg.ImageName)
+	logrus.Debugf("Pulled image %s", image)
 
-	info, err := GetContainer(name)
+	info, err := GetContainer(instance.Node, name)
 	if err != nil {
 		return err
 	}
@@ -178,31 +236,52 @@ func StartContainer(name string, cfg *model.Config) error {
 
 	if !exists {
 
-		labels := map[string]string{
-			"redzilla":          "1",
-			"redzilla_instance": "redzilla_" + name,
+		labels := make(map[string]string)
+		for key, value := range instance.Labels {
+			labels[key] = value
 		}
+		labels["redzilla"] = "1"
+		labels["redzilla_instance"] = "redzilla_" + name
+
 		exposedPorts := nat.PortSet{
 			"1880/tcp": {},
 		}
 
-		instanceConfigPath := storage.GetConfigPath(cfg)
-		instanceDataPath := storage.GetInstancesDataPath(name, cfg)
-		binds := []string{
-			instanceDataPath + ":/data",
-			instanceConfigPath + ":/config",
+		binds, mounts, err := containerMounts(instance, nodeCfg, cfg)
+		if err != nil {
+			return err
+		}
+		binds = append(binds, opts.Binds...)
+
+		envVars := mergeEnv(extractEnv(cfg), opts.Env)
+
+		portBindings := nat.PortMap{
+			"1880": []nat.PortBinding{
+				nat.PortBinding{
+					HostIP:   "",
+					HostPort: "1880",
+				},
+			}}
+		if len(nodeCfg.Address) > 0 {
+			// remote nodes are reached on a port published by the docker host
+			portBindings = nat.PortMap{
+				"1880/tcp": []nat.PortBinding{
+					nat.PortBinding{
+						HostIP:   "",
+						HostPort: "",
+					},
+				}}
 		}
-
-		envVars := extractEnv(cfg)
 
 		logrus.Debugf("Creating new container %s ", name)
 		logrus.Debugf("Bind paths: %v", binds)
-		logrus.Debugf("Env: %v", envVars)
+		logrus.Debugf("Mounts: %v", mounts)
+		logrus.Debugf("Env: %d variables", len(envVars))
 
 		resp, err1 := cli.ContainerCreate(ctx,
 			&container.Config{
 				User:         strconv.Itoa(os.Getuid()), // avoid permission issues
-				Image:        cfg.ImageName,
+				Image:        image,
 				AttachStdin:  false,
 				AttachStdout: true,
 				AttachStderr: true,
@@ -210,21 +289,20 @@ func StartContainer(name string, cfg *model.Config) error {
 				ExposedPorts: exposedPorts,
 				Labels:       labels,
 				Env:          envVars,
+				Cmd:          opts.Cmd,
 			},
 			&container.HostConfig{
-				Binds:       binds,
-				NetworkMode: container.NetworkMode(cfg.Network),
-				PortBindings: nat.PortMap{
-					"1880": []nat.PortBinding{
-						nat.PortBinding{
-							HostIP:   "",
-							HostPort: "1880",
-						},
-					}},
-				AutoRemove: true,
+				Binds:        binds,
+				Mounts:       mounts,
+				NetworkMode:  container.NetworkMode(cfg.Network),
+				PortBindings: portBindings,
+				AutoRemove:   true,
+				Resources: container.Resources{
+					Memory:   instance.Resources.Memory,
+					NanoCPUs: int64(instance.Resources.CPUs * 1e9),
+				},
 				// Links           []string          // List of links (in the name:alias form)
 				// PublishAllPorts bool              // Should docker publish all exposed port for the container
-				// Mounts []mount.Mount `json:",omitempty"`
 			},
 			nil, // &network.NetworkingConfig{},
 			name,
@@ -252,14 +330,14 @@ func StartContainer(name string, cfg *model.Config) error {
 }
 
 // ContainerWatchLogs pipe logs from the container instance
-func ContainerWatchLogs(ctx context.Context, name string, writer io.Writer) error {
+func ContainerWatchLogs(ctx context.Context, node, name string, writer io.Writer) error {
 
-	cli, err := getClient()
+	cli, err := getClient(node)
 	if err != nil {
 		return err
 	}
 
-	info, err := GetContainer(name)
+	info, err := GetContainer(node, name)
 	if err != nil {
 		return err
 	}
@@ -301,18 +379,18 @@ func ContainerWatchLogs(ctx context.Context, name string, writer io.Writer) erro
 }
 
 //StopContainer stop a container
-func StopContainer(name string) error {
+func StopContainer(node, name string) error {
 
-	logrus.Debugf("Stopping container %s", name)
+	logrus.Debugf("Stopping container %s on %s", name, node)
 
-	cli, err := getClient()
+	cli, err := getClient(node)
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
 
-	info, err := GetContainer(name)
+	info, err := GetContainer(node, name)
 	if err != nil {
 		return err
 	}
@@ -335,7 +413,7 @@ func StopContainer(name string) error {
 }
 
 // GetContainer return container info by name
-func GetContainer(name string) (*types.ContainerJSON, error) {
+func GetContainer(node, name string) (*types.ContainerJSON, error) {
 
 	ctx := context.Background()
 	emptyJSON := &types.ContainerJSON{}
@@ -344,7 +422,7 @@ func GetContainer(name string) (*types.ContainerJSON, error) {
 		return emptyJSON, errors.New("GetContainer(): name is empty")
 	}
 
-	cli, err := getClient()
+	cli, err := getClient(node)
 	if err != nil {
 		return emptyJSON, err
 	}
@@ -361,11 +439,11 @@ func GetContainer(name string) (*types.ContainerJSON, error) {
 }
 
 //GetNetwork inspect a network by networkID
-func GetNetwork(networkID string) (*types.NetworkResource, error) {
+func GetNetwork(node, networkID string) (*types.NetworkResource, error) {
 
 	n := types.NetworkResource{}
 
-	cli, err := getClient()
+	cli, err := getClient(node)
 	if err != nil {
 		return &n, err
 	}
@@ -378,3 +456,54 @@ func GetNetwork(networkID string) (*types.NetworkResource, error) {
 
 	return &n, nil
 }
+
+// GetPublishedAddress return the host:port where the node publishes the
+// container Node-RED port, empty if the node has no Address configured
+func GetPublishedAddress(node, name string) (string, error) {
+
+	nodeCfg, err := GetNodeConfig(node)
+	if err != nil {
+		return "", err
+	}
+	if len(nodeCfg.Address) == 0 {
+		return "", nil
+	}
+
+	info, err := GetContainer(node, name)
+	if err != nil {
+		return "", err
+	}
+	if info.ContainerJSONBase == nil || info.NetworkSettings == nil {
+		return "", errors.New("Container not found " + name)
+	}
+
+	bindings := info.NetworkSettings.Ports["1880/tcp"]
+	if len(bindings) == 0 {
+		return "", fmt.Errorf("Port not published for container `%s`", name)
+	}
+
+	return nodeCfg.Address + ":" + bindings[0].HostPort, nil
+}
+
+//RemoveContainer remove a stopped container, so the next start creates it
+//again from the current image
+func RemoveContainer(node, name string) error {
+
+	cli, err := getClient(node)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = cli.ContainerRemove(ctx, name, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		// containers are started with AutoRemove and may be already gone
+		if client.IsErrNotFound(err) || strings.Contains(err.Error(), "already in progress") {
+			return nil
+		}
+		return err
+	}
+
+	logrus.Debugf("Removed container %s", name)
+	return nil
+}
@@ -0,0 +1,95 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/sirupsen/logrus"
+
+	"golang.org/x/net/context"
+)
+
+// InstallPackages run `npm install` in the instance data directory with a
+// temporary container of the instance image, installing the nodes listed
+// in package.json
+func InstallPackages(instance *model.Instance, cfg *model.Config) error {
+
+	cli, err := getClient(instance.Node)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	image := cfg.ImageName
+	if len(instance.Image) > 0 {
+		image = instance.Image
+	}
+
+	pull, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, pull)
+	pull.Close()
+	if err != nil {
+		return err
+	}
+
+	instanceDataPath := storage.GetInstancesDataPath(instance.Name, cfg)
+
+	logrus.Debugf("Installing packages for %s", instance.Name)
+
+	resp, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			User:       strconv.Itoa(os.Getuid()),
+			Image:      image,
+			Entrypoint: strslice.StrSlice{"npm"},
+			Cmd:        strslice.StrSlice{"install", "--no-audit", "--production", "--cache", "/data/.npm"},
+			WorkingDir: "/data",
+			Labels: map[string]string{
+				"redzilla_install": "redzilla_" + instance.Name,
+			},
+		},
+		&container.HostConfig{
+			Binds: []string{
+				instanceDataPath + ":/data",
+			},
+		},
+		nil,
+		"",
+	)
+	if err != nil {
+		return err
+	}
+
+	containerID := resp.ID
+	defer cli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true})
+
+	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNextExit)
+
+	err = cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-errCh:
+		return err
+	case status := <-statusCh:
+		if status.StatusCode != 0 {
+			return fmt.Errorf("Package install for %s exited with code %d", instance.Name, status.StatusCode)
+		}
+	}
+
+	logrus.Infof("Installed packages for %s", instance.Name)
+	return nil
+}
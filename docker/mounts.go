@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"fmt"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// DataPath is where the instance data is mounted in the container
+const DataPath = "/data"
+
+// ConfigPath is where the shared config is mounted in the container
+const ConfigPath = "/config"
+
+// containerMounts return the binds for data and config and the additional
+// mounts of the instance. A data volume replaces the data host bind. Bind
+// mounts are checked against the redzilla host and refused on remote nodes
+func containerMounts(instance *model.Instance, nodeCfg *model.NodeConfig, cfg *model.Config) ([]string, []mount.Mount, error) {
+
+	binds := []string{
+		storage.GetConfigPath(cfg) + ":" + ConfigPath,
+	}
+	mounts := make([]mount.Mount, 0, len(instance.Mounts)+1)
+
+	if len(instance.DataVolume) > 0 {
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: instance.DataVolume,
+			Target: DataPath,
+		})
+	} else {
+		binds = append(binds, storage.GetInstancesDataPath(instance.Name, cfg)+":"+DataPath)
+	}
+
+	for _, m := range instance.Mounts {
+		switch m.Type {
+		case model.MountVolume:
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeVolume,
+				Source:   m.Source,
+				Target:   m.Target,
+				ReadOnly: m.ReadOnly,
+			})
+		case model.MountBind:
+			if len(nodeCfg.Address) > 0 {
+				return nil, nil, fmt.Errorf("Bind mount %s not allowed on remote node %s", m.Source, nodeCfg.Name)
+			}
+			// host paths are never writable by instances
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   m.Source,
+				Target:   m.Target,
+				ReadOnly: true,
+			})
+		case model.MountTmpfs:
+			mounts = append(mounts, mount.Mount{
+				Type:   mount.TypeTmpfs,
+				Target: m.Target,
+				TmpfsOptions: &mount.TmpfsOptions{
+					SizeBytes: m.Size,
+				},
+			})
+		}
+	}
+
+	return binds, mounts, nil
+}
@@ -0,0 +1,29 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+func TestContainerMountsRemoteNode(t *testing.T) {
+
+	cfg := &model.Config{InstanceDataPath: "/tmp/redzilla/instances", InstanceConfigPath: "/tmp/redzilla/config"}
+	instance := &model.Instance{
+		Name:   "tenant",
+		Mounts: []model.Mount{{Type: model.MountBind, Source: "/srv/shared", Target: "/shared"}},
+	}
+
+	_, mounts, err := containerMounts(instance, &model.NodeConfig{Name: "local"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || !mounts[0].ReadOnly {
+		t.Fatalf("Bind mount should be read-only on local nodes, got %+v", mounts)
+	}
+
+	_, _, err = containerMounts(instance, &model.NodeConfig{Name: "remote", Address: "10.0.0.2"}, cfg)
+	if err == nil {
+		t.Fatal("Bind mount should be refused on remote nodes")
+	}
+}
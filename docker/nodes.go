@@ -0,0 +1,271 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+
+	"golang.org/x/net/context"
+)
+
+// LocalNode is the node used when no nodes are configured
+const LocalNode = "local"
+
+const nodeCollection = "nodes"
+
+//ErrNoNodeAvailable is returned when no node can host an instance
+var ErrNoNodeAvailable = errors.New("No node available")
+
+var nodesMutex sync.Mutex
+var nodeConfigs []model.NodeConfig
+var clients = make(map[string]*client.Client)
+
+var roundRobinMutex sync.Mutex
+var roundRobinIndex int
+
+// InitNodes register the docker endpoints from the configuration
+func InitNodes(cfg *model.Config) {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+	nodeConfigs = cfg.Nodes
+	if len(nodeConfigs) == 0 {
+		nodeConfigs = []model.NodeConfig{{Name: LocalNode}}
+	}
+}
+
+// GetNodeConfigs return the configured nodes
+func GetNodeConfigs() []model.NodeConfig {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+	if len(nodeConfigs) == 0 {
+		return []model.NodeConfig{{Name: LocalNode}}
+	}
+	return nodeConfigs
+}
+
+// GetNodeConfig return a node configuration, an empty name return the
+// default (first) node
+func GetNodeConfig(name string) (*model.NodeConfig, error) {
+	nodes := GetNodeConfigs()
+	if len(name) == 0 {
+		return &nodes[0], nil
+	}
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return &nodes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Node `%s` not found", name)
+}
+
+//return a docker client for a node
+func getClient(node string) (*client.Client, error) {
+
+	nodeCfg, err := GetNodeConfig(node)
+	if err != nil {
+		return nil, err
+	}
+
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+
+	if cli, ok := clients[nodeCfg.Name]; ok {
+		return cli, nil
+	}
+
+	var cli *client.Client
+	if len(nodeCfg.Host) == 0 {
+		cli, err = client.NewEnvClient()
+	} else {
+		var httpClient *http.Client
+		if len(nodeCfg.TLSCert) > 0 || len(nodeCfg.TLSCACert) > 0 {
+			tlsc, terr := tlsconfig.Client(tlsconfig.Options{
+				CAFile:             nodeCfg.TLSCACert,
+				CertFile:           nodeCfg.TLSCert,
+				KeyFile:            nodeCfg.TLSKey,
+				InsecureSkipVerify: !nodeCfg.TLSVerify,
+			})
+			if terr != nil {
+				return nil, terr
+			}
+			httpClient = &http.Client{
+				Transport: &http.Transport{TLSClientConfig: tlsc},
+			}
+		}
+		cli, err = client.NewClient(nodeCfg.Host, api.DefaultVersion, httpClient, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clients[nodeCfg.Name] = cli
+	return cli, nil
+}
+
+// getNodeState load the stored state of a node
+func getNodeState(name string, cfg *model.Config) (*model.Node, error) {
+	node := &model.Node{Name: name}
+	err := storage.GetStore(nodeCollection, cfg).Load(name, node)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return node, nil
+}
+
+// SetDraining mark a node as draining, draining nodes do not receive new instances
+func SetDraining(name string, draining bool, cfg *model.Config) error {
+
+	_, err := GetNodeConfig(name)
+	if err != nil {
+		return err
+	}
+
+	node, err := getNodeState(name, cfg)
+	if err != nil {
+		return err
+	}
+
+	node.Draining = draining
+	return storage.GetStore(nodeCollection, cfg).Update(name, node, node.Version)
+}
+
+// IsDraining check if a node is draining
+func IsDraining(name string, cfg *model.Config) (bool, error) {
+	node, err := getNodeState(name, cfg)
+	if err != nil {
+		return false, err
+	}
+	return node.Draining, nil
+}
+
+// countInstances return the number of redzilla containers on a node
+func countInstances(name string) (int, error) {
+
+	cli, err := getClient(name)
+	if err != nil {
+		return 0, err
+	}
+
+	f := filters.NewArgs()
+	f.Add("label", "redzilla=1")
+	list, err := cli.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: f,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(list), nil
+}
+
+// ListNodes return configuration and usage of all nodes
+func ListNodes(cfg *model.Config) []model.NodeStatus {
+
+	list := make([]model.NodeStatus, 0)
+	for _, nodeCfg := range GetNodeConfigs() {
+
+		status := model.NodeStatus{
+			Name:     nodeCfg.Name,
+			Address:  nodeCfg.Address,
+			Labels:   nodeCfg.Labels,
+			Capacity: nodeCfg.Capacity,
+		}
+
+		draining, err := IsDraining(nodeCfg.Name, cfg)
+		if err == nil {
+			status.Draining = draining
+		}
+
+		count, err := countInstances(nodeCfg.Name)
+		if err == nil {
+			status.Instances = count
+			status.Reachable = true
+		}
+
+		list = append(list, status)
+	}
+
+	return list
+}
+
+// matchLabels check if all the selector labels are set on the node
+func matchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectNode pick a node among candidates with the given strategy. Nodes
+// are expected reachable and not draining
+func selectNode(candidates []model.NodeStatus, strategy string) (string, error) {
+
+	available := make([]model.NodeStatus, 0)
+	for _, node := range candidates {
+		if node.Capacity > 0 && node.Instances >= node.Capacity {
+			continue
+		}
+		available = append(available, node)
+	}
+
+	if len(available) == 0 {
+		return "", ErrNoNodeAvailable
+	}
+
+	switch strings.ToLower(strategy) {
+	case "round-robin":
+		roundRobinMutex.Lock()
+		defer roundRobinMutex.Unlock()
+		node := available[roundRobinIndex%len(available)]
+		roundRobinIndex++
+		return node.Name, nil
+	default:
+		// capacity, prefer the node with the lowest share of its capacity in
+		// use, nodes without capacity limit count as empty. Ties go to the
+		// node with less instances
+		usage := func(n model.NodeStatus) float64 {
+			if n.Capacity > 0 {
+				return float64(n.Instances) / float64(n.Capacity)
+			}
+			return 0
+		}
+		sort.SliceStable(available, func(i, j int) bool {
+			ui, uj := usage(available[i]), usage(available[j])
+			if ui != uj {
+				return ui < uj
+			}
+			return available[i].Instances < available[j].Instances
+		})
+		return available[0].Name, nil
+	}
+}
+
+// Schedule select a node for a new instance, the selector restricts
+// candidates to nodes having all its labels
+func Schedule(selector map[string]string, cfg *model.Config) (string, error) {
+
+	candidates := make([]model.NodeStatus, 0)
+	for _, node := range ListNodes(cfg) {
+		if !node.Reachable || node.Draining || !matchLabels(node.Labels, selector) {
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+
+	return selectNode(candidates, cfg.SchedulerStrategy)
+}
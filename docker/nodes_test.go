@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+func TestSelectNodeCapacity(t *testing.T) {
+
+	nodes := []model.NodeStatus{
+		{Name: "full", Capacity: 2, Instances: 2},
+		{Name: "busy", Capacity: 4, Instances: 3},
+		{Name: "idle", Capacity: 10, Instances: 1},
+	}
+
+	node, err := selectNode(nodes, "capacity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "idle" {
+		t.Fatalf("Expected idle, got %s", node)
+	}
+
+	_, err = selectNode(nodes[:1], "capacity")
+	if err != ErrNoNodeAvailable {
+		t.Fatalf("Expected ErrNoNodeAvailable, got %v", err)
+	}
+}
+
+func TestSelectNodeRoundRobin(t *testing.T) {
+
+	nodes := []model.NodeStatus{{Name: "a"}, {Name: "b"}}
+
+	first, _ := selectNode(nodes, "round-robin")
+	second, _ := selectNode(nodes, "round-robin")
+	if first == second {
+		t.Fatalf("Expected different nodes, got %s twice", first)
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := map[string]string{"zone": "eu", "disk": "ssd"}
+	if !matchLabels(labels, map[string]string{"zone": "eu"}) {
+		t.Fail()
+	}
+	if matchLabels(labels, map[string]string{"zone": "us"}) {
+		t.Fail()
+	}
+	if !matchLabels(labels, nil) {
+		t.Fail()
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/ansriaz/redzilla/model"
 	"github.com/ansriaz/redzilla/service"
+	units "github.com/docker/go-units"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 
@@ -37,6 +38,24 @@ func init() {
 	log.AddHook(filenameHook)
 }
 
+// defaultReplicaID identify this process among redzilla replicas
+func defaultReplicaID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "redzilla"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// lowerAll return the values in lower case
+func lowerAll(values []string) []string {
+	lower := make([]string, 0, len(values))
+	for _, value := range values {
+		lower = append(lower, strings.ToLower(value))
+	}
+	return lower
+}
+
 func main() {
 
 	viper.SetDefault("Network", "redzilla")
@@ -49,13 +68,84 @@ func main() {
 	viper.SetDefault("LogLevel", "info")
 	viper.SetDefault("Autostart", false)
 	viper.SetDefault("EnvPrefix", "")
+	viper.SetDefault("AuditLogPath", "./data/audit.log")
+	viper.SetDefault("StoreType", "file")
+	viper.SetDefault("StoreURL", "")
+	viper.SetDefault("ReplicaID", defaultReplicaID())
+	viper.SetDefault("LeaseTTL", "15s")
+	viper.SetDefault("CacheSyncInterval", "5s")
+	viper.SetDefault("SchedulerStrategy", "capacity")
+	viper.SetDefault("BackupTarget", "local")
+	viper.SetDefault("BackupPath", "./data/backups")
+	viper.SetDefault("BackupInterval", "0")
+	viper.SetDefault("BackupRetention", 7)
+	viper.SetDefault("BackupStop", false)
+	viper.SetDefault("RenameRedirectTTL", "168h")
+	viper.SetDefault("SecretKey", "")
+	viper.SetDefault("SecretKeyFile", "")
+	viper.SetDefault("SecretOldKeys", []string{})
+	viper.SetDefault("SecretsPath", "./data/secrets")
+	viper.SetDefault("MountAllowList", []string{})
+	viper.SetDefault("UsageInterval", "10m")
+	viper.SetDefault("DiskQuota", "0")
+	viper.SetDefault("DiskQuotaAction", "warn")
+	viper.SetDefault("OIDCIssuer", "")
+	viper.SetDefault("OIDCClientID", "")
+	viper.SetDefault("OIDCClientSecret", "")
+	viper.SetDefault("OIDCScopes", []string{"openid", "email", "profile"})
+	viper.SetDefault("OIDCRedirectURL", "")
+	viper.SetDefault("OIDCPrincipalClaim", "email")
+	viper.SetDefault("OIDCGroupsClaim", "groups")
+	viper.SetDefault("SessionSecret", "")
+	viper.SetDefault("SessionTTL", "12h")
+	viper.SetDefault("RBAC", false)
+	viper.SetDefault("RBACDefaultRole", "operator")
+	viper.SetDefault("RBACAdmins", []string{})
+	viper.SetDefault("BackupS3.Endpoint", "")
+	viper.SetDefault("BackupS3.Bucket", "")
+	viper.SetDefault("BackupS3.Region", "us-east-1")
+	viper.SetDefault("BackupS3.AccessKey", "")
+	viper.SetDefault("BackupS3.SecretKey", "")
+	viper.SetDefault("BackupS3.Prefix", "")
+	viper.SetDefault("BackupS3.PathStyle", true)
 
 	viper.SetDefault("AuthType", "none")
 	viper.SetDefault("AuthHttpMethod", "GET")
 	viper.SetDefault("AuthHttpUrl", "")
 	viper.SetDefault("AuthHttpHeader", "Authorization")
+	viper.SetDefault("AuthHttpCacheTTL", "0")
+	viper.SetDefault("AuthChain", []string{})
+	viper.SetDefault("AuthProxyChain", []string{})
+	viper.SetDefault("AuthHtpasswdFile", "")
+	viper.SetDefault("AuthClientCAFile", "")
+
+	viper.SetDefault("RoutingMode", "subdomain")
+	viper.SetDefault("PathStrip", false)
+
+	viper.SetDefault("BackendTLS", false)
+	viper.SetDefault("BackendInsecure", false)
+	viper.SetDefault("WebsocketIdle", "1h")
+	viper.SetDefault("WebsocketLifetime", "0")
+	viper.SetDefault("TrustedProxies", []string{})
+	viper.SetDefault("PreserveHost", false)
+
+	viper.SetDefault("TLSMode", "none")
+	viper.SetDefault("TLSPort", ":443")
+	viper.SetDefault("TLSCertFile", "")
+	viper.SetDefault("TLSKeyFile", "")
+	viper.SetDefault("TLSRedirect", true)
+	viper.SetDefault("HSTSMaxAge", "0")
+	viper.SetDefault("ACMEDirectoryURL", "https://acme-v02.api.letsencrypt.org/directory")
+	viper.SetDefault("ACMEEmail", "")
+	viper.SetDefault("ACMECAFile", "")
+	viper.SetDefault("ACMEChallenge", "http-01")
+	viper.SetDefault("ACMEDNSHook", "")
+	viper.SetDefault("ACMEDNSWait", "30s")
+	viper.SetDefault("ACMERenewBefore", "720h")
 
 	viper.SetEnvPrefix("redzilla")
+	// nested keys like BackupS3.Endpoint map to REDZILLA_BACKUPS3_ENDPOINT
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
 	configFile := "./config.yml"
@@ -83,17 +173,104 @@ func main() {
 		Autostart:          viper.GetBool("Autostart"),
 		EnvPrefix:          viper.GetString("EnvPrefix"),
 		AuthType:           viper.GetString("AuthType"),
+		AuditLogPath:       viper.GetString("AuditLogPath"),
+		StoreType:          viper.GetString("StoreType"),
+		StoreURL:           viper.GetString("StoreURL"),
+		ReplicaID:          viper.GetString("ReplicaID"),
+		LeaseTTL:           viper.GetDuration("LeaseTTL"),
+		CacheSyncInterval:  viper.GetDuration("CacheSyncInterval"),
+		SchedulerStrategy:  viper.GetString("SchedulerStrategy"),
+		BackupTarget:       viper.GetString("BackupTarget"),
+		BackupPath:         viper.GetString("BackupPath"),
+		BackupInterval:     viper.GetDuration("BackupInterval"),
+		BackupRetention:    viper.GetInt("BackupRetention"),
+		BackupStop:         viper.GetBool("BackupStop"),
+		RenameRedirectTTL:  viper.GetDuration("RenameRedirectTTL"),
+		SecretKey:          viper.GetString("SecretKey"),
+		SecretKeyFile:      viper.GetString("SecretKeyFile"),
+		SecretOldKeys:      viper.GetStringSlice("SecretOldKeys"),
+		SecretsPath:        viper.GetString("SecretsPath"),
+		MountAllowList:     viper.GetStringSlice("MountAllowList"),
+		UsageInterval:      viper.GetDuration("UsageInterval"),
+		DiskQuotaAction:    strings.ToLower(viper.GetString("DiskQuotaAction")),
+		OIDCIssuer:         viper.GetString("OIDCIssuer"),
+		OIDCClientID:       viper.GetString("OIDCClientID"),
+		OIDCClientSecret:   viper.GetString("OIDCClientSecret"),
+		OIDCScopes:         viper.GetStringSlice("OIDCScopes"),
+		OIDCRedirectURL:    viper.GetString("OIDCRedirectURL"),
+		OIDCPrincipalClaim: viper.GetString("OIDCPrincipalClaim"),
+		OIDCGroupsClaim:    viper.GetString("OIDCGroupsClaim"),
+		SessionSecret:      viper.GetString("SessionSecret"),
+		SessionTTL:         viper.GetDuration("SessionTTL"),
+		RBAC:               viper.GetBool("RBAC"),
+		RBACDefaultRole:    strings.ToLower(viper.GetString("RBACDefaultRole")),
+		RBACAdmins:         viper.GetStringSlice("RBACAdmins"),
+		AuthChain:          lowerAll(viper.GetStringSlice("AuthChain")),
+		AuthProxyChain:     lowerAll(viper.GetStringSlice("AuthProxyChain")),
+		AuthHtpasswdFile:   viper.GetString("AuthHtpasswdFile"),
+		AuthClientCAFile:   viper.GetString("AuthClientCAFile"),
+		RoutingMode:        strings.ToLower(viper.GetString("RoutingMode")),
+		PathStrip:          viper.GetBool("PathStrip"),
+		BackendTLS:         viper.GetBool("BackendTLS"),
+		BackendCAFile:      viper.GetString("BackendCAFile"),
+		BackendInsecure:    viper.GetBool("BackendInsecure"),
+		WebsocketIdle:      viper.GetDuration("WebsocketIdle"),
+		WebsocketLifetime:  viper.GetDuration("WebsocketLifetime"),
+		TrustedProxies:     viper.GetStringSlice("TrustedProxies"),
+		PreserveHost:       viper.GetBool("PreserveHost"),
+		TLSMode:            strings.ToLower(viper.GetString("TLSMode")),
+		TLSPort:            viper.GetString("TLSPort"),
+		TLSCertFile:        viper.GetString("TLSCertFile"),
+		TLSKeyFile:         viper.GetString("TLSKeyFile"),
+		TLSRedirect:        viper.GetBool("TLSRedirect"),
+		HSTSMaxAge:         viper.GetDuration("HSTSMaxAge"),
+		ACMEDirectoryURL:   viper.GetString("ACMEDirectoryURL"),
+		ACMEEmail:          viper.GetString("ACMEEmail"),
+		ACMECAFile:         viper.GetString("ACMECAFile"),
+		ACMEChallenge:      strings.ToLower(viper.GetString("ACMEChallenge")),
+		ACMEDNSHook:        viper.GetString("ACMEDNSHook"),
+		ACMEDNSWait:        viper.GetDuration("ACMEDNSWait"),
+		ACMERenewBefore:    viper.GetDuration("ACMERenewBefore"),
+		BackupS3: model.S3Config{
+			Endpoint:  viper.GetString("BackupS3.Endpoint"),
+			Bucket:    viper.GetString("BackupS3.Bucket"),
+			Region:    viper.GetString("BackupS3.Region"),
+			AccessKey: viper.GetString("BackupS3.AccessKey"),
+			SecretKey: viper.GetString("BackupS3.SecretKey"),
+			Prefix:    viper.GetString("BackupS3.Prefix"),
+			PathStyle: viper.GetBool("BackupS3.PathStyle"),
+		},
 	}
 
-	if strings.ToLower(cfg.AuthType) == "http" {
+	diskQuota, err := units.RAMInBytes(viper.GetString("DiskQuota"))
+	if err != nil {
+		panic(fmt.Errorf("Failed to parse disk quota: %s", err))
+	}
+	cfg.DiskQuota = diskQuota
+
+	err = viper.UnmarshalKey("Nodes", &cfg.Nodes)
+	if err != nil {
+		panic(fmt.Errorf("Failed to parse nodes: %s", err))
+	}
+
+	// AuthType is a shorthand for the common chains
+	if len(cfg.AuthChain) == 0 {
+		cfg.AuthChain = model.DefaultAuthChain(strings.ToLower(cfg.AuthType))
+	}
+	if len(cfg.AuthProxyChain) == 0 {
+		cfg.AuthProxyChain = cfg.AuthChain
+	}
+
+	if cfg.UsesAuth(model.AuthHTTP) {
 
 		a := new(model.AuthHttp)
 		a.Method = viper.GetString("AuthHttpMethod")
 		a.URL = viper.GetString("AuthHttpUrl")
 		a.Header = viper.GetString("AuthHttpHeader")
+		a.CacheTTL = viper.GetDuration("AuthHttpCacheTTL")
 
 		//setup the body template
-		rawTpl := viper.GetString("AuthHttpHeader")
+		rawTpl := viper.GetString("AuthHttpBody")
 		if len(rawTpl) > 0 {
 			bodyTemplate, err := template.New("").Parse(rawTpl)
 			if err != nil {
@@ -105,6 +282,23 @@ func main() {
 		cfg.AuthHttp = a
 	}
 
+	if cfg.RBAC && model.RoleRank(cfg.RBACDefaultRole) == 0 && cfg.RBACDefaultRole != "none" {
+		panic(fmt.Errorf("Invalid RBAC default role %s", cfg.RBACDefaultRole))
+	}
+
+	if cfg.RoutingMode != model.RoutingSubdomain && cfg.RoutingMode != model.RoutingPath {
+		panic(fmt.Errorf("Invalid routing mode %s", cfg.RoutingMode))
+	}
+
+	// instance pages would share the origin of the API and its session cookie
+	if cfg.RoutingMode == model.RoutingPath && cfg.UsesAuth(model.AuthOIDC) {
+		panic(fmt.Errorf("Routing mode %s cannot be used with %s sessions", cfg.RoutingMode, model.AuthOIDC))
+	}
+
+	if cfg.TLSMode != "none" && len(cfg.TLSMode) > 0 && !cfg.TLSEnabled() {
+		panic(fmt.Errorf("Invalid TLS mode %s", cfg.TLSMode))
+	}
+
 	lvl, err := log.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		panic(fmt.Errorf("Failed to parse level %s: %s", cfg.LogLevel, err))
@@ -115,7 +309,7 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	log.Debugf("%++v", cfg)
+	log.Debugf("%++v", cfg.Redact())
 
 	defer service.Stop(cfg)
 
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+const (
+	//AuditSuccess the action completed
+	AuditSuccess = "success"
+	//AuditFailure the action failed
+	AuditFailure = "failure"
+	//AuditDenied the action was not authorized
+	AuditDenied = "denied"
+)
+
+// AuditEntry records an action performed on redzilla
+type AuditEntry struct {
+	Time      time.Time
+	Principal string
+	Action    string
+	Instance  string
+	Source    string
+	UserAgent string
+	Outcome   string
+	Status    int
+	Message   string
+	// Replica is the redzilla process which recorded the entry
+	Replica string
+}
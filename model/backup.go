@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// Backup is a snapshot of an instance data directory
+type Backup struct {
+	ID       string
+	Instance string
+	Created  time.Time
+	Size     int64
+}
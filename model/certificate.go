@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+const (
+	//TLSStatic serve certificates loaded from files
+	TLSStatic = "static"
+	//TLSACME obtain certificates from an ACME directory
+	TLSACME = "acme"
+
+	//ChallengeHTTP validate domains with a token served on port 80
+	ChallengeHTTP = "http-01"
+	//ChallengeDNS validate domains with a TXT record, required for wildcards
+	ChallengeDNS = "dns-01"
+)
+
+// Certificate is a TLS certificate obtained with ACME
+type Certificate struct {
+	Name    string
+	Domains []string
+	// Certificate is the PEM encoded chain
+	Certificate string
+	// Key is the PEM encoded private key, encrypted when a secret key is set
+	Key      string
+	NotAfter time.Time
+	Updated  time.Time
+}
+
+//Due check if the certificate should be renewed
+func (c *Certificate) Due(renewBefore time.Duration) bool {
+	return time.Now().Add(renewBefore).After(c.NotAfter)
+}
@@ -1,6 +1,10 @@
 package model
 
-import "html/template"
+import (
+	"html/template"
+	"net/url"
+	"time"
+)
 
 // Config stores settings for the appliance
 type Config struct {
@@ -16,6 +20,159 @@ type Config struct {
 	EnvPrefix          string
 	AuthType           string
 	AuthHttp           *AuthHttp
+	AuditLogPath       string
+	StoreType          string
+	StoreURL           string
+	ReplicaID          string
+	LeaseTTL           time.Duration
+	CacheSyncInterval  time.Duration
+	Nodes              []NodeConfig
+	SchedulerStrategy  string
+	BackupTarget       string
+	BackupPath         string
+	BackupS3           S3Config
+	BackupInterval     time.Duration
+	BackupRetention    int
+	BackupStop         bool
+	RenameRedirectTTL  time.Duration
+	SecretKey          string
+	SecretKeyFile      string
+	SecretOldKeys      []string
+	SecretsPath        string
+	MountAllowList     []string
+	UsageInterval      time.Duration
+	DiskQuota          int64
+	DiskQuotaAction    string
+	OIDCIssuer         string
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCScopes         []string
+	OIDCRedirectURL    string
+	OIDCPrincipalClaim string
+	OIDCGroupsClaim    string
+	SessionSecret      string
+	SessionTTL         time.Duration
+	RBAC               bool
+	RBACDefaultRole    string
+	RBACAdmins         []string
+	AuthChain          []string
+	AuthProxyChain     []string
+	AuthHtpasswdFile   string
+	AuthClientCAFile   string
+	TLSMode            string
+	TLSPort            string
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSRedirect        bool
+	HSTSMaxAge         time.Duration
+	ACMEDirectoryURL   string
+	ACMEEmail          string
+	ACMECAFile         string
+	ACMEChallenge      string
+	ACMEDNSHook        string
+	ACMEDNSWait        time.Duration
+	ACMERenewBefore    time.Duration
+	RoutingMode        string
+	PathStrip          bool
+	BackendTLS         bool
+	BackendCAFile      string
+	BackendInsecure    bool
+	WebsocketIdle      time.Duration
+	WebsocketLifetime  time.Duration
+	TrustedProxies     []string
+	PreserveHost       bool
+}
+
+const (
+	//AuthBasic authenticates users of an htpasswd file
+	AuthBasic = "basic"
+	//AuthToken authenticates API tokens issued by redzilla
+	AuthToken = "token"
+	//AuthHTTP asks an external auth service
+	AuthHTTP = "http"
+	//AuthOIDC authenticates OpenID Connect tokens and sessions
+	AuthOIDC = "oidc"
+	//AuthMTLS authenticates TLS client certificates
+	AuthMTLS = "mtls"
+)
+
+//DefaultAuthChain return the providers chain equivalent to an AuthType
+func DefaultAuthChain(authType string) []string {
+	switch authType {
+	case AuthHTTP, AuthOIDC:
+		return []string{AuthToken, authType}
+	}
+	return []string{}
+}
+
+//UsesAuth check if a provider is in the API or proxy chain
+func (c *Config) UsesAuth(provider string) bool {
+	for _, chain := range [][]string{c.AuthChain, c.AuthProxyChain} {
+		for _, name := range chain {
+			if name == provider {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	//RoutingSubdomain serve instances at <name>.<domain>
+	RoutingSubdomain = "subdomain"
+	//RoutingPath serve instances at <domain>/instance/<name>/
+	RoutingPath = "path"
+)
+
+//TLSEnabled check if redzilla terminates TLS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSMode == TLSStatic || c.TLSMode == TLSACME
+}
+
+//Redact return a copy of the configuration hiding secret values, to be logged
+func (c *Config) Redact() *Config {
+
+	redacted := *c
+	redact := func(value string) string {
+		if len(value) == 0 {
+			return value
+		}
+		return RedactedValue
+	}
+
+	redacted.SecretKey = redact(c.SecretKey)
+	redacted.OIDCClientSecret = redact(c.OIDCClientSecret)
+	redacted.SessionSecret = redact(c.SessionSecret)
+	redacted.BackupS3.SecretKey = redact(c.BackupS3.SecretKey)
+	if len(c.SecretOldKeys) > 0 {
+		redacted.SecretOldKeys = make([]string, len(c.SecretOldKeys))
+		for i := range c.SecretOldKeys {
+			redacted.SecretOldKeys[i] = RedactedValue
+		}
+	}
+
+	// the store URL may carry the redis password
+	if u, err := url.Parse(c.StoreURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), RedactedValue)
+			redacted.StoreURL = u.String()
+		}
+	}
+
+	return &redacted
+}
+
+// S3Config configure an S3 compatible object storage
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to all object keys
+	Prefix string
+	// PathStyle address the bucket in the path instead of the host name
+	PathStyle bool
 }
 
 type AuthHttp struct {
@@ -23,4 +180,6 @@ type AuthHttp struct {
 	URL    string
 	Header string
 	Body   *template.Template
+	// CacheTTL applies to decisions without Cache-Control, zero is not cached
+	CacheTTL time.Duration
 }
@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// Connections reports the websockets relayed to an instance by a replica
+type Connections struct {
+	Active int
+	// Total counts the connections since the replica started
+	Total        int64
+	LastActivity time.Time
+}
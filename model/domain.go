@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// Domain is a custom hostname of an instance, routed once verified
+type Domain struct {
+	Host     string
+	Instance string
+	// Token proves control of the host, published in a TXT record
+	Token      string
+	Verified   bool
+	VerifiedAt time.Time
+	Version    int64
+	Created    time.Time
+	CreatedBy  string
+}
+
+//GetVersion return the resource version
+func (d *Domain) GetVersion() int64 {
+	return d.Version
+}
+
+//SetVersion set the resource version
+func (d *Domain) SetVersion(version int64) {
+	d.Version = version
+}
@@ -0,0 +1,67 @@
+package model
+
+import "time"
+
+const (
+	//RoleAdmin manage all instances and redzilla settings
+	RoleAdmin = "admin"
+	//RoleOperator create instances and manage the ones owned or shared
+	RoleOperator = "operator"
+	//RoleViewer read and reach the instances owned or shared
+	RoleViewer = "viewer"
+)
+
+// roleRanks order roles by privilege
+var roleRanks = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+//RoleRank return the privilege of a role, zero if the role is unknown
+func RoleRank(role string) int {
+	return roleRanks[role]
+}
+
+//TeamPrefix marks a grant subject as a team instead of a principal
+const TeamPrefix = "team:"
+
+// Grant assign a role to a principal, or to the members of a team when
+// Subject starts with TeamPrefix
+type Grant struct {
+	Subject   string
+	Role      string
+	Version   int64
+	Updated   time.Time
+	UpdatedBy string
+}
+
+//GetVersion return the resource version
+func (g *Grant) GetVersion() int64 {
+	return g.Version
+}
+
+//SetVersion set the resource version
+func (g *Grant) SetVersion(version int64) {
+	g.Version = version
+}
+
+// Team is a group of principals sharing instances, in addition to the
+// groups provided by the identity provider
+type Team struct {
+	Name      string
+	Members   []string
+	Version   int64
+	Updated   time.Time
+	UpdatedBy string
+}
+
+//GetVersion return the resource version
+func (t *Team) GetVersion() int64 {
+	return t.Version
+}
+
+//SetVersion set the resource version
+func (t *Team) SetVersion(version int64) {
+	t.Version = version
+}
@@ -0,0 +1,18 @@
+package model
+
+const (
+	//HeaderSet replaces the header
+	HeaderSet = "set"
+	//HeaderAdd adds a value to the header
+	HeaderAdd = "add"
+	//HeaderRemove removes the header
+	HeaderRemove = "remove"
+)
+
+// HeaderRule changes a request header proxied to an instance
+type HeaderRule struct {
+	Name string
+	// Action is set, add or remove, set by default
+	Action string `json:",omitempty"`
+	Value  string `json:",omitempty"`
+}
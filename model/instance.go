@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 //InstanceStatus last known state of an instance
 type InstanceStatus int
@@ -14,6 +17,12 @@ var (
 	InstanceStarted = InstanceStatus(20)
 )
 
+//RedactedValue replaces secret values in API responses
+const RedactedValue = "******"
+
+//MaxInstanceHistory number of changes kept in the instance record
+const MaxInstanceHistory = 10
+
 //NewInstance return a new json instance
 func NewInstance(name string) *Instance {
 	return &Instance{
@@ -31,4 +40,169 @@ type Instance struct {
 	Status  InstanceStatus
 	IP      string
 	Port    string
+	Address string
+	// Labels are free-form key/values to select instances, set as
+	// container labels too
+	Labels map[string]string
+	// Annotations are free-form metadata not used for selection
+	Annotations map[string]string
+	// Owner is the principal who created the instance
+	Owner string
+	// Team shares the instance with the team members
+	Team string `json:",omitempty"`
+	// Domains are custom hostnames of the instance, see the domains API
+	Domains []string `json:",omitempty"`
+	// Node is the docker node running the instance
+	Node string
+	// NodeSelector restricts scheduling to nodes having all these labels
+	NodeSelector map[string]string
+	// Image overrides the default Node-RED image
+	Image     string
+	Resources InstanceResources
+	// Env is passed to the container along with the EnvPrefix variables
+	Env map[string]string
+	// Secrets are passed to the container as env, values are encrypted
+	Secrets map[string]string
+	// SecretRefs inject secrets from the secret store
+	SecretRefs []SecretRef
+	// DataVolume is a docker volume mounted to /data instead of the
+	// instance data directory
+	DataVolume string
+	// Mounts are added to the data and config mounts
+	Mounts []Mount
+	// ProxyHeaders change the requests proxied to the instance
+	ProxyHeaders []HeaderRule `json:",omitempty"`
+	// DiskQuota overrides the default quota in bytes, -1 is unlimited
+	DiskQuota int64 `json:",omitempty"`
+	// Usage is reported by the API only, not stored with the instance
+	Usage *Usage `json:",omitempty"`
+	// Connections is reported by the API only, for the answering replica
+	Connections *Connections `json:",omitempty"`
+	// Template used to provision the instance
+	Template string
+	// InstallPending requests to install package.json dependencies on next start
+	InstallPending bool
+	// Version is the resource version, incremented on each stored update
+	Version   int64
+	Updated   time.Time
+	UpdatedBy string
+	History   []InstanceChange
+}
+
+// InstanceResources limits the container resources, zero means unlimited
+type InstanceResources struct {
+	// Memory limit in bytes
+	Memory int64
+	// CPUs is the number of CPUs, eg. 0.5
+	CPUs float64
+}
+
+const (
+	//MountVolume mount a named docker volume
+	MountVolume = "volume"
+	//MountBind mount a host path, always read-only
+	MountBind = "bind"
+	//MountTmpfs mount a temporary file system
+	MountTmpfs = "tmpfs"
+)
+
+// Mount is an additional container mount
+type Mount struct {
+	// Type is one of volume, bind or tmpfs
+	Type string
+	// Source is the volume name or host path
+	Source   string `json:",omitempty"`
+	Target   string
+	ReadOnly bool `json:",omitempty"`
+	// Size limit of a tmpfs in bytes, zero means unlimited
+	Size int64 `json:",omitempty"`
+}
+
+// InstanceChange track who changed an instance record
+type InstanceChange struct {
+	Version int64
+	Action  string
+	Actor   string
+	Time    time.Time
+}
+
+//Redact return a copy of the instance hiding secret values
+func (i *Instance) Redact() *Instance {
+	redacted := *i
+	if len(i.Secrets) > 0 {
+		redacted.Secrets = make(map[string]string)
+		for key := range i.Secrets {
+			redacted.Secrets[key] = RedactedValue
+		}
+	}
+	return &redacted
+}
+
+//MatchLabels check if the instance has all the selector labels
+func (i *Instance) MatchLabels(selector map[string]string) bool {
+	for key, value := range selector {
+		if current, ok := i.Labels[key]; !ok || current != value {
+			return false
+		}
+	}
+	return true
+}
+
+//GetVersion return the resource version
+func (i *Instance) GetVersion() int64 {
+	return i.Version
+}
+
+//SetVersion set the resource version
+func (i *Instance) SetVersion(version int64) {
+	i.Version = version
+}
+
+//Touch record a change to the instance, keeping the latest MaxInstanceHistory entries
+func (i *Instance) Touch(actor, action string) {
+	i.Updated = time.Now()
+	i.UpdatedBy = actor
+
+	history := append([]InstanceChange{}, i.History...)
+	history = append(history, InstanceChange{
+		Version: i.Version + 1,
+		Action:  action,
+		Actor:   actor,
+		Time:    i.Updated,
+	})
+	if len(history) > MaxInstanceHistory {
+		history = history[len(history)-MaxInstanceHistory:]
+	}
+	i.History = history
+}
+
+//Copy return a new stopped instance named name with the same settings
+func (i *Instance) Copy(name string) (*Instance, error) {
+
+	// a JSON roundtrip deep copies maps and nested settings
+	raw, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewInstance(name)
+	created := c.Created
+	err = json.Unmarshal(raw, c)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Name = name
+	c.ID = ""
+	c.Created = created
+	c.Status = InstanceStopped
+	c.IP = ""
+	c.Address = ""
+	c.Node = ""
+	c.Version = 0
+	c.Updated = time.Time{}
+	c.UpdatedBy = ""
+	c.History = nil
+
+	return c, nil
 }
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// Lease grants a replica exclusive ownership of a task until it expires
+type Lease struct {
+	Name    string
+	Holder  string
+	Expires time.Time
+	Version int64
+}
+
+//GetVersion return the resource version
+func (l *Lease) GetVersion() int64 {
+	return l.Version
+}
+
+//SetVersion set the resource version
+func (l *Lease) SetVersion(version int64) {
+	l.Version = version
+}
@@ -0,0 +1,46 @@
+package model
+
+// NodeConfig describe a docker engine instances can be scheduled on
+type NodeConfig struct {
+	Name string
+	// Host is the docker endpoint, eg. tcp://10.0.0.2:2376. Empty uses the environment
+	Host string
+	// Address is the host reachable by redzilla to proxy instances, if empty
+	// the container IP on Network is used
+	Address   string
+	TLSCACert string
+	TLSCert   string
+	TLSKey    string
+	TLSVerify bool
+	Labels    map[string]string
+	// Capacity is the max number of instances, 0 means unlimited
+	Capacity int
+}
+
+// Node is the stored state of a node
+type Node struct {
+	Name     string
+	Draining bool
+	Version  int64
+}
+
+//GetVersion return the resource version
+func (n *Node) GetVersion() int64 {
+	return n.Version
+}
+
+//SetVersion set the resource version
+func (n *Node) SetVersion(version int64) {
+	n.Version = version
+}
+
+// NodeStatus report a node configuration and usage
+type NodeStatus struct {
+	Name      string
+	Address   string
+	Labels    map[string]string
+	Capacity  int
+	Instances int
+	Draining  bool
+	Reachable bool
+}
@@ -0,0 +1,10 @@
+package model
+
+import "time"
+
+// Redirect sends requests for a former instance name to its new name
+type Redirect struct {
+	Name    string
+	Target  string
+	Expires time.Time
+}
@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// Secret is a named value stored encrypted by redzilla
+type Secret struct {
+	Name        string
+	Description string
+	// Value is encrypted at rest and never returned by the API
+	Value     string
+	Version   int64
+	Updated   time.Time
+	UpdatedBy string
+}
+
+//GetVersion return the resource version
+func (s *Secret) GetVersion() int64 {
+	return s.Version
+}
+
+//SetVersion set the resource version
+func (s *Secret) SetVersion(version int64) {
+	s.Version = version
+}
+
+//Redact return a copy of the secret hiding the value
+func (s *Secret) Redact() *Secret {
+	redacted := *s
+	redacted.Value = RedactedValue
+	return &redacted
+}
+
+// SecretRef inject a stored secret into an instance container, either as
+// an env variable or as a read-only file in /run/secrets
+type SecretRef struct {
+	Secret string
+	Env    string `json:",omitempty"`
+	File   string `json:",omitempty"`
+}
@@ -0,0 +1,35 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Template is a blueprint to provision new instances
+type Template struct {
+	Name        string
+	Description string
+	// Flows is written to flows.json
+	Flows json.RawMessage
+	// Settings is written to settings.js
+	Settings string
+	// Package is written to package.json, its dependencies are installed
+	// before the first start
+	Package   json.RawMessage
+	Env       map[string]string
+	Image     string
+	Resources InstanceResources
+	Version   int64
+	Updated   time.Time
+	UpdatedBy string
+}
+
+//GetVersion return the resource version
+func (t *Template) GetVersion() int64 {
+	return t.Version
+}
+
+//SetVersion set the resource version
+func (t *Template) SetVersion(version int64) {
+	t.Version = version
+}
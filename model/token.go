@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+const (
+	//ScopeRead allow reading instances and other resources
+	ScopeRead = "read"
+	//ScopeLifecycle allow creating and changing instances, implies read
+	ScopeLifecycle = "lifecycle"
+	//ScopeAdmin allow everything
+	ScopeAdmin = "admin"
+)
+
+// Token is an API token issued by redzilla, only its hash is stored
+type Token struct {
+	ID   string
+	Name string
+	// Principal the token acts as
+	Principal string
+	Scopes    []string
+	// Instances restricts the token to these instances, empty is all
+	Instances []string `json:",omitempty"`
+	// Expires is zero for tokens not expiring
+	Expires   time.Time
+	Hash      string `json:",omitempty"`
+	Created   time.Time
+	CreatedBy string
+}
+
+//Redact return a copy of the token without its hash
+func (t *Token) Redact() *Token {
+	redacted := *t
+	redacted.Hash = ""
+	return &redacted
+}
+
+//Expired check if the token is no longer valid
+func (t *Token) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+const (
+	//QuotaWarn log and audit instances over quota
+	QuotaWarn = "warn"
+	//QuotaBlock refuse to start instances over quota
+	QuotaBlock = "block"
+	//QuotaStop stop running instances over quota and refuse to start them
+	QuotaStop = "stop"
+)
+
+// Usage reports the disk space used by an instance
+type Usage struct {
+	Instance string
+	// Data is the size of the data directory, log excluded
+	Data int64
+	Log  int64
+	// Quota is the limit applied to Data and Log, zero means unlimited
+	Quota    int64
+	Exceeded bool
+	Updated  time.Time
+}
+
+//Total return the space used
+func (u *Usage) Total() int64 {
+	return u.Data + u.Log
+}
@@ -0,0 +1,238 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// leeway tolerate clock skew with the provider
+const leeway = time.Minute
+
+//ErrInvalidToken is returned for malformed tokens
+var ErrInvalidToken = errors.New("Invalid token")
+
+// header is the JOSE header of a token
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+//Claims are the token claims
+type Claims map[string]interface{}
+
+//String return a string claim, empty if missing
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+//Strings return a claim as list of strings, like groups
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// time return a numeric date claim
+func (c Claims) time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// validate check issuer, audience and validity period
+func (c Claims) validate(issuer, audience string, now time.Time) error {
+
+	if strings.TrimSuffix(c.String("iss"), "/") != issuer {
+		return errors.New("Invalid issuer")
+	}
+
+	audienceOk := false
+	for _, aud := range c.Strings("aud") {
+		if aud == audience {
+			audienceOk = true
+			break
+		}
+	}
+	if !audienceOk {
+		return errors.New("Invalid audience")
+	}
+
+	exp, ok := c.time("exp")
+	if !ok || now.After(exp.Add(leeway)) {
+		return errors.New("Token expired")
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return errors.New("Token not yet valid")
+	}
+
+	return nil
+}
+
+// parseJWT decode a compact JWT without verifying it
+func parseJWT(token string) (*header, Claims, []byte, []byte, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+	h := new(header)
+	err = json.Unmarshal(rawHeader, h)
+	if err != nil {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+	claims := Claims{}
+	err = json.Unmarshal(rawClaims, &claims)
+	if err != nil {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, nil, ErrInvalidToken
+	}
+
+	return h, claims, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+// verifySignature check the token signature, only asymmetric algorithms
+// are accepted
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported algorithm %s", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("Algorithm does not match key")
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errors.New("Algorithm does not match key")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("Invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+
+	return errors.New("Unsupported key")
+}
+
+// jwk is a JSON web key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwks is a JSON web key set
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// publicKey decode RSA and EC keys
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
@@ -0,0 +1,294 @@
+package oidc
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// keysTTL is how long fetched signing keys are used before a refresh
+const keysTTL = time.Hour
+
+// keysMinRefresh limit refreshes triggered by unknown key ids or expired
+// keys, and retries of a failed discovery
+const keysMinRefresh = 30 * time.Second
+
+//ErrUnknownKey is returned when no signing key matches the token
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+// discovery is the subset of the OpenID provider metadata in use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+//Provider validate tokens issued by an OpenID Connect provider and run the
+//authorization code flow. Metadata is discovered on first use
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu           sync.Mutex
+	meta         *discovery
+	discovered   time.Time
+	discoveryErr error
+	discovering  chan struct{}
+	keys         map[string]crypto.PublicKey
+	fetched      time.Time
+	attempts     time.Time
+}
+
+//NewProvider create a provider for the issuer URL and client credentials
+func NewProvider(issuer, clientID, clientSecret string) *Provider {
+	return &Provider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		keys:         make(map[string]crypto.PublicKey),
+	}
+}
+
+// getJSON fetch a JSON document
+func (p *Provider) getJSON(uri string, v interface{}) error {
+	resp, err := p.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request to %s failed with code %d", uri, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// metadata return the provider metadata, discovering it if needed. The
+// discovery is fetched without holding the lock, concurrent callers wait
+// for it, and a failed one is retried at most once per keysMinRefresh
+func (p *Provider) metadata() (*discovery, error) {
+	p.mu.Lock()
+	if p.meta == nil && p.discovering != nil {
+		done := p.discovering
+		p.mu.Unlock()
+		<-done
+		p.mu.Lock()
+	}
+	if p.meta != nil || time.Since(p.discovered) <= keysMinRefresh {
+		defer p.mu.Unlock()
+		if p.meta == nil {
+			return nil, p.discoveryErr
+		}
+		return p.meta, nil
+	}
+	done := make(chan struct{})
+	p.discovering = done
+	p.discovered = time.Now()
+	p.mu.Unlock()
+
+	meta, err := p.discover()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta, p.discoveryErr = meta, err
+	p.discovering = nil
+	close(done)
+	return meta, err
+}
+
+// discover fetch the provider metadata
+func (p *Provider) discover() (*discovery, error) {
+	meta := new(discovery)
+	err := p.getJSON(p.issuer+"/.well-known/openid-configuration", meta)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("Issuer mismatch in discovery: %s", meta.Issuer)
+	}
+	return meta, nil
+}
+
+// fetchKeys fetch the provider key set
+func (p *Provider) fetchKeys(jwksURI string) (map[string]crypto.PublicKey, error) {
+
+	set := jwks{}
+	err := p.getJSON(jwksURI, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logrus.Debugf("Skipping key %s: %s", k.Kid, err.Error())
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	logrus.Debugf("Loaded %d signing keys from %s", len(keys), jwksURI)
+
+	return keys, nil
+}
+
+// key return the signing key by id, refreshing the key set when expired or
+// when the id is unknown, as after a key rotation. The key set is fetched
+// without holding the lock, at most once per keysMinRefresh
+func (p *Provider) key(kid string) (crypto.PublicKey, error) {
+
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	if ok && time.Since(p.fetched) <= keysTTL {
+		p.mu.Unlock()
+		return key, nil
+	}
+	refresh := time.Since(p.attempts) > keysMinRefresh
+	if refresh {
+		p.attempts = time.Now()
+	}
+	p.mu.Unlock()
+
+	if refresh {
+		keys, err := p.fetchKeys(meta.JWKSURI)
+		if err != nil {
+			// keep using cached keys if the provider is unreachable
+			logrus.Warnf("Failed to refresh signing keys: %s", err.Error())
+		} else {
+			p.mu.Lock()
+			p.keys = keys
+			p.fetched = time.Now()
+			p.mu.Unlock()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+//Verify check signature and claims of an ID or access token issued to the
+//client. If nonce is not empty it must match the token nonce
+func (p *Provider) Verify(token, nonce string) (Claims, error) {
+
+	header, claims, signed, signature, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Alg, key, signed, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	err = claims.validate(p.issuer, p.clientID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) > 0 && claims.String("nonce") != nonce {
+		return nil, errors.New("Invalid nonce")
+	}
+
+	return claims, nil
+}
+
+//AuthCodeURL return the provider URL to start a browser login
+func (p *Provider) AuthCodeURL(redirectURI, state, nonce string, scopes []string) (string, error) {
+
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return meta.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+//Exchange trade an authorization code for the ID token
+func (p *Provider) Exchange(code, redirectURI string) (string, error) {
+
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.clientID)
+	form.Set("client_secret", p.clientSecret)
+
+	resp, err := p.client.PostForm(meta.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token request failed with code %d: %s", resp.StatusCode, string(body))
+	}
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens.IDToken) == 0 {
+		return "", errors.New("Token response without id_token")
+	}
+
+	return tokens.IDToken, nil
+}
@@ -0,0 +1,228 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a stand-in OpenID provider serving discovery and keys
+type testIssuer struct {
+	server  *httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer.server.URL,
+				"authorization_endpoint": issuer.server.URL + "/authorize",
+				"token_endpoint":         issuer.server.URL + "/token",
+				"jwks_uri":               issuer.server.URL + "/keys",
+			})
+		case "/keys":
+			issuer.mu.Lock()
+			defer issuer.mu.Unlock()
+			issuer.fetches++
+			keys := make([]map[string]string, 0)
+			for kid, key := range issuer.keys {
+				keys = append(keys, map[string]string{
+					"kty": "RSA",
+					"kid": kid,
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return issuer
+}
+
+func (i *testIssuer) addKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mu.Lock()
+	i.keys[kid] = key
+	i.mu.Unlock()
+}
+
+func (i *testIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	i.mu.Lock()
+	key := i.keys[kid]
+	i.mu.Unlock()
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (i *testIssuer) claims(aud string, exp time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   i.server.URL,
+		"aud":   aud,
+		"sub":   "user-1",
+		"email": "user@example.com",
+		"exp":   exp.Unix(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+	issuer.addKey(t, "key-1")
+
+	p := NewProvider(issuer.server.URL, "redzilla", "secret")
+
+	token := issuer.sign(t, "key-1", issuer.claims("redzilla", time.Now().Add(time.Hour)))
+	claims, err := p.Verify(token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.String("email") != "user@example.com" {
+		t.Fatalf("Unexpected claims %v", claims)
+	}
+
+	token = issuer.sign(t, "key-1", issuer.claims("other-client", time.Now().Add(time.Hour)))
+	if _, err = p.Verify(token, ""); err == nil {
+		t.Fatal("Token for another audience should be refused")
+	}
+
+	token = issuer.sign(t, "key-1", issuer.claims("redzilla", time.Now().Add(-time.Hour)))
+	if _, err = p.Verify(token, ""); err == nil {
+		t.Fatal("Expired token should be refused")
+	}
+
+	valid := issuer.sign(t, "key-1", issuer.claims("redzilla", time.Now().Add(time.Hour)))
+	if _, err = p.Verify(valid[:len(valid)-4]+"AAAA", ""); err == nil {
+		t.Fatal("Tampered token should be refused")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+	issuer.addKey(t, "key-1")
+
+	p := NewProvider(issuer.server.URL, "redzilla", "secret")
+
+	token := issuer.sign(t, "key-1", issuer.claims("redzilla", time.Now().Add(time.Hour)))
+	if _, err := p.Verify(token, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider rotates to a new key, fetched on first use
+	issuer.addKey(t, "key-2")
+	p.attempts = time.Time{}
+
+	token = issuer.sign(t, "key-2", issuer.claims("redzilla", time.Now().Add(time.Hour)))
+	if _, err := p.Verify(token, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredKeysRefresh(t *testing.T) {
+
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+	issuer.addKey(t, "key-1")
+
+	p := NewProvider(issuer.server.URL, "redzilla", "secret")
+
+	token := issuer.sign(t, "key-1", issuer.claims("redzilla", time.Now().Add(time.Hour)))
+	if _, err := p.Verify(token, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := func() int {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		return issuer.fetches
+	}
+
+	// expired keys are used as is after a recent refresh attempt
+	p.fetched = time.Now().Add(-2 * keysTTL)
+	p.attempts = time.Now()
+	if _, err := p.Verify(token, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fetches() != 1 {
+		t.Fatalf("Keys should not be fetched within keysMinRefresh, got %d fetches", fetches())
+	}
+
+	p.attempts = time.Time{}
+	if _, err := p.Verify(token, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fetches() != 2 {
+		t.Fatalf("Expired keys should be refreshed, got %d fetches", fetches())
+	}
+}
+
+func TestDiscoveryRetry(t *testing.T) {
+
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	p := NewProvider(server.URL, "redzilla", "secret")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.metadata(); err == nil {
+				t.Error("Failed discovery should return an error")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := p.metadata(); err == nil {
+		t.Fatal("Failed discovery should be reported until retried")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Fatalf("Discovery should be fetched once within keysMinRefresh, got %d requests", requests)
+	}
+}
@@ -0,0 +1,236 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+// encryptedPrefix mark values encrypted by a Cipher
+const encryptedPrefix = "enc:v1:"
+
+//ErrNoKey is returned when no secret key is configured
+var ErrNoKey = errors.New("Secret key not configured")
+
+//ErrInvalidValue is returned for values not encrypted by a Cipher
+var ErrInvalidValue = errors.New("Invalid encrypted value")
+
+//ErrKeyMismatch is returned when a value was encrypted with another key
+var ErrKeyMismatch = errors.New("Value encrypted with another key")
+
+var defaultCipher *Cipher
+var defaultCipherMutex sync.Mutex
+
+//Cipher encrypt values with AES-GCM using a key derived from the secret key.
+//Previous keys are kept to decrypt values until they are rotated
+type Cipher struct {
+	aead cipher.AEAD
+	id   string
+	keys map[string]cipher.AEAD
+}
+
+// newAEAD derive an AES-GCM key and its id from the key material
+func newAEAD(material []byte) (cipher.AEAD, string, error) {
+
+	key := sha256.Sum256(material)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, "", err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the key id tells which key encrypted a value, not the key itself
+	sum := sha256.Sum256(key[:])
+
+	return aead, hex.EncodeToString(sum[:])[:8], nil
+}
+
+//NewCipher create a cipher from the key material, of any length. Values
+//encrypted with the old keys can still be decrypted
+func NewCipher(material []byte, old ...[]byte) (*Cipher, error) {
+
+	if len(material) == 0 {
+		return nil, ErrNoKey
+	}
+
+	aead, id, err := newAEAD(material)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cipher{
+		aead: aead,
+		id:   id,
+		keys: map[string]cipher.AEAD{id: aead},
+	}
+
+	for _, key := range old {
+		if len(key) == 0 {
+			continue
+		}
+		oldAEAD, oldID, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.keys[oldID]; !ok {
+			c.keys[oldID] = oldAEAD
+		}
+	}
+
+	return c, nil
+}
+
+//LoadKey read the secret key from SecretKeyFile or SecretKey
+func LoadKey(cfg *model.Config) ([]byte, error) {
+
+	if len(cfg.SecretKeyFile) > 0 {
+		raw, err := ioutil.ReadFile(cfg.SecretKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSpace(string(raw))
+		if len(key) == 0 {
+			return nil, ErrNoKey
+		}
+		return []byte(key), nil
+	}
+
+	if len(cfg.SecretKey) == 0 {
+		return nil, ErrNoKey
+	}
+
+	return []byte(cfg.SecretKey), nil
+}
+
+//GetCipher return the cipher for the configured secret key
+func GetCipher(cfg *model.Config) (*Cipher, error) {
+	defaultCipherMutex.Lock()
+	defer defaultCipherMutex.Unlock()
+
+	if defaultCipher != nil {
+		return defaultCipher, nil
+	}
+
+	key, err := LoadKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	old := make([][]byte, 0, len(cfg.SecretOldKeys))
+	for _, oldKey := range cfg.SecretOldKeys {
+		old = append(old, []byte(oldKey))
+	}
+
+	c, err := NewCipher(key, old...)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultCipher = c
+	return defaultCipher, nil
+}
+
+//IsEncrypted check if the value has been encrypted by a Cipher
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+//KeyID return the identifier of the key
+func (c *Cipher) KeyID() string {
+	return c.id
+}
+
+//Encrypt encrypt a value, the result is text safe
+func (c *Cipher) Encrypt(plain string) (string, error) {
+
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plain), []byte(c.id))
+
+	return encryptedPrefix + c.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// split return the key id and sealed content of an encrypted value
+func split(value string) (string, []byte, error) {
+
+	if !IsEncrypted(value) {
+		return "", nil, ErrInvalidValue
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", nil, ErrInvalidValue
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, ErrInvalidValue
+	}
+
+	return parts[0], sealed, nil
+}
+
+//Decrypt decrypt a value returned by Encrypt with the current or an old key
+func (c *Cipher) Decrypt(value string) (string, error) {
+
+	id, sealed, err := split(value)
+	if err != nil {
+		return "", err
+	}
+
+	aead, ok := c.keys[id]
+	if !ok {
+		return "", ErrKeyMismatch
+	}
+
+	size := aead.NonceSize()
+	if len(sealed) < size {
+		return "", ErrInvalidValue
+	}
+
+	plain, err := aead.Open(nil, sealed[:size], sealed[size:], []byte(id))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+//NeedsRotation check if the value was encrypted with an old key
+func (c *Cipher) NeedsRotation(value string) bool {
+	id, _, err := split(value)
+	return err == nil && id != c.id
+}
+
+//Rotate encrypt again with the current key a value encrypted with an old key
+func (c *Cipher) Rotate(value string) (string, error) {
+
+	if !c.NeedsRotation(value) {
+		return value, nil
+	}
+
+	plain, err := c.Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Encrypt(plain)
+}
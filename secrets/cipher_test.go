@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+
+	c, err := NewCipher([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := c.Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(value) {
+		t.Fatalf("Value not marked as encrypted: %s", value)
+	}
+
+	plain, err := c.Decrypt(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != "s3cr3t" {
+		t.Fatalf("Unexpected value %s", plain)
+	}
+
+	other, err := NewCipher([]byte("other-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Decrypt(value); err != ErrKeyMismatch {
+		t.Fatalf("Expected key mismatch, got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+
+	old, err := NewCipher([]byte("old-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := old.Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCipher([]byte("new-key"), []byte("old-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.NeedsRotation(value) {
+		t.Fatal("Value encrypted with the old key should need rotation")
+	}
+
+	rotated, err := c.Rotate(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.NeedsRotation(rotated) {
+		t.Fatal("Rotated value should use the current key")
+	}
+
+	plain, err := c.Decrypt(rotated)
+	if err != nil || plain != "s3cr3t" {
+		t.Fatalf("Unexpected value %s: %v", plain, err)
+	}
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"time"
+
+	"github.com/ansriaz/redzilla/api"
+	"github.com/ansriaz/redzilla/cluster"
+	"github.com/ansriaz/redzilla/model"
+	"github.com/sirupsen/logrus"
+)
+
+// scheduleBackups run periodic backups of all instances on the leader
+func scheduleBackups(cfg *model.Config) {
+
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+
+	logrus.Infof("Scheduling backups every %s, keeping %d", cfg.BackupInterval, cfg.BackupRetention)
+
+	go func() {
+		ticker := time.NewTicker(cfg.BackupInterval)
+		for range ticker.C {
+			if !cluster.IsLeader() {
+				continue
+			}
+			api.BackupAll(cfg)
+		}
+	}()
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"time"
+
+	"github.com/ansriaz/redzilla/certs"
+	"github.com/ansriaz/redzilla/cluster"
+	"github.com/ansriaz/redzilla/model"
+	"github.com/sirupsen/logrus"
+)
+
+// renewInterval is how often stored certificates are checked for renewal
+const renewInterval = time.Hour
+
+// scheduleRenewal renew ACME certificates on the leader
+func scheduleRenewal(cfg *model.Config) {
+
+	if cfg.TLSMode != model.TLSACME {
+		return
+	}
+
+	manager, err := certs.GetManager(cfg)
+	if err != nil {
+		logrus.Errorf("Certificates will not be renewed: %s", err.Error())
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(renewInterval)
+		for range ticker.C {
+			if !cluster.IsLeader() {
+				continue
+			}
+			manager.Renew()
+		}
+	}()
+}
@@ -2,20 +2,38 @@ package service
 
 import (
 	"github.com/ansriaz/redzilla/api"
+	"github.com/ansriaz/redzilla/cluster"
 	"github.com/ansriaz/redzilla/docker"
 	"github.com/ansriaz/redzilla/model"
+	"github.com/ansriaz/redzilla/storage"
 	"github.com/sirupsen/logrus"
 )
 
 // Start the service
 func Start(cfg *model.Config) error {
 
+	// the leader resumes the log pipes of running instances
+	cluster.OnElected(func() {
+		api.ResyncInstances(cfg)
+	})
+	cluster.StartElection(cfg)
+
+	api.SyncInstances(cfg)
+	scheduleBackups(cfg)
+	scheduleUsage(cfg)
+	scheduleRenewal(cfg)
+
 	msg := docker.ListenEvents(cfg)
 	go func() {
 		for {
 			select {
 			case ev := <-msg:
 
+				// events are handled by the leader replica only
+				if !cluster.IsLeader() {
+					continue
+				}
+
 				instance := api.GetInstance(ev.Name, cfg)
 
 				exists, err := instance.Exists()
@@ -28,6 +46,13 @@ func Start(cfg *model.Config) error {
 					continue
 				}
 
+				// ignore leftovers of an instance moved to another node
+				node := instance.GetStatus().Node
+				if len(node) > 0 && node != ev.Node {
+					logrus.Debugf("Ignoring %s event for %s on %s", ev.Action, ev.Name, ev.Node)
+					continue
+				}
+
 				switch ev.Action {
 				case "die":
 					logrus.Warnf("Container exited %s", ev.Name)
@@ -40,6 +65,8 @@ func Start(cfg *model.Config) error {
 						logrus.Warnf("Failed to reset detail for %s: %s", instance.GetStatus().Name, rerr.Error())
 					}
 
+					saveStatus(instance, "container.die")
+
 					break
 				case "start":
 					err = instance.StartLogsPipe()
@@ -51,6 +78,8 @@ func Start(cfg *model.Config) error {
 					instance.GetIP()
 					instance.GetStatus().Status = model.InstanceStarted
 
+					saveStatus(instance, "container.start")
+
 					break
 				default:
 					logrus.Infof("Container %s %s", ev.Action, ev.Name)
@@ -70,6 +99,21 @@ func Start(cfg *model.Config) error {
 	return nil
 }
 
+// saveStatus persist the runtime status so other replicas can pick it up
+func saveStatus(instance *api.Instance, action string) {
+
+	status := instance.GetStatus().Status
+	err := instance.Save(api.SystemPrincipal, action)
+	if err == storage.ErrConflict {
+		// the record has been reloaded, retry once with the known status
+		instance.GetStatus().Status = status
+		err = instance.Save(api.SystemPrincipal, action)
+	}
+	if err != nil {
+		logrus.Warnf("Failed to save status of %s: %s", instance.GetStatus().Name, err.Error())
+	}
+}
+
 // Stop the service
 func Stop(cfg *model.Config) {
 
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"time"
+
+	"github.com/ansriaz/redzilla/api"
+	"github.com/ansriaz/redzilla/cluster"
+	"github.com/ansriaz/redzilla/model"
+	"github.com/sirupsen/logrus"
+)
+
+// scheduleUsage measure instances disk usage periodically on the leader
+func scheduleUsage(cfg *model.Config) {
+
+	if cfg.UsageInterval <= 0 {
+		return
+	}
+
+	logrus.Infof("Checking disk usage every %s", cfg.UsageInterval)
+
+	go func() {
+		ticker := time.NewTicker(cfg.UsageInterval)
+		for range ticker.C {
+			if !cluster.IsLeader() {
+				continue
+			}
+			api.CheckUsage(cfg)
+		}
+	}()
+}
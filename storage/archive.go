@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveDir write a tar.gz of dir content to w. Paths for which skip
+// return true are left out, directories skipped with all their content
+func ArchiveDir(dir string, w io.Writer, skip func(path string, info os.FileInfo) bool) error {
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		if skip != nil && skip(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// ExtractArchive unpack a tar.gz created by ArchiveDir into dir
+func ExtractArchive(r io.Reader, dir string) error {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	err = CreateDir(dir)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	// links extracted so far, entries and link targets may not go through
+	// them or the real path could end outside of root
+	links := map[string]bool{}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, ok := resolvePath(root, root, header.Name, links)
+		if !ok || links[target] {
+			return fmt.Errorf("Invalid path in archive `%s`", header.Name)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+		case tar.TypeSymlink:
+			// links may only point inside the archive, or later entries
+			// could be written through them
+			_, ok = resolvePath(root, filepath.Dir(target), header.Linkname, links)
+			if filepath.IsAbs(header.Linkname) || !ok {
+				return fmt.Errorf("Invalid link in archive `%s` -> `%s`", header.Name, header.Linkname)
+			}
+			err = CreateDir(filepath.Dir(target))
+			if err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+			links[target] = true
+		case tar.TypeReg:
+			err = extractFile(tr, target, mode)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resolvePath walk name from base one element at a time, as the
+// filesystem would. It fails when the path leaves root or goes through
+// one of links, whose real target is not known lexically
+func resolvePath(root, base, name string, links map[string]bool) (string, bool) {
+	path := base
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if links[path] {
+			return "", false
+		}
+		switch part {
+		case "", ".":
+		case "..":
+			if path == root {
+				return "", false
+			}
+			path = filepath.Dir(path)
+		default:
+			path = filepath.Join(path, part)
+		}
+	}
+	return path, path == root || strings.HasPrefix(path, root+string(os.PathSeparator))
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+
+	err := CreateDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
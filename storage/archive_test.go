@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveRoundtrip(t *testing.T) {
+
+	src, err := ioutil.TempDir("", "redzilla-archive-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dst, err := ioutil.TempDir("", "redzilla-archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	CreateDir(filepath.Join(src, "lib", "flows"))
+	ioutil.WriteFile(filepath.Join(src, "flows.json"), []byte("[]"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "lib", "flows", "a.json"), []byte("{}"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "instance.log"), []byte("log"), 0644)
+
+	var buf bytes.Buffer
+	err = ArchiveDir(src, &buf, func(path string, info os.FileInfo) bool {
+		return path == "instance.log"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ExtractArchive(&buf, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "lib", "flows", "a.json"))
+	if err != nil || string(content) != "{}" {
+		t.Fatalf("Unexpected content %s (%v)", content, err)
+	}
+
+	exists, _ := PathExists(filepath.Join(dst, "instance.log"))
+	if exists {
+		t.Fatal("Skipped file has been archived")
+	}
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+
+	// archive of symlinks given as name, link pairs, an empty link is
+	// added as a regular file
+	archive := func(entries ...string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for i := 0; i < len(entries); i += 2 {
+			if len(entries[i+1]) == 0 {
+				tw.WriteHeader(&tar.Header{Name: entries[i], Typeflag: tar.TypeReg, Mode: 0644})
+				continue
+			}
+			tw.WriteHeader(&tar.Header{Name: entries[i], Linkname: entries[i+1], Typeflag: tar.TypeSymlink, Mode: 0777})
+		}
+		tw.Close()
+		gz.Close()
+		return &buf
+	}
+
+	dst, err := ioutil.TempDir("", "redzilla-archive-links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = ExtractArchive(archive("lib/flows.json", "../flows.json"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, link := range []string{"/etc/passwd", "../../etc", "lib/../../.."} {
+		err = ExtractArchive(archive("escape", link), dst)
+		if err == nil {
+			t.Fatalf("Link to %s should be refused", link)
+		}
+	}
+
+	chains := [][]string{
+		{"s", ".", "s/t", "..", "s/t/x", ""},
+		{"a", ".", "b", "a/..", "b/x", ""},
+		{"c", "lib", "c", ""},
+	}
+	for _, entries := range chains {
+		dst, err := ioutil.TempDir("", "redzilla-archive-chain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		err = ExtractArchive(archive(entries...), dst)
+		if err == nil {
+			t.Fatalf("Archive %v should be refused", entries)
+		}
+	}
+}
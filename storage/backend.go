@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+//Backend persists JSON records grouped by collection. Multiple redzilla
+//replicas share state by pointing to the same backend
+type Backend interface {
+	Write(collection, id string, record interface{}) error
+	// Read a record, returning an error matching os.IsNotExist if missing
+	Read(collection, id string, result interface{}) error
+	ReadAll(collection string) ([]string, error)
+	Delete(collection, id string) error
+	// Lock a record across processes, the returned function releases the lock
+	Lock(collection, id string, timeout time.Duration) (func(), error)
+}
+
+//BackendFactory create a backend from the configuration
+type BackendFactory func(cfg *model.Config) (Backend, error)
+
+var backendsMutex sync.Mutex
+var backends = map[string]BackendFactory{
+	"file":  newFileBackend,
+	"redis": newRedisBackend,
+}
+
+//RegisterBackend add a store backend selectable with the StoreType option
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	backends[strings.ToLower(name)] = factory
+}
+
+//NewBackend create the backend configured by StoreType
+func NewBackend(cfg *model.Config) (Backend, error) {
+
+	storeType := strings.ToLower(cfg.StoreType)
+	if len(storeType) == 0 {
+		storeType = "file"
+	}
+
+	backendsMutex.Lock()
+	factory, ok := backends[storeType]
+	backendsMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown store type `%s`", cfg.StoreType)
+	}
+
+	return factory(cfg)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+	"github.com/nanobox-io/golang-scribble"
+)
+
+// fileBackend store records as JSON files. Replicas on the same machine
+// (or sharing the directory) coordinate with lock files
+type fileBackend struct {
+	path string
+	db   *scribble.Driver
+}
+
+func newFileBackend(cfg *model.Config) (Backend, error) {
+	return NewFileBackend(cfg.StorePath)
+}
+
+//NewFileBackend create a backend storing files at path
+func NewFileBackend(path string) (Backend, error) {
+
+	// create a new scribble database, providing a destination for the database to live
+	db, err := scribble.New(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileBackend{
+		path: path,
+		db:   db,
+	}, nil
+}
+
+func (f *fileBackend) Write(collection, id string, record interface{}) error {
+	return f.db.Write(collection, id, record)
+}
+
+func (f *fileBackend) Read(collection, id string, result interface{}) error {
+	return f.db.Read(collection, id, result)
+}
+
+func (f *fileBackend) ReadAll(collection string) ([]string, error) {
+	err := CreateDir(filepath.Join(f.path, collection))
+	if err != nil {
+		return nil, err
+	}
+	return f.db.ReadAll(collection)
+}
+
+func (f *fileBackend) Delete(collection, id string) error {
+	return f.db.Delete(collection, id)
+}
+
+func (f *fileBackend) Lock(collection, id string, timeout time.Duration) (func(), error) {
+	return LockFile(filepath.Join(f.path, ".locks", collection, id+".lock"), timeout)
+}
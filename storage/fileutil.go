@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/ansriaz/redzilla/model"
 )
@@ -53,6 +56,16 @@ func GetConfigPath(cfg *model.Config) string {
 	return path
 }
 
+// GetSecretsPath return the path where secret files of an instance are
+// written for the container
+func GetSecretsPath(name string, cfg *model.Config) string {
+	path, err := filepath.Abs(cfg.SecretsPath)
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Join(path, name)
+}
+
 // GetStorePath return the path where instance data is stored
 func GetStorePath(name string, cfg *model.Config) string {
 	path, err := filepath.Abs(cfg.StorePath)
@@ -61,3 +74,88 @@ func GetStorePath(name string, cfg *model.Config) string {
 	}
 	return filepath.Join(path, name)
 }
+
+// CopyDir copy the content of src into dst. Paths for which skip return
+// true are left out, directories skipped with all their content
+func CopyDir(src, dst string, skip func(path string, info os.FileInfo) bool) error {
+
+	err := CreateDir(dst)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		if skip != nil && skip(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			// a copied link pointing outside of src would give dst access
+			// to files of the host or of another instance. Dangling links
+			// lead nowhere and are left out
+			real, err := filepath.EvalSymlinks(path)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if filepath.IsAbs(link) || err != nil || (real != root && !strings.HasPrefix(real, root+string(os.PathSeparator))) {
+				return fmt.Errorf("Invalid link `%s` -> `%s`", rel, link)
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyDirLinks(t *testing.T) {
+
+	base, err := ioutil.TempDir("", "redzilla-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	src := filepath.Join(base, "src")
+	CreateDir(filepath.Join(src, "lib"))
+	ioutil.WriteFile(filepath.Join(src, "flows.json"), []byte("[]"), 0644)
+	os.Symlink("../flows.json", filepath.Join(src, "lib", "flows.json"))
+	os.Symlink("missing", filepath.Join(src, "dangling"))
+
+	dst := filepath.Join(base, "dst")
+	err = CopyDir(src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "lib", "flows.json"))
+	if err != nil || string(content) != "[]" {
+		t.Fatalf("Unexpected content %s (%v)", content, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "dangling")); err == nil {
+		t.Fatal("Dangling link should be left out")
+	}
+
+	for _, link := range []string{base, "..", "lib/../.."} {
+		os.Remove(filepath.Join(src, "escape"))
+		os.Symlink(link, filepath.Join(src, "escape"))
+		err = CopyDir(src, filepath.Join(base, "escape"), nil)
+		if err == nil {
+			t.Fatalf("Link to %s should be refused", link)
+		}
+	}
+}
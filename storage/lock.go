@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLockTimeout is returned when a lock cannot be acquired in time
+var ErrLockTimeout = errors.New("Timeout acquiring lock")
+
+// staleLock is the age after which a lock file is considered abandoned
+const staleLock = time.Second * 30
+
+// LockFile acquire an exclusive lock backed by a file, usable across processes.
+// The returned function releases the lock.
+func LockFile(path string, timeout time.Duration) (func(), error) {
+
+	err := CreateDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() {
+				os.Remove(path)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// remove locks left behind by a crashed process
+		info, serr := os.Stat(path)
+		if serr == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//AppendLog is an append-only log of JSON records, one per line
+type AppendLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+//NewAppendLog create a log writing at path
+func NewAppendLog(path string) (*AppendLog, error) {
+	err := CreateDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	return &AppendLog{path: path}, nil
+}
+
+//Append a record to the log
+func (l *AppendLog) Append(record interface{}) error {
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
+	return err
+}
+
+//Scan call fn for each record in the log, in insertion order
+func (l *AppendLog) Scan(fn func(line []byte) error) error {
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		err = fn(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
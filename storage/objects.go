@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+//ObjectInfo describe a stored object
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+//ObjectStore stores opaque blobs like backup archives
+type ObjectStore interface {
+	Put(key string, r io.Reader, size int64) error
+	// Get an object, returning an error matching os.IsNotExist if missing
+	Get(key string) (io.ReadCloser, error)
+	// List objects with key starting with prefix, sorted by key
+	List(prefix string) ([]ObjectInfo, error)
+	Delete(key string) error
+}
+
+//NewBackupStore create the object store configured for backups
+func NewBackupStore(cfg *model.Config) (ObjectStore, error) {
+	switch strings.ToLower(cfg.BackupTarget) {
+	case "", "local":
+		return NewLocalObjectStore(cfg.BackupPath)
+	case "s3":
+		return NewS3ObjectStore(cfg.BackupS3)
+	}
+	return nil, fmt.Errorf("Unknown backup target `%s`", cfg.BackupTarget)
+}
+
+// localObjectStore keep objects as files in a directory
+type localObjectStore struct {
+	path string
+}
+
+//NewLocalObjectStore create an object store in a local directory
+func NewLocalObjectStore(path string) (ObjectStore, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	err = CreateDir(abspath)
+	if err != nil {
+		return nil, err
+	}
+	return &localObjectStore{path: abspath}, nil
+}
+
+func (l *localObjectStore) file(key string) (string, error) {
+	target := filepath.Join(l.path, filepath.FromSlash(key))
+	if !strings.HasPrefix(target, l.path+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Invalid object key `%s`", key)
+	}
+	return target, nil
+}
+
+func (l *localObjectStore) Put(key string, r io.Reader, size int64) error {
+
+	target, err := l.file(key)
+	if err != nil {
+		return err
+	}
+
+	err = CreateDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	// write aside and rename, so readers never see partial objects
+	tmp := target + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, target)
+}
+
+func (l *localObjectStore) Get(key string) (io.ReadCloser, error) {
+	target, err := l.file(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(target)
+}
+
+func (l *localObjectStore) List(prefix string) ([]ObjectInfo, error) {
+
+	list := make([]ObjectInfo, 0)
+	err := filepath.Walk(l.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.path, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		list = append(list, ObjectInfo{
+			Key:      key,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+
+	return list, nil
+}
+
+func (l *localObjectStore) Delete(key string) error {
+	target, err := l.file(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(target)
+}
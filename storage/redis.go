@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+// redisUnlockScript delete a lock only if still owned
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisLockTTL expire locks held by crashed replicas
+const redisLockTTL = staleLock
+
+// redisBackend store each collection as a redis hash, for replicas running
+// on different machines. It speaks the plain RESP protocol over a single
+// connection
+type redisBackend struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisBackend(cfg *model.Config) (Backend, error) {
+	return NewRedisBackend(cfg.StoreURL)
+}
+
+//NewRedisBackend create a backend from an URL like redis://:password@host:6379/0
+func NewRedisBackend(rawURL string) (Backend, error) {
+
+	if len(rawURL) == 0 {
+		rawURL = "redis://localhost:6379/0"
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("Unsupported redis URL scheme `%s`", u.Scheme)
+	}
+
+	r := &redisBackend{
+		addr:   u.Host,
+		prefix: "redzilla:",
+	}
+	if !strings.Contains(r.addr, ":") {
+		r.addr += ":6379"
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); len(db) > 0 {
+		r.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redis database `%s`", db)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *redisBackend) key(collection string) string {
+	return r.prefix + collection
+}
+
+func (r *redisBackend) Write(collection, id string, record interface{}) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = r.do("HSET", r.key(collection), id, string(raw))
+	return err
+}
+
+func (r *redisBackend) Read(collection, id string, result interface{}) error {
+	res, err := r.do("HGET", r.key(collection), id)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return &os.PathError{Op: "read", Path: collection + "/" + id, Err: os.ErrNotExist}
+	}
+	return json.Unmarshal([]byte(res.(string)), result)
+}
+
+func (r *redisBackend) ReadAll(collection string) ([]string, error) {
+	res, err := r.do("HVALS", r.key(collection))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0)
+	for _, item := range res.([]interface{}) {
+		if str, ok := item.(string); ok {
+			list = append(list, str)
+		}
+	}
+	return list, nil
+}
+
+func (r *redisBackend) Delete(collection, id string) error {
+	_, err := r.do("HDEL", r.key(collection), id)
+	return err
+}
+
+func (r *redisBackend) Lock(collection, id string, timeout time.Duration) (func(), error) {
+
+	lockKey := r.prefix + "lock:" + collection + ":" + id
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+	ttl := strconv.FormatInt(int64(redisLockTTL/time.Millisecond), 10)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := r.do("SET", lockKey, token, "NX", "PX", ttl)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			// the reply of a SET applied by the server may have been lost
+			// before do retried it, the lock is then already ours
+			res, err = r.do("GET", lockKey)
+			if err != nil {
+				return nil, err
+			}
+			if owner, ok := res.(string); !ok || owner != token {
+				res = nil
+			}
+		}
+		if res != nil {
+			return func() {
+				r.do("EVAL", redisUnlockScript, "1", lockKey, token)
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+// do send a command, reconnecting once if the connection dropped. The
+// command may run twice when a reply is lost, commands must be idempotent
+func (r *redisBackend) do(args ...string) (interface{}, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for tries := 0; tries < 2; tries++ {
+
+		if r.conn == nil {
+			err = r.connect()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var res interface{}
+		res, err = r.roundtrip(args...)
+		if err == nil {
+			return res, nil
+		}
+		if _, ok := err.(redisError); ok {
+			return nil, err
+		}
+
+		// network failure, drop the connection and retry
+		r.conn.Close()
+		r.conn = nil
+	}
+
+	return nil, err
+}
+
+func (r *redisBackend) connect() error {
+
+	conn, err := net.DialTimeout("tcp", r.addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.rd = bufio.NewReader(conn)
+
+	if len(r.password) > 0 {
+		if _, err = r.roundtrip("AUTH", r.password); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	if r.db > 0 {
+		if _, err = r.roundtrip("SELECT", strconv.Itoa(r.db)); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *redisBackend) roundtrip(args ...string) (interface{}, error) {
+
+	r.conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	var cmd strings.Builder
+	cmd.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		cmd.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := r.conn.Write([]byte(cmd.String())); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(r.rd)
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRedisReply parse a RESP reply. Nil bulk strings and arrays return nil
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		list := make([]interface{}, size)
+		for i := 0; i < size; i++ {
+			list[i], err = readRedisReply(rd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply `%s`", line)
+}
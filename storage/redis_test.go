@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadRedisReply(t *testing.T) {
+
+	rd := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nfoo\r\n$-1\r\n:42\r\n"))
+	res, err := readRedisReply(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := res.([]interface{})
+	if len(list) != 3 || list[0] != "foo" || list[1] != nil || list[2] != int64(42) {
+		t.Fatalf("Unexpected reply %v", list)
+	}
+
+	rd = bufio.NewReader(strings.NewReader("-ERR wrong\r\n"))
+	_, err = readRedisReply(rd)
+	if _, ok := err.(redisError); !ok {
+		t.Fatalf("Expected redis error, got %v", err)
+	}
+}
+
+// lostReplyRedis serve SET NX and GET, dropping the connection instead of
+// replying to the first SET
+func lostReplyRedis(t *testing.T) net.Listener {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	values := map[string]string{}
+	dropped := false
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					req, err := readRedisReply(rd)
+					if err != nil {
+						return
+					}
+					args := req.([]interface{})
+
+					mu.Lock()
+					reply := "$-1\r\n"
+					switch args[0] {
+					case "SET":
+						key, value := args[1].(string), args[2].(string)
+						if _, ok := values[key]; !ok {
+							values[key] = value
+							reply = "+OK\r\n"
+						}
+						if !dropped {
+							dropped = true
+							mu.Unlock()
+							return
+						}
+					case "GET":
+						if value, ok := values[args[1].(string)]; ok {
+							reply = "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+						}
+					case "EVAL":
+						reply = ":1\r\n"
+					}
+					mu.Unlock()
+
+					conn.Write([]byte(reply))
+				}
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func TestRedisLockLostReply(t *testing.T) {
+
+	ln := lostReplyRedis(t)
+	defer ln.Close()
+
+	backend, err := NewRedisBackend("redis://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	unlock, err := backend.Lock("instances", "tenant", time.Second)
+	if err != nil {
+		t.Fatalf("Lock set before the lost reply should be acquired: %v", err)
+	}
+	unlock()
+
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("Lock should not wait for its own expiry")
+	}
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+// s3ObjectStore store objects in an S3 compatible bucket, signing requests
+// with AWS signature version 4
+type s3ObjectStore struct {
+	endpoint *url.URL
+	cfg      model.S3Config
+	client   *http.Client
+}
+
+//NewS3ObjectStore create an object store backed by an S3 compatible service
+func NewS3ObjectStore(cfg model.S3Config) (ObjectStore, error) {
+
+	if len(cfg.Endpoint) == 0 || len(cfg.Bucket) == 0 {
+		return nil, errors.New("S3 endpoint and bucket are required")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Region) == 0 {
+		cfg.Region = "us-east-1"
+	}
+
+	return &s3ObjectStore{
+		endpoint: endpoint,
+		cfg:      cfg,
+		client:   &http.Client{Timeout: time.Minute * 30},
+	}, nil
+}
+
+// objectURL return the URL of a key, or of the bucket if key is empty
+func (s *s3ObjectStore) objectURL(key string, query url.Values) *url.URL {
+
+	u := *s.endpoint
+	path := "/"
+	if len(key) > 0 {
+		path += s.cfg.Prefix + key
+	}
+
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = path
+	}
+	u.RawPath = encodePath(u.Path)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+
+	return &u
+}
+
+func (s *s3ObjectStore) do(method string, u *url.URL, body io.Reader, size int64) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: u.Path, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s failed with %d: %s", method, u.Path, resp.StatusCode, string(msg))
+	}
+
+	return resp, nil
+}
+
+func (s *s3ObjectStore) Put(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, s.objectURL(key, nil), r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3ObjectStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.objectURL(key, nil), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3ObjectStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, s.objectURL(key, nil), nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is the ListObjectsV2 response
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3ObjectStore) List(prefix string) ([]ObjectInfo, error) {
+
+	list := make([]ObjectInfo, 0)
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.cfg.Prefix+prefix)
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, s.objectURL("", query), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Contents {
+			list = append(list, ObjectInfo{
+				Key:      strings.TrimPrefix(item.Key, s.cfg.Prefix),
+				Size:     item.Size,
+				Modified: item.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+
+	return list, nil
+}
+
+// sign add an AWS signature v4 Authorization header. The payload is not
+// signed so that archives can be streamed
+func (s *s3ObjectStore) sign(req *http.Request, now time.Time) {
+
+	const payloadHash = "UNSIGNED-PAYLOAD"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		encodePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeURIComponent escape all characters but the unreserved ones, as
+// required by signature v4
+func encodeURIComponent(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func encodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = encodeURIComponent(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, encodeURIComponent(key)+"="+encodeURIComponent(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
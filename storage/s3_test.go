@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ansriaz/redzilla/model"
+)
+
+// fakeS3 is an in memory bucket answering the requests of the S3 store,
+// listing one key per page to exercise continuation
+type fakeS3 struct {
+	mutex   sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = body
+	case r.Method == http.MethodGet:
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+
+	prefix := r.URL.Query().Get("prefix")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string
+		Size int64
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > 0 {
+		result.Contents = []content{{Key: keys[0], Size: int64(len(f.objects[keys[0]]))}}
+		result.IsTruncated = len(keys) > 1
+		if result.IsTruncated {
+			result.NextContinuationToken = keys[0]
+		}
+	}
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3ObjectStore(t *testing.T) {
+
+	bucket := &fakeS3{bucket: "backups", objects: make(map[string][]byte)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	store, err := NewS3ObjectStore(model.S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "backups",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Prefix:    "redzilla/",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"tenant/2.tar.gz", "tenant/1.tar.gz", "other/1.tar.gz"} {
+		err = store.Put(key, strings.NewReader(key), int64(len(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := bucket.objects["redzilla/tenant/1.tar.gz"]; !ok {
+		t.Fatalf("Keys should be prefixed, got %v", bucket.objects)
+	}
+
+	list, err := store.List("tenant/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Key != "tenant/1.tar.gz" || list[1].Key != "tenant/2.tar.gz" || list[0].Size != 15 {
+		t.Fatalf("Unexpected list %+v", list)
+	}
+
+	r, err := store.Get("tenant/2.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "tenant/2.tar.gz" {
+		t.Fatalf("Unexpected content %s", content)
+	}
+
+	err = store.Delete("tenant/2.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get("tenant/2.tar.gz")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Deleted object should not exist, got %v", err)
+	}
+}
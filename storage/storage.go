@@ -1,17 +1,34 @@
 package storage
 
 import (
+	"sync"
+
 	"github.com/ansriaz/redzilla/model"
 	"github.com/sirupsen/logrus"
 )
 
-var store *Store
+var backend Backend
+var stores = make(map[string]*Store)
+var storesMutex sync.Mutex
 
-//GetStore return the store instance
+//GetStore return the store for a collection
 func GetStore(collection string, cfg *model.Config) *Store {
-	if store == nil {
-		logrus.Debugf("Initializing store at %s", cfg.StorePath)
-		store = NewStore(collection, cfg.StorePath)
+
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+
+	if backend == nil {
+		logrus.Debugf("Initializing %s store at %s", cfg.StoreType, cfg.StorePath)
+		b, err := NewBackend(cfg)
+		if err != nil {
+			panic(err)
+		}
+		backend = b
 	}
-	return store
+
+	if _, ok := stores[collection]; !ok {
+		stores[collection] = NewStore(collection, backend)
+	}
+
+	return stores[collection]
 }
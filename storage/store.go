@@ -1,57 +1,96 @@
 package storage
 
 import (
-	"path/filepath"
-
-	"github.com/nanobox-io/golang-scribble"
+	"errors"
+	"os"
+	"time"
 )
 
+// ErrConflict is returned when a record has been modified since it was loaded
+var ErrConflict = errors.New("Record version conflict")
+
+// lockTimeout is the max time to wait for a record lock
+const lockTimeout = time.Second * 5
+
+//Versioned is a record carrying a resource version
+type Versioned interface {
+	GetVersion() int64
+	SetVersion(version int64)
+}
+
 //Store abstract a simple store
 type Store struct {
-	filepath   string
-	db         *scribble.Driver
+	backend    Backend
 	collection string
 }
 
-//NewStore create a new storage
-func NewStore(collection string, path string) *Store {
+//NewStore create a new storage for a collection
+func NewStore(collection string, backend Backend) *Store {
+	return &Store{
+		backend:    backend,
+		collection: collection,
+	}
+}
+
+//Save a record
+func (s Store) Save(id string, record interface{}) error {
+	return s.backend.Write(s.collection, id, record)
+}
+
+//Update save a record only if the stored version matches the expected one,
+//incrementing the record version on success
+func (s Store) Update(id string, record Versioned, expected int64) error {
 
-	// create a new scribble database, providing a destination for the database to live
-	db, err := scribble.New(path, nil)
+	unlock, err := s.backend.Lock(s.collection, id, lockTimeout)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer unlock()
 
-	err = CreateDir(filepath.Join(path, collection))
+	current, err := s.Version(id)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if current != expected {
+		return ErrConflict
 	}
 
-	s := Store{
-		filepath:   path,
-		db:         db,
-		collection: collection,
+	record.SetVersion(expected + 1)
+	err = s.backend.Write(s.collection, id, record)
+	if err != nil {
+		record.SetVersion(expected)
+		return err
 	}
 
-	return &s
+	return nil
 }
 
-//Save a record
-func (s Store) Save(id string, record interface{}) error {
-	return s.db.Write(s.collection, id, record)
+//Version return the stored version of a record, 0 if it does not exists
+func (s Store) Version(id string) (int64, error) {
+	probe := struct {
+		Version int64
+	}{}
+	err := s.backend.Read(s.collection, id, &probe)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return probe.Version, nil
 }
 
 //Load a record
 func (s Store) Load(id string, result interface{}) error {
-	return s.db.Read(s.collection, id, result)
+	return s.backend.Read(s.collection, id, result)
 }
 
 //Delete a record
 func (s Store) Delete(id string) error {
-	return s.db.Delete(s.collection, id)
+	return s.backend.Delete(s.collection, id)
 }
 
 //List all records
 func (s Store) List() ([]string, error) {
-	return s.db.ReadAll(s.collection)
+	return s.backend.ReadAll(s.collection)
 }
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type versionedRecord struct {
+	Name    string
+	Version int64
+}
+
+func (r *versionedRecord) GetVersion() int64 {
+	return r.Version
+}
+
+func (r *versionedRecord) SetVersion(version int64) {
+	r.Version = version
+}
+
+func TestStoreUpdateConflict(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "redzilla-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore("test", b)
+
+	r1 := &versionedRecord{Name: "foo"}
+	err = s.Update("foo", r1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.Version != 1 {
+		t.Fatalf("Expected version 1, got %d", r1.Version)
+	}
+
+	// a second writer holding the old version must fail
+	r2 := &versionedRecord{Name: "foo"}
+	err = s.Update("foo", r2, 0)
+	if err != ErrConflict {
+		t.Fatalf("Expected conflict, got %v", err)
+	}
+
+	err = s.Update("foo", r1, r1.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := s.Version("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("Expected version 2, got %d", version)
+	}
+}